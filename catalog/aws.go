@@ -5,8 +5,11 @@ package catalog
 
 import (
 	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"net"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -24,23 +27,83 @@ const (
 	ConsulSourceKey = "external-source"
 	ConsulAWSNS     = "external-aws-ns"
 	ConsulAWSID     = "external-aws-id"
+	// AWSConsulID is the instance attribute holding the Consul service ID of
+	// instances created from Consul.
+	AWSConsulID = "external-consul-id"
+	// AWSConsulTags is the instance attribute holding the sorted,
+	// comma-separated tags of instances created from Consul.
+	AWSConsulTags = "external-consul-tags"
+	// AWSOptInTagKey is the resource tag that opts an AWS service into being
+	// synced to Consul when opt-in is required.
+	AWSOptInTagKey = "consul-sync"
 )
 
+const (
+	// NamespaceTypeHTTP creates an HTTP namespace when the namespace
+	// doesn't exist yet.
+	NamespaceTypeHTTP = "http"
+	// NamespaceTypeDNSPrivate creates a private DNS namespace associated
+	// with a VPC when the namespace doesn't exist yet.
+	NamespaceTypeDNSPrivate = "dns-private"
+
+	operationPollInterval = time.Second
+	operationTimeout      = 5 * time.Minute
+)
+
+// NamespaceConfig identifies the CloudMap namespace to sync with, either by
+// its ID or by its name. Namespaces referenced by name are created if Create
+// is set and they don't exist yet.
+type NamespaceConfig struct {
+	ID     string
+	Name   string
+	Create bool
+	Type   string
+	VPC    string
+}
+
+func (n NamespaceConfig) String() string {
+	if len(n.ID) > 0 {
+		return n.ID
+	}
+	return n.Name
+}
+
 type awsSyncer struct {
-	lock         sync.RWMutex
-	client       *awssd.Client
+	client       CloudMapClient
 	log          hclog.Logger
 	namespace    *awssdtypes.Namespace
-	services     map[string]service
+	state        state
 	trigger      chan bool
 	consulPrefix string
 	awsPrefix    string
 	toConsul     bool
 	pullInterval time.Duration
 	dnsTTL       int64
+	filter       serviceFilter
+	optIn        bool
+	status       *Status
+	dryRun       bool
+	workers      *workers
+	retries      *retryQueue
+	operations   *operationTracker
+	deploymentID string
+	adopt        bool
+	guard        *RemovalGuard
+	// awsTombstones delays removing instances from this namespace,
+	// consulTombstones removing the instances of this namespace from
+	// Consul.
+	awsTombstones    *tombstones
+	consulTombstones *tombstones
+
+	ownersLock sync.Mutex
+	owners     map[string]owner
+	// dryAdopted are the services adopted in a dry run, which are tagged
+	// by adoptDryRun.
+	dryAdopted []awssdtypes.ServiceSummary
 }
 
 var awsServiceDescription = "Imported from Consul"
+var awsNamespaceDescription = "Created by consul-aws"
 
 func (a *awsSyncer) sync(consul *consul, stop, stopped chan struct{}) {
 	defer close(stopped)
@@ -50,23 +113,39 @@ func (a *awsSyncer) sync(consul *consul, stop, stopped chan struct{}) {
 			if !a.toConsul {
 				continue
 			}
-			create := onlyInFirst(a.getServices(), consul.getServices())
-			count := consul.create(create)
-			if count > 0 {
-				consul.log.Info("created", "count", fmt.Sprintf("%d", count))
-			}
-
-			remove := onlyInFirst(consul.getServices(), a.getServices())
-			count = consul.remove(remove)
-			if count > 0 {
-				consul.log.Info("removed", "count", fmt.Sprintf("%d", count))
-			}
+			run := newSyncRun(consul.log, directionToConsul, *a.namespace.Id, consul.dryRun)
+			a.syncToConsul(consul, run)
+			run.finish()
 		case <-stop:
 			return
 		}
 	}
 }
 
+// syncToConsul creates and removes services and instances in Consul to
+// match the namespace of a.
+func (a *awsSyncer) syncToConsul(consul *consul, run *syncRun) {
+	namespace := *a.namespace.Id
+	source, destination := a.state.load(), consul.state.load()
+	run.log.Trace("reconciling", "aws-version", source.version, "consul-version", destination.version)
+	imported := servicesForNamespace(destination.services, namespace)
+	r := reconcile(source.services, imported, consul.rules(namespace))
+	consul.create(r.create, run)
+	consul.update(r.update, run)
+	consul.clearHealths(r.clear, run)
+	consul.rekey(r.rekey, run)
+
+	synced := func(s service) bool { return s.fromAWS }
+	remove := a.consulTombstones.expired(r.remove, synced, time.Now())
+	metricTombstones.WithLabelValues(run.direction, run.namespace).Set(float64(a.consulTombstones.len()))
+	removals := countNodes(remove, synced)
+	known := countNodes(imported, func(s service) bool { return s.fromAWS })
+	if !a.guard.allow(run, removals, known) {
+		return
+	}
+	consul.remove(remove, run)
+}
+
 func (a *awsSyncer) fetchNamespace(id string) (*awssdtypes.Namespace, error) {
 	resp, err := a.client.GetNamespace(context.Background(), &awssd.GetNamespaceInput{Id: aws.String(id)})
 	if err != nil {
@@ -75,6 +154,88 @@ func (a *awsSyncer) fetchNamespace(id string) (*awssdtypes.Namespace, error) {
 	return resp.Namespace, nil
 }
 
+func (a *awsSyncer) fetchNamespaceID(name string) (string, error) {
+	paginator := awssd.NewListNamespacesPaginator(a.client, &awssd.ListNamespacesInput{
+		Filters: []awssdtypes.NamespaceFilter{{
+			Name:      awssdtypes.NamespaceFilterNameName,
+			Condition: awssdtypes.FilterConditionEq,
+			Values:    []string{name},
+		}},
+	})
+
+	for paginator.HasMorePages() {
+		p, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return "", fmt.Errorf("error paging through namespaces: %s", err)
+		}
+		for _, ns := range p.Namespaces {
+			if ns.Name != nil && *ns.Name == name {
+				return *ns.Id, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+func (a *awsSyncer) createNamespace(config NamespaceConfig) (string, error) {
+	var operationID *string
+	switch config.Type {
+	case NamespaceTypeHTTP, "":
+		resp, err := a.client.CreateHttpNamespace(context.TODO(), &awssd.CreateHttpNamespaceInput{
+			Name:        &config.Name,
+			Description: &awsNamespaceDescription,
+		})
+		if err != nil {
+			return "", err
+		}
+		operationID = resp.OperationId
+	case NamespaceTypeDNSPrivate:
+		resp, err := a.client.CreatePrivateDnsNamespace(context.TODO(), &awssd.CreatePrivateDnsNamespaceInput{
+			Name:        &config.Name,
+			Vpc:         &config.VPC,
+			Description: &awsNamespaceDescription,
+		})
+		if err != nil {
+			return "", err
+		}
+		operationID = resp.OperationId
+	default:
+		return "", fmt.Errorf("unknown namespace type %q", config.Type)
+	}
+
+	operation, err := a.waitForOperation(*operationID)
+	if err != nil {
+		return "", err
+	}
+	id, ok := operation.Targets[string(awssdtypes.OperationTargetTypeNamespace)]
+	if !ok {
+		return "", fmt.Errorf("operation %s did not return a namespace", *operationID)
+	}
+	return id, nil
+}
+
+// waitForOperation polls an asynchronous CloudMap operation until it
+// succeeds, fails or takes longer than operationTimeout.
+func (a *awsSyncer) waitForOperation(id string) (*awssdtypes.Operation, error) {
+	deadline := time.Now().Add(operationTimeout)
+	for {
+		resp, err := a.client.GetOperation(context.TODO(), &awssd.GetOperationInput{OperationId: &id})
+		if err != nil {
+			return nil, err
+		}
+		switch resp.Operation.Status {
+		case awssdtypes.OperationStatusSuccess:
+			return resp.Operation, nil
+		case awssdtypes.OperationStatusFail:
+			return nil, fmt.Errorf("operation %s failed: %s", id, aws.ToString(resp.Operation.ErrorMessage))
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for operation %s", id)
+		}
+		time.Sleep(operationPollInterval)
+	}
+}
+
 func (a *awsSyncer) fetchServices() ([]awssdtypes.ServiceSummary, error) {
 	paginator := awssd.NewListServicesPaginator(a.client, &awssd.ListServicesInput{
 		Filters: []awssdtypes.ServiceFilter{{
@@ -95,7 +256,47 @@ func (a *awsSyncer) fetchServices() ([]awssdtypes.ServiceSummary, error) {
 	return services, nil
 }
 
-func (a *awsSyncer) transformServices(awsServices []awssdtypes.ServiceSummary) map[string]service {
+func (a *awsSyncer) fetchTags(arn string) (map[string]string, error) {
+	resp, err := a.client.ListTagsForResource(context.TODO(), &awssd.ListTagsForResourceInput{
+		ResourceARN: &arn,
+	})
+	if err != nil {
+		return nil, err
+	}
+	tags := make(map[string]string, len(resp.Tags))
+	for _, t := range resp.Tags {
+		tags[aws.ToString(t.Key)] = aws.ToString(t.Value)
+	}
+	return tags, nil
+}
+
+// filterOptedIn drops the services that are not tagged with AWSOptInTagKey
+// when opt-in is required. Services created from Consul are always kept.
+func (a *awsSyncer) filterOptedIn(awsServices []awssdtypes.ServiceSummary, owners map[string]owner) ([]awssdtypes.ServiceSummary, error) {
+	if !a.optIn {
+		return awsServices, nil
+	}
+	result := []awssdtypes.ServiceSummary{}
+	for _, as := range awsServices {
+		if owners[aws.ToString(as.Id)] == ownerNone {
+			tags, err := a.fetchTags(aws.ToString(as.Arn))
+			if err != nil {
+				return nil, fmt.Errorf("error fetching tags of %s: %s", aws.ToString(as.Name), err)
+			}
+			if !isTrue(tags[AWSOptInTagKey]) {
+				a.log.Trace("service not opted in", "name", aws.ToString(as.Name))
+				continue
+			}
+		}
+		result = append(result, as)
+	}
+	return result, nil
+}
+
+// transformServices turns the AWS services into services. Services with an
+// owner are the ones created from Consul, by this deployment or another
+// one.
+func (a *awsSyncer) transformServices(awsServices []awssdtypes.ServiceSummary, owners map[string]owner) map[string]service {
 	services := map[string]service{}
 	for _, as := range awsServices {
 		s := service{
@@ -104,9 +305,14 @@ func (a *awsSyncer) transformServices(awsServices []awssdtypes.ServiceSummary) m
 			awsID:        *as.Id,
 			awsNamespace: *a.namespace.Id,
 		}
-		if as.Description != nil && *as.Description == awsServiceDescription {
+		if o := owners[*as.Id]; o != ownerNone {
 			s.fromConsul = true
+			s.foreign = o != ownerSelf
+			s.legacy = o == ownerLegacy
 			s.name = strings.TrimPrefix(s.name, a.consulPrefix)
+		} else if !a.filter.allow(s.name, nil) {
+			a.log.Trace("service excluded by filter", "name", s.name)
+			continue
 		}
 
 		services[s.name] = s
@@ -114,7 +320,28 @@ func (a *awsSyncer) transformServices(awsServices []awssdtypes.ServiceSummary) m
 	return services
 }
 
-func (a *awsSyncer) setupNamespace(id string) error {
+func (a *awsSyncer) setupNamespace(config NamespaceConfig) error {
+	id := config.ID
+	if len(id) == 0 {
+		var err error
+		id, err = a.fetchNamespaceID(config.Name)
+		if err != nil {
+			return err
+		}
+		if len(id) == 0 {
+			if !config.Create {
+				return fmt.Errorf("namespace %q not found", config.Name)
+			}
+			if a.dryRun {
+				return fmt.Errorf("namespace %q not found, it would be created without -dry-run", config.Name)
+			}
+			a.log.Info("creating namespace", "name", config.Name, "type", config.Type)
+			id, err = a.createNamespace(config)
+			if err != nil {
+				return fmt.Errorf("cannot create namespace %q: %s", config.Name, err)
+			}
+		}
+	}
 	namespace, err := a.fetchNamespace(id)
 	if err != nil {
 		return err
@@ -124,25 +351,72 @@ func (a *awsSyncer) setupNamespace(id string) error {
 }
 
 func (a *awsSyncer) fetch() error {
-	awsService, err := a.fetchServices()
+	start := time.Now()
+	services, err := a.fetchAll()
+	observeFetch(sideAWS, *a.namespace.Id, start, services, err)
 	if err != nil {
 		return err
 	}
-	services := a.transformServices(awsService)
+	a.setServices(services)
+	a.operations.fetched(start)
+	a.status.fetched(sideAWS, *a.namespace.Id)
+	return nil
+}
+
+func (a *awsSyncer) fetchAll() (map[string]service, error) {
+	awsService, err := a.fetchServices()
+	if err != nil {
+		return nil, err
+	}
+	awsService, owners, err := a.resolveOwners(awsService)
+	if err != nil {
+		return nil, err
+	}
+	// Failing to fetch tags must not look like services have opted out,
+	// which would remove them from Consul.
+	awsService, err = a.filterOptedIn(awsService, owners)
+	if err != nil {
+		return nil, err
+	}
+	services := a.transformServices(awsService, owners)
 	for h, s := range services {
+		if s.legacy {
+			continue
+		}
 		var awsNodes []awssdtypes.InstanceSummary
 		var err error
 		name := s.name
 		if s.fromConsul {
 			name = a.consulPrefix + name
 		}
-		awsNodes, err = a.discoverNodes(name)
+		// Services created from Consul carry the Consul health status, so
+		// unhealthy instances have to be discovered as well. Otherwise they
+		// would look like they are missing.
+		healthStatus := awssdtypes.HealthStatusFilterHealthy
+		if s.fromConsul {
+			healthStatus = awssdtypes.HealthStatusFilterAll
+		}
+		awsNodes, err = a.discoverNodes(name, healthStatus)
 		if err != nil {
 			a.log.Error("cannot discover nodes", "error", err)
 			continue
 		}
+		// Instances of other deployments are left alone, and so are
+		// their services.
+		if s.fromConsul {
+			var all bool
+			awsNodes, all = a.ownInstances(awsNodes, owners[s.awsID])
+			if !all {
+				s.foreign = true
+				services[h] = s
+			}
+		}
 
-		nodes := a.transformNodes(awsNodes)
+		var current func(h string, p int) string
+		if s.fromConsul {
+			current = a.instanceID
+		}
+		nodes := a.transformNodes(awsNodes, current)
 		if len(nodes) == 0 {
 			continue
 		}
@@ -153,21 +427,18 @@ func (a *awsSyncer) fetch() error {
 			a.log.Error("cannot fetch healths", "error", err)
 		} else {
 			if s.fromConsul {
-				healths = a.rekeyHealths(s.name, healths)
+				healths = a.rekeyHealths(nodes, healths)
 			}
 			s.healths = healths
 		}
 
 		services[h] = s
 	}
-	a.setServices(services)
-	return nil
+	return services, nil
 }
 
 func (a *awsSyncer) getNodeForConsulID(name, id string) (node, bool) {
-	a.lock.RLock()
-	copy, ok := a.services[name]
-	a.lock.RUnlock()
+	copy, ok := a.getService(name)
 	if !ok {
 		return node{}, ok
 	}
@@ -181,15 +452,19 @@ func (a *awsSyncer) getNodeForConsulID(name, id string) (node, bool) {
 	return node{}, false
 }
 
-func (a *awsSyncer) rekeyHealths(name string, healths map[string]health) map[string]health {
+// rekeyHealths turns healths keyed by AWS instance ID into healths keyed by
+// the Consul service ID of the instances, so they can be compared with the
+// healths fetched from Consul.
+func (a *awsSyncer) rekeyHealths(nodes map[string]map[int]node, healths map[string]health) map[string]health {
 	rekeyed := map[string]health{}
-	s, ok := a.getService(name)
-	if !ok {
-		return nil
-	}
-	for k, h := range s.healths {
-		if n, ok := a.getNodeForConsulID(name, k); ok {
-			rekeyed[id(k, n.host, n.port)] = h
+	for _, ports := range nodes {
+		for _, n := range ports {
+			if len(n.consulID) == 0 {
+				continue
+			}
+			if h, ok := healths[n.awsID]; ok {
+				rekeyed[n.consulID] = h
+			}
 		}
 	}
 	return rekeyed
@@ -208,6 +483,13 @@ func statusFromAWS(aws awssdtypes.HealthStatus) health {
 	return result
 }
 
+func statusToCustomHealth(h health) awssdtypes.CustomHealthStatus {
+	if h == critical {
+		return awssdtypes.CustomHealthStatusUnhealthy
+	}
+	return awssdtypes.CustomHealthStatusHealthy
+}
+
 func (a *awsSyncer) fetchHealths(id string) (map[string]health, error) {
 	paginator := awssd.NewGetInstancesHealthStatusPaginator(a.client, &awssd.GetInstancesHealthStatusInput{
 		ServiceId: &id,
@@ -220,7 +502,7 @@ func (a *awsSyncer) fetchHealths(id string) (map[string]health, error) {
 		var notFound *awssdtypes.InstanceNotFound
 		if errors.As(err, &notFound) {
 			// Note (dans): I think this is the case when all the instances have an unknown health status for a service,
-			// which is fairly common because we don't sync the health status from Consul to AWS (yet).
+			// which is fairly common for services without any health check configuration.
 			a.log.Trace("instance not found", "service-id", id)
 			return result, nil
 		}
@@ -236,20 +518,22 @@ func (a *awsSyncer) fetchHealths(id string) (map[string]health, error) {
 	return result, nil
 }
 
-func (a *awsSyncer) transformNodes(awsNodes []awssdtypes.InstanceSummary) map[string]map[int]node {
+// transformNodes turns the instances of an AWS service into nodes. For
+// services created from Consul, current returns the ID an instance has, so
+// instances left over from an older ID scheme are found.
+func (a *awsSyncer) transformNodes(awsNodes []awssdtypes.InstanceSummary, current func(h string, p int) string) map[string]map[int]node {
 	nodes := map[string]map[int]node{}
 	for _, an := range awsNodes {
 		h := an.Attributes["AWS_INSTANCE_IPV4"]
+		if len(h) == 0 {
+			h = an.Attributes["AWS_INSTANCE_IPV6"]
+		}
 		p := 0
 		if an.Attributes["AWS_INSTANCE_PORT"] != "" {
 			p, _ = strconv.Atoi(an.Attributes["AWS_INSTANCE_PORT"])
 		}
-		if nodes[h] == nil {
-			nodes[h] = map[int]node{}
-		}
-		n := nodes[h]
-		n[p] = node{port: p, host: h, awsID: *an.Id, attributes: an.Attributes}
-		nodes[h] = n
+		n := node{port: p, host: h, awsID: *an.Id, consulID: an.Attributes[AWSConsulID], attributes: an.Attributes}
+		addInstance(nodes, n, func(n node) string { return n.awsID }, current)
 	}
 	return nodes
 }
@@ -270,7 +554,7 @@ func (a *awsSyncer) fetchNodes(id string) ([]awssdtypes.InstanceSummary, error)
 	return nodes, nil
 }
 
-func (a *awsSyncer) discoverNodes(name string) ([]awssdtypes.InstanceSummary, error) {
+func (a *awsSyncer) discoverNodes(name string, healthStatus awssdtypes.HealthStatusFilter) ([]awssdtypes.InstanceSummary, error) {
 	if a.namespace.Properties == nil ||
 		a.namespace.Properties.HttpProperties == nil ||
 		a.namespace.Properties.HttpProperties.HttpName == nil {
@@ -278,7 +562,7 @@ func (a *awsSyncer) discoverNodes(name string) ([]awssdtypes.InstanceSummary, er
 	}
 
 	resp, err := a.client.DiscoverInstances(context.TODO(), &awssd.DiscoverInstancesInput{
-		HealthStatus: awssdtypes.HealthStatusFilterHealthy,
+		HealthStatus: healthStatus,
 		// This is the http name, which can be different from the display name in the event there have been
 		// multiple versions of the namespace (i.e. it has been recreated).
 		NamespaceName: a.namespace.Properties.HttpProperties.HttpName,
@@ -295,142 +579,487 @@ func (a *awsSyncer) discoverNodes(name string) ([]awssdtypes.InstanceSummary, er
 }
 
 func (a *awsSyncer) getServices() map[string]service {
-	a.lock.RLock()
-	copy := a.services
-	a.lock.RUnlock()
-	return copy
+	return a.state.load().services
 }
 
 func (a *awsSyncer) getService(name string) (service, bool) {
-	a.lock.RLock()
-	copy, ok := a.services[name]
-	a.lock.RUnlock()
-	return copy, ok
+	s, ok := a.getServices()[name]
+	return s, ok
 }
 
 func (a *awsSyncer) setServices(services map[string]service) {
-	a.lock.Lock()
-	a.services = services
-	a.lock.Unlock()
+	a.state.replace(services)
 }
 
-func (a *awsSyncer) create(services map[string]service) int {
+func (a *awsSyncer) create(services map[string]service, run *syncRun) {
 	wg := sync.WaitGroup{}
-	count := 0
 	for k, s := range services {
 		if s.fromAWS {
 			continue
 		}
 		name := a.consulPrefix + k
-		if len(s.awsID) == 0 {
+		var dnsConfig *awssdtypes.DnsConfig
+		if a.namespace.Type != awssdtypes.NamespaceTypeHttp {
+			dnsConfig = a.dnsConfig(s.overrides)
+		}
+		if len(s.awsID) == 0 && !run.dryRun(Change{Action: ActionCreateService, Service: name, Attributes: dnsAttributes(dnsConfig)}) {
 			input := awssd.CreateServiceInput{
 				Description: &awsServiceDescription,
 				Name:        &name,
 				NamespaceId: a.namespace.Id,
+				// Lets consul-aws push the health status of Consul
+				// instances with UpdateInstanceCustomHealthStatus.
+				HealthCheckCustomConfig: &awssdtypes.HealthCheckCustomConfig{},
+				Tags:                    a.ownerTags(),
 			}
-			if a.namespace.Type != awssdtypes.NamespaceTypeHttp {
-				input.DnsConfig = &awssdtypes.DnsConfig{
-					DnsRecords: []awssdtypes.DnsRecord{
-						{TTL: &a.dnsTTL, Type: awssdtypes.RecordTypeSrv},
-					},
-				}
-			}
+			input.DnsConfig = dnsConfig
 			resp, err := a.client.CreateService(context.TODO(), &input)
 			if err != nil {
 				var alreadyExists *awssdtypes.ServiceAlreadyExists
-				if !errors.As(err, &alreadyExists) {
-					a.log.Info("service already exists", "name", name)
+				if errors.As(err, &alreadyExists) {
+					a.log.Error("cannot create service in AWS, a service of that name exists", "name", name)
 				} else {
 					a.log.Error("cannot create services in AWS", "error", err.Error())
 				}
+				run.fail(operationCreate)
 				continue
 			}
 			s.awsID = *resp.Service.Id
-			count++
+			a.setOwner(s.awsID, ownerSelf)
+			// Published right away, so syncs triggered by Consul before
+			// the next fetch of AWS register into it instead of creating
+			// it again.
+			a.state.addService(k, service{
+				id:           s.awsID,
+				name:         k,
+				awsID:        s.awsID,
+				awsNamespace: *a.namespace.Id,
+				fromConsul:   true,
+			})
+			run.create()
 		}
-		for h, nodes := range s.nodes {
-			for _, n := range nodes {
-				wg.Add(1)
-				go func(serviceID, name, h string, n node) {
-					wg.Done()
-					instanceID := id(serviceID, h, n.port)
-					attributes := n.attributes
-					attributes["AWS_INSTANCE_IPV4"] = h
-					attributes["AWS_INSTANCE_PORT"] = fmt.Sprintf("%d", n.port)
-					_, err := a.client.RegisterInstance(context.TODO(), &awssd.RegisterInstanceInput{
-						ServiceId:  &serviceID,
-						Attributes: attributes,
-						InstanceId: &instanceID,
-					})
-					if err != nil {
-						a.log.Error("cannot create nodes", "error", err.Error())
-					}
-				}(s.awsID, name, h, n)
+		// Healths are only updated once the instances of the service are
+		// registered.
+		registered := &sync.WaitGroup{}
+		a.register(&wg, registered, name, s, ActionRegisterInstance, run, nil)
+		current, _ := a.getService(k)
+		for consulID, h := range s.healths {
+			instanceID, ok := a.instanceIDForConsulID(k, s, consulID)
+			if !ok {
+				continue
 			}
+			if ch, ok := current.healths[consulID]; ok && ch != unknown && statusToCustomHealth(ch) == statusToCustomHealth(h) {
+				continue
+			}
+			if run.dryRun(Change{Action: ActionUpdateHealth, Service: name, Instance: instanceID, Health: string(statusToCustomHealth(h))}) {
+				continue
+			}
+			a.updateHealth(&wg, registered, name, s.awsID, instanceID, h, run)
+		}
+	}
+	wg.Wait()
+}
+
+// update registers the instances whose attributes changed again.
+func (a *awsSyncer) update(services map[string]service, run *syncRun) {
+	wg := sync.WaitGroup{}
+	for k, s := range services {
+		if !s.fromConsul || s.fromAWS || len(s.awsID) == 0 {
+			continue
+		}
+		a.register(&wg, &sync.WaitGroup{}, a.consulPrefix+k, s, ActionUpdateInstance, run, nil)
+	}
+	wg.Wait()
+}
+
+// rekey registers the instances that were registered under an older ID
+// scheme again under their current ID, with their health, and deregisters
+// the stale ones once replaced, so they are never missing.
+func (a *awsSyncer) rekey(services map[string]service, run *syncRun) {
+	type replaced struct {
+		name      string
+		serviceID string
+		staleIDs  []string
+	}
+	lock := sync.Mutex{}
+	done := []replaced{}
+
+	wg := sync.WaitGroup{}
+	for k, s := range services {
+		if !s.fromConsul || s.fromAWS || len(s.awsID) == 0 {
+			continue
+		}
+		name := a.consulPrefix + k
+		serviceID := s.awsID
+		registered := &sync.WaitGroup{}
+		a.register(&wg, registered, name, s, ActionRekeyInstance, run, func(n node) {
+			lock.Lock()
+			done = append(done, replaced{name: name, serviceID: serviceID, staleIDs: n.staleIDs})
+			lock.Unlock()
+		})
+		for consulID, h := range s.healths {
+			instanceID, ok := a.instanceIDForConsulID(k, s, consulID)
+			if !ok {
+				continue
+			}
+			if run.dryRun(Change{Action: ActionUpdateHealth, Service: name, Instance: instanceID, Health: string(statusToCustomHealth(h))}) {
+				continue
+			}
+			a.updateHealth(&wg, registered, name, serviceID, instanceID, h, run)
+		}
+	}
+	wg.Wait()
+
+	for _, r := range done {
+		for _, staleID := range r.staleIDs {
+			a.deregister(&wg, r.name, r.serviceID, staleID, run, func(err error) {
+				if err != nil {
+					a.log.Error("cannot remove instance", "id", staleID, "error", err.Error())
+					run.fail(operationRemove)
+				}
+			})
 		}
-		// for instanceID, h := range s.healths {
-		// 	wg.Add(1)
-		// 	go func(serviceID, instanceID string, h health) {
-		// 		defer wg.Done()
-		// 		req := a.client.UpdateInstanceCustomHealthStatusRequest(&awssd.UpdateInstanceCustomHealthStatusInput{
-		// 			ServiceId:  &serviceID,
-		// 			InstanceId: &instanceID,
-		// 			Status:     statusToCustomHealth(h),
-		// 		})
-		// 		_, err := req.Send()
-		// 		if err != nil {
-		// 			a.log.Error("cannot create custom health", "error", err.Error())
-		// 		}
-		// 	}(s.awsID, instanceID, h)
-		// }
+		a.log.Debug("rekeyed instances", "service", r.name, "stale", r.staleIDs)
 	}
 	wg.Wait()
-	return count
 }
 
-func (a *awsSyncer) remove(services map[string]service) int {
+// clearHealths marks the instances whose Consul service instances have no
+// checks anymore as healthy.
+func (a *awsSyncer) clearHealths(services map[string]service, run *syncRun) {
 	wg := sync.WaitGroup{}
-	for _, s := range services {
+	for k, s := range services {
+		if !s.fromConsul || s.fromAWS || len(s.awsID) == 0 {
+			continue
+		}
+		name := a.consulPrefix + k
+		for consulID, h := range s.healths {
+			if statusToCustomHealth(h) == awssdtypes.CustomHealthStatusHealthy {
+				continue
+			}
+			instanceID, ok := a.instanceIDForConsulID(k, s, consulID)
+			if !ok {
+				continue
+			}
+			if run.dryRun(Change{Action: ActionClearHealth, Service: name, Instance: instanceID}) {
+				continue
+			}
+			a.updateHealth(&wg, &sync.WaitGroup{}, name, s.awsID, instanceID, passing, run)
+		}
+	}
+	wg.Wait()
+}
+
+// register registers the instances of the service, which are new with
+// ActionRegisterInstance, changed with ActionUpdateInstance and registered
+// under an older ID scheme with ActionRekeyInstance. registered is done
+// once the registrations are made, and done, if set, is called with every
+// node registered.
+func (a *awsSyncer) register(wg, registered *sync.WaitGroup, name string, s service, action string, run *syncRun, done func(n node)) {
+	operation := operationCreate
+	if action != ActionRegisterInstance {
+		operation = operationUpdate
+	}
+	for h, nodes := range s.nodes {
+		for _, n := range nodes {
+			instanceID := a.instanceID(h, n.port)
+			attributes := a.instanceAttributes(n)
+			if run.dryRun(Change{Action: action, Service: name, Instance: instanceID, Address: h, Port: n.port, Attributes: attributes}) {
+				continue
+			}
+			serviceID := s.awsID
+			if a.operations.pending(serviceID, instanceID) {
+				a.log.Debug("operation pending, not registering instance", "service", name, "instance", instanceID)
+				continue
+			}
+			registered.Add(1)
+			m := mutation{
+				action:     action,
+				operation:  operation,
+				service:    name,
+				serviceID:  serviceID,
+				instanceID: instanceID,
+			}
+			m.fn = func() error {
+				resp, err := a.client.RegisterInstance(context.TODO(), &awssd.RegisterInstanceInput{
+					ServiceId:  &serviceID,
+					Attributes: attributes,
+					InstanceId: &instanceID,
+				})
+				if err != nil {
+					return err
+				}
+				a.operations.track(m, resp.OperationId, run, time.Now())
+				return nil
+			}
+			a.mutate(wg, m, func(err error) {
+				defer registered.Done()
+				switch {
+				case err != nil:
+					a.log.Error("cannot register instance", "action", action, "error", err.Error())
+					run.fail(operation)
+					return
+				case action == ActionRegisterInstance:
+					run.create()
+				default:
+					run.update()
+				}
+				if done != nil {
+					done(n)
+				}
+			})
+		}
+	}
+}
+
+// updateHealth sets the custom health of an instance once the
+// registrations are made.
+func (a *awsSyncer) updateHealth(wg, registered *sync.WaitGroup, name, serviceID, instanceID string, h health, run *syncRun) {
+	a.mutate(wg, mutation{
+		action:     ActionUpdateHealth,
+		operation:  operationHealth,
+		service:    name,
+		serviceID:  serviceID,
+		instanceID: instanceID,
+		fn: func() error {
+			registered.Wait()
+			_, err := a.client.UpdateInstanceCustomHealthStatus(context.TODO(), &awssd.UpdateInstanceCustomHealthStatusInput{
+				ServiceId:  &serviceID,
+				InstanceId: &instanceID,
+				Status:     statusToCustomHealth(h),
+			})
+			return err
+		},
+	}, func(err error) {
+		if err != nil {
+			var notFound *awssdtypes.CustomHealthNotFound
+			if errors.As(err, &notFound) {
+				// Services created before health syncing have no
+				// custom health check configuration.
+				a.log.Debug("service has no custom health check", "id", serviceID)
+			} else {
+				a.log.Error("cannot update custom health", "error", err.Error())
+				run.fail(operationHealth)
+			}
+		}
+	})
+}
+
+// maxInstanceIDLength is the length of the longest instance ID CloudMap
+// accepts.
+const maxInstanceIDLength = 64
+
+// instanceID returns the ID of the AWS instance registered by this
+// deployment for the Consul service instance at host h and port p. IDs too
+// long for CloudMap, like the ones of long hostnames, are hashed. The host,
+// port and Consul service ID are found in the attributes of the instance,
+// they are never parsed from the ID.
+func (a *awsSyncer) instanceID(h string, p int) string {
+	id := encodeID(h, strconv.Itoa(p), a.deploymentID)
+	if len(id) > maxInstanceIDLength {
+		return fmt.Sprintf("%x", sha256.Sum256([]byte(id)))
+	}
+	return id
+}
+
+// staleIDs returns the IDs of the instance n that aren't its current ID.
+func (a *awsSyncer) staleIDs(n node) []string {
+	stale := append([]string{}, n.staleIDs...)
+	if n.awsID != a.instanceID(n.host, n.port) {
+		stale = append(stale, n.awsID)
+	}
+	return stale
+}
+
+// instanceAttributes returns the attributes of the AWS instance registered
+// for a Consul service instance.
+func (a *awsSyncer) instanceAttributes(n node) map[string]string {
+	attributes := map[string]string{}
+	for k, v := range n.attributes {
+		attributes[k] = v
+	}
+	if ip := net.ParseIP(n.host); ip != nil && ip.To4() == nil {
+		attributes["AWS_INSTANCE_IPV6"] = n.host
+	} else {
+		attributes["AWS_INSTANCE_IPV4"] = n.host
+	}
+	attributes["AWS_INSTANCE_PORT"] = fmt.Sprintf("%d", n.port)
+	attributes[AWSConsulID] = n.consulID
+	attributes[DeploymentKey] = a.deploymentID
+	if len(n.tags) > 0 {
+		tags := append([]string{}, n.tags...)
+		sort.Strings(tags)
+		attributes[AWSConsulTags] = strings.Join(tags, ",")
+	}
+	return attributes
+}
+
+// rules returns how the Consul services are reconciled with the services
+// of the namespace.
+func (a *awsSyncer) rules() reconcileRules {
+	return reconcileRules{
+		attributes: func(s service, n node) map[string]string { return a.instanceAttributes(n) },
+		healthKey:  func(n node) string { return n.consulID },
+		staleIDs:   func(_ string, n node) []string { return a.staleIDs(n) },
+	}
+}
+
+// dnsConfig returns the DNS configuration for a new service, which has SRV
+// records with the configured TTL unless overridden for the service.
+func (a *awsSyncer) dnsConfig(o overrides) *awssdtypes.DnsConfig {
+	ttl := a.dnsTTL
+	if o.ttl > 0 {
+		ttl = o.ttl
+	}
+	recordTypes := []awssdtypes.RecordType{awssdtypes.RecordTypeSrv}
+	if len(o.recordTypes) > 0 {
+		recordTypes = nil
+		for _, t := range o.recordTypes {
+			recordTypes = append(recordTypes, awssdtypes.RecordType(t))
+		}
+	}
+	config := &awssdtypes.DnsConfig{
+		RoutingPolicy: awssdtypes.RoutingPolicy(o.routingPolicy),
+	}
+	for _, t := range recordTypes {
+		config.DnsRecords = append(config.DnsRecords, awssdtypes.DnsRecord{TTL: aws.Int64(ttl), Type: t})
+	}
+	return config
+}
+
+// dnsAttributes returns the DNS settings of a service as recorded in its
+// create-service change, or nil without DNS settings.
+func dnsAttributes(config *awssdtypes.DnsConfig) map[string]string {
+	if config == nil {
+		return nil
+	}
+	attributes := map[string]string{}
+	if config.RoutingPolicy != "" {
+		attributes["routing-policy"] = string(config.RoutingPolicy)
+	}
+	for _, r := range config.DnsRecords {
+		attributes["ttl-"+string(r.Type)] = strconv.FormatInt(aws.ToInt64(r.TTL), 10)
+	}
+	return attributes
+}
+
+// instanceIDForConsulID returns the ID of the AWS instance created for the
+// Consul service instance with the given ID, either from the nodes about to
+// be created or from the instances already known in AWS.
+func (a *awsSyncer) instanceIDForConsulID(name string, s service, consulID string) (string, bool) {
+	for h, nodes := range s.nodes {
+		for _, n := range nodes {
+			if n.consulID == consulID {
+				return a.instanceID(h, n.port), true
+			}
+		}
+	}
+	if n, ok := a.getNodeForConsulID(name, consulID); ok {
+		return n.awsID, true
+	}
+	return "", false
+}
+
+func (a *awsSyncer) remove(services map[string]service, run *syncRun) {
+	wg := sync.WaitGroup{}
+	for k, s := range services {
 		if !s.fromConsul || len(s.awsID) == 0 {
 			continue
 		}
+		name := a.consulPrefix + k
 		for h, nodes := range s.nodes {
 			for _, n := range nodes {
-				wg.Add(1)
-				go func(serviceID, id string) {
-					defer wg.Done()
-					_, err := a.client.DeregisterInstance(context.TODO(), &awssd.DeregisterInstanceInput{
-						ServiceId:  &serviceID,
-						InstanceId: &id,
-					})
+				if run.dryRun(Change{Action: ActionDeregisterInstance, Service: name, Instance: n.awsID, Address: h, Port: n.port}) {
+					continue
+				}
+				a.deregister(&wg, name, s.awsID, n.awsID, run, func(err error) {
 					if err != nil {
 						a.log.Error("cannot remove instance", "error", err.Error())
+						run.fail(operationRemove)
+					} else {
+						run.remove()
 					}
-				}(s.awsID, id(s.awsID, h, n.port))
+				})
+				for _, staleID := range n.staleIDs {
+					a.deregister(&wg, name, s.awsID, staleID, run, func(err error) {
+						if err != nil {
+							a.log.Error("cannot remove instance", "id", staleID, "error", err.Error())
+							run.fail(operationRemove)
+						}
+					})
+				}
 			}
 		}
 	}
 	wg.Wait()
 
-	count := 0
 	for k, s := range services {
 		if !s.fromConsul || len(s.awsID) == 0 {
 			continue
 		}
 		origService, _ := a.getService(k)
-		if len(s.nodes) < len(origService.nodes) {
+		if len(s.nodes) < len(origService.nodes) || origService.foreign {
 			continue
 		}
-		_, err := a.client.DeleteService(context.TODO(), &awssd.DeleteServiceInput{
-			Id: &s.awsID,
+		if run.dryRun(Change{Action: ActionDeleteService, Service: a.consulPrefix + k}) {
+			continue
+		}
+		// CloudMap doesn't delete services with instances, so services are
+		// only deleted once their instances are deregistered.
+		if a.operations.pendingService(s.awsID) {
+			a.log.Debug("operations pending, not deleting service", "name", a.consulPrefix+k)
+			continue
+		}
+		serviceID := s.awsID
+		a.mutate(&wg, mutation{
+			action:    ActionDeleteService,
+			operation: operationRemove,
+			service:   a.consulPrefix + k,
+			serviceID: serviceID,
+			fn: func() error {
+				_, err := a.client.DeleteService(context.TODO(), &awssd.DeleteServiceInput{
+					Id: &serviceID,
+				})
+				return err
+			},
+		}, func(err error) {
+			if err != nil {
+				a.log.Error("cannot remove services", "name", k, "id", serviceID, "error", err.Error())
+				run.fail(operationRemove)
+			} else {
+				run.remove()
+			}
+		})
+	}
+	wg.Wait()
+}
+
+// deregister deregisters an instance of a service, unless an operation on
+// it is pending, and calls done with the result.
+func (a *awsSyncer) deregister(wg *sync.WaitGroup, name, serviceID, instanceID string, run *syncRun, done func(error)) {
+	if a.operations.pending(serviceID, instanceID) {
+		a.log.Debug("operation pending, not deregistering instance", "service", name, "instance", instanceID)
+		return
+	}
+	m := mutation{
+		action:     ActionDeregisterInstance,
+		operation:  operationRemove,
+		service:    name,
+		serviceID:  serviceID,
+		instanceID: instanceID,
+	}
+	m.fn = func() error {
+		resp, err := a.client.DeregisterInstance(context.TODO(), &awssd.DeregisterInstanceInput{
+			ServiceId:  &serviceID,
+			InstanceId: &instanceID,
 		})
 		if err != nil {
-			a.log.Error("cannot remove services", "name", k, "id", s.awsID, "error", err.Error())
-		} else {
-			count++
+			return err
 		}
+		a.operations.track(m, resp.OperationId, run, time.Now())
+		return nil
 	}
-	return count
+	a.mutate(wg, m, done)
 }
 
 func (a *awsSyncer) fetchIndefinetely(stop, stopped chan struct{}) {
@@ -4,10 +4,13 @@
 package catalog
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	awssdtypes "github.com/aws/aws-sdk-go-v2/service/servicediscovery/types"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-hclog"
 	"github.com/stretchr/testify/require"
 )
 
@@ -35,18 +38,143 @@ func TestAWSTransformNodes(t *testing.T) {
 			4: {port: 4, host: "1.1.1.4", awsID: "five", attributes: map[string]string{"AWS_INSTANCE_IPV4": "1.1.1.4", "AWS_INSTANCE_PORT": "4", "custom": "aha"}},
 		},
 	}
-	require.Equal(t, expected, a.transformNodes(nodes))
+	require.Equal(t, expected, a.transformNodes(nodes, nil))
+}
+
+func TestAWSTransformNodes_StaleIDs(t *testing.T) {
+	a := awsSyncer{deploymentID: DefaultDeploymentID}
+	attributes := map[string]string{"AWS_INSTANCE_IPV4": "1.1.1.1", "AWS_INSTANCE_PORT": "1"}
+	current := a.instanceID("1.1.1.1", 1)
+	nodes := []awssdtypes.InstanceSummary{
+		{Id: aws.String("srv-1_1.1.1.1_1"), Attributes: attributes},
+		{Id: aws.String(current), Attributes: attributes},
+		{Id: aws.String("other"), Attributes: attributes},
+	}
+	expected := map[string]map[int]node{
+		"1.1.1.1": {1: {port: 1, host: "1.1.1.1", awsID: current, attributes: attributes, staleIDs: []string{"srv-1_1.1.1.1_1", "other"}}},
+	}
+	require.Equal(t, expected, a.transformNodes(nodes, a.instanceID))
+}
+
+func TestAWSInstanceID(t *testing.T) {
+	a := awsSyncer{deploymentID: DefaultDeploymentID}
+	require.Equal(t, "10.0.0.1_80_default", a.instanceID("10.0.0.1", 80))
+	require.Equal(t, "fd00::1_80_default", a.instanceID("fd00::1", 80))
+	require.Equal(t, "my@5fhost_80_default", a.instanceID("my_host", 80))
+	require.NotEqual(t, a.instanceID("10.0.0.1", 80), (&awsSyncer{deploymentID: "eu"}).instanceID("10.0.0.1", 80))
+
+	long := strings.Repeat("a", 63) + ".example.com"
+	id := a.instanceID(long, 80)
+	require.Len(t, id, maxInstanceIDLength)
+	require.NotEqual(t, id, a.instanceID(long, 81))
+
+	require.Empty(t, a.staleIDs(node{host: "10.0.0.1", port: 80, awsID: "10.0.0.1_80_default"}))
+	require.Equal(t, []string{"srv-1_10.0.0.1_80"}, a.staleIDs(node{host: "10.0.0.1", port: 80, awsID: "srv-1_10.0.0.1_80"}))
 }
 
 func TestAWSTransformServices(t *testing.T) {
-	a := awsSyncer{}
+	a := awsSyncer{namespace: &awssdtypes.Namespace{Id: aws.String("ns1")}}
 	services := []awssdtypes.ServiceSummary{
-		{Id: aws.String("one"), Name: aws.String("web"), Description: &awsServiceDescription},
+		{Id: aws.String("one"), Name: aws.String("web")},
 		{Id: aws.String("two"), Name: aws.String("redis")},
+		{Id: aws.String("three"), Name: aws.String("api")},
 	}
 	expected := map[string]service{
-		"web":   {id: "one", name: "web", awsID: "one", fromConsul: true},
-		"redis": {id: "two", name: "redis", awsID: "two", fromConsul: false},
+		"web":   {id: "one", name: "web", awsID: "one", awsNamespace: "ns1", fromConsul: true},
+		"redis": {id: "two", name: "redis", awsID: "two", awsNamespace: "ns1", fromConsul: false},
+		"api":   {id: "three", name: "api", awsID: "three", awsNamespace: "ns1", fromConsul: true, foreign: true},
+	}
+	require.Equal(t, expected, a.transformServices(services, map[string]owner{"one": ownerSelf, "three": ownerOther}))
+}
+
+func TestAWSTransformServices_Filter(t *testing.T) {
+	filter, err := newServiceFilter(Filter{Include: []string{"web*"}})
+	require.NoError(t, err)
+	a := awsSyncer{namespace: &awssdtypes.Namespace{Id: aws.String("ns1")}, filter: filter, log: hclog.NewNullLogger()}
+	services := []awssdtypes.ServiceSummary{
+		{Id: aws.String("one"), Name: aws.String("redis")},
+		{Id: aws.String("two"), Name: aws.String("redis")},
+		{Id: aws.String("three"), Name: aws.String("web-1")},
+	}
+	expected := map[string]service{
+		"redis": {id: "one", name: "redis", awsID: "one", awsNamespace: "ns1", fromConsul: true},
+		"web-1": {id: "three", name: "web-1", awsID: "three", awsNamespace: "ns1"},
+	}
+	require.Equal(t, expected, a.transformServices(services, map[string]owner{"one": ownerSelf}))
+}
+
+func TestAWSRekeyHealths(t *testing.T) {
+	a := awsSyncer{}
+	nodes := map[string]map[int]node{
+		"1.1.1.1": {
+			1: {port: 1, host: "1.1.1.1", awsID: "i1", consulID: "web1"},
+			2: {port: 2, host: "1.1.1.1", awsID: "i2", consulID: "web2"},
+		},
+		"1.1.1.2": {
+			1: {port: 1, host: "1.1.1.2", awsID: "i3"},
+		},
 	}
-	require.Equal(t, expected, a.transformServices(services))
+	healths := map[string]health{"i1": passing, "i2": critical, "i3": passing}
+	expected := map[string]health{"web1": passing, "web2": critical}
+	require.Equal(t, expected, a.rekeyHealths(nodes, healths))
+}
+
+func TestStatusToCustomHealth(t *testing.T) {
+	require.Equal(t, awssdtypes.CustomHealthStatusHealthy, statusToCustomHealth(passing))
+	require.Equal(t, awssdtypes.CustomHealthStatusHealthy, statusToCustomHealth(unknown))
+	require.Equal(t, awssdtypes.CustomHealthStatusUnhealthy, statusToCustomHealth(critical))
+}
+
+func TestAWSDNSConfig(t *testing.T) {
+	a := awsSyncer{dnsTTL: 60}
+	require.Equal(t, &awssdtypes.DnsConfig{
+		DnsRecords: []awssdtypes.DnsRecord{{TTL: aws.Int64(60), Type: awssdtypes.RecordTypeSrv}},
+	}, a.dnsConfig(overrides{}))
+	require.Equal(t, &awssdtypes.DnsConfig{
+		RoutingPolicy: awssdtypes.RoutingPolicyWeighted,
+		DnsRecords: []awssdtypes.DnsRecord{
+			{TTL: aws.Int64(10), Type: awssdtypes.RecordTypeA},
+			{TTL: aws.Int64(10), Type: awssdtypes.RecordTypeAaaa},
+		},
+	}, a.dnsConfig(overrides{ttl: 10, routingPolicy: "WEIGHTED", recordTypes: []string{"A", "AAAA"}}))
+}
+
+func TestDNSAttributes(t *testing.T) {
+	a := awsSyncer{dnsTTL: 60}
+	require.Nil(t, dnsAttributes(nil))
+	require.Equal(t, map[string]string{"ttl-SRV": "60"}, dnsAttributes(a.dnsConfig(overrides{})))
+	require.Equal(t, map[string]string{"routing-policy": "WEIGHTED", "ttl-A": "10"},
+		dnsAttributes(a.dnsConfig(overrides{ttl: 10, routingPolicy: "WEIGHTED", recordTypes: []string{"A"}})))
+}
+
+// TestAWSCreate_BeforeFetch syncs to AWS again before AWS is fetched, like
+// a sync triggered by a change in Consul, which registers into the service
+// created by the first sync instead of creating it again.
+func TestAWSCreate_BeforeFetch(t *testing.T) {
+	cloudMap, awsClient := newFakeCloudMap(t)
+	consul, consulClient := newFakeConsul(t)
+	config := Config{
+		ToAWS:        true,
+		Namespaces:   []NamespaceConfig{{ID: fakeNamespaceID}},
+		ConsulPrefix: "consul_",
+	}
+	consul.registerService(&api.AgentService{ID: "web1", Service: "web", Address: "10.0.0.1", Port: 80}, "")
+	s, err := newSyncer(config, awsClient, consulClient)
+	require.NoError(t, err)
+	require.NoError(t, s.fetch())
+	a := s.awsSyncers[0]
+
+	run := newSyncRun(a.log, directionToAWS, fakeNamespaceID, false)
+	s.consul.syncToAWS(a, run)
+	require.Equal(t, int64(2), run.created.Load())
+	s.waitForOperations()
+
+	consul.registerService(&api.AgentService{ID: "web2", Service: "web", Address: "10.0.0.2", Port: 80}, "")
+	_, err = s.consul.fetch(0)
+	require.NoError(t, err)
+	run = newSyncRun(a.log, directionToAWS, fakeNamespaceID, false)
+	s.consul.syncToAWS(a, run)
+	require.Zero(t, run.failed.Load())
+	s.waitForOperations()
+	require.Len(t, cloudMap.instances("consul_web"), 2)
 }
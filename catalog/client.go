@@ -0,0 +1,95 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package catalog
+
+import (
+	"context"
+
+	awssd "github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+	"github.com/hashicorp/consul/api"
+)
+
+// CloudMapClient is the part of the CloudMap API used by consul-aws.
+// *servicediscovery.Client implements it.
+type CloudMapClient interface {
+	awssd.ListNamespacesAPIClient
+	awssd.ListServicesAPIClient
+	awssd.ListInstancesAPIClient
+	awssd.GetInstancesHealthStatusAPIClient
+
+	GetNamespace(context.Context, *awssd.GetNamespaceInput, ...func(*awssd.Options)) (*awssd.GetNamespaceOutput, error)
+	CreateHttpNamespace(context.Context, *awssd.CreateHttpNamespaceInput, ...func(*awssd.Options)) (*awssd.CreateHttpNamespaceOutput, error)
+	CreatePrivateDnsNamespace(context.Context, *awssd.CreatePrivateDnsNamespaceInput, ...func(*awssd.Options)) (*awssd.CreatePrivateDnsNamespaceOutput, error)
+	GetOperation(context.Context, *awssd.GetOperationInput, ...func(*awssd.Options)) (*awssd.GetOperationOutput, error)
+	TagResource(context.Context, *awssd.TagResourceInput, ...func(*awssd.Options)) (*awssd.TagResourceOutput, error)
+	ListTagsForResource(context.Context, *awssd.ListTagsForResourceInput, ...func(*awssd.Options)) (*awssd.ListTagsForResourceOutput, error)
+	CreateService(context.Context, *awssd.CreateServiceInput, ...func(*awssd.Options)) (*awssd.CreateServiceOutput, error)
+	DeleteService(context.Context, *awssd.DeleteServiceInput, ...func(*awssd.Options)) (*awssd.DeleteServiceOutput, error)
+	DiscoverInstances(context.Context, *awssd.DiscoverInstancesInput, ...func(*awssd.Options)) (*awssd.DiscoverInstancesOutput, error)
+	RegisterInstance(context.Context, *awssd.RegisterInstanceInput, ...func(*awssd.Options)) (*awssd.RegisterInstanceOutput, error)
+	DeregisterInstance(context.Context, *awssd.DeregisterInstanceInput, ...func(*awssd.Options)) (*awssd.DeregisterInstanceOutput, error)
+	UpdateInstanceCustomHealthStatus(context.Context, *awssd.UpdateInstanceCustomHealthStatusInput, ...func(*awssd.Options)) (*awssd.UpdateInstanceCustomHealthStatusOutput, error)
+}
+
+// ConsulClient is the part of the Consul API used by consul-aws. Use
+// NewConsulClient to wrap an *api.Client.
+type ConsulClient interface {
+	Catalog() ConsulCatalog
+	Health() ConsulHealth
+	KV() ConsulKV
+	// LockOpts is only used for leader election, see Config.LockKey.
+	LockOpts(opts *api.LockOptions) (ConsulLocker, error)
+}
+
+// ConsulLocker is the lock on a KV key used for leader election. *api.Lock
+// implements it.
+type ConsulLocker interface {
+	Lock(stopCh <-chan struct{}) (<-chan struct{}, error)
+	Unlock() error
+}
+
+// ConsulCatalog is the part of the catalog endpoints used by consul-aws.
+// *api.Catalog implements it.
+type ConsulCatalog interface {
+	Services(q *api.QueryOptions) (map[string][]string, *api.QueryMeta, error)
+	Service(service, tag string, q *api.QueryOptions) ([]*api.CatalogService, *api.QueryMeta, error)
+	Node(node string, q *api.QueryOptions) (*api.CatalogNode, *api.QueryMeta, error)
+	Register(reg *api.CatalogRegistration, q *api.WriteOptions) (*api.WriteMeta, error)
+	Deregister(dereg *api.CatalogDeregistration, q *api.WriteOptions) (*api.WriteMeta, error)
+}
+
+// ConsulHealth is the part of the health endpoints used by consul-aws.
+// *api.Health implements it.
+type ConsulHealth interface {
+	Checks(service string, q *api.QueryOptions) (api.HealthChecks, *api.QueryMeta, error)
+}
+
+// ConsulKV is the part of the KV endpoints used by consul-aws. *api.KV
+// implements it.
+type ConsulKV interface {
+	Get(key string, q *api.QueryOptions) (*api.KVPair, *api.QueryMeta, error)
+}
+
+type consulAPIClient struct {
+	client *api.Client
+}
+
+// NewConsulClient returns a ConsulClient using the Consul API client.
+func NewConsulClient(client *api.Client) ConsulClient {
+	return consulAPIClient{client: client}
+}
+
+func (c consulAPIClient) Catalog() ConsulCatalog { return c.client.Catalog() }
+func (c consulAPIClient) Health() ConsulHealth   { return c.client.Health() }
+func (c consulAPIClient) KV() ConsulKV           { return c.client.KV() }
+func (c consulAPIClient) LockOpts(opts *api.LockOptions) (ConsulLocker, error) {
+	lock, err := c.client.LockOpts(opts)
+	if err != nil {
+		return nil, err
+	}
+	return lock, nil
+}
+
+var _ CloudMapClient = (*awssd.Client)(nil)
+var _ ConsulLocker = (*api.Lock)(nil)
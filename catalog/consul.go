@@ -5,6 +5,7 @@ package catalog
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -16,61 +17,54 @@ import (
 const (
 	ConsulAWSNodeName = "consul-aws"
 	WaitTime          = 10
+	// ConsulOptInMetaKey is the service meta key that opts a Consul service
+	// into being synced to AWS when opt-in is required.
+	ConsulOptInMetaKey = "cloudmap-sync"
+
+	// ConsulCloudMapNameKey is the service meta key overriding the name of
+	// the service created in AWS. The consul service prefix still applies.
+	ConsulCloudMapNameKey = "cloudmap-name"
+	// ConsulCloudMapTTLKey is the service meta key overriding the TTL in
+	// seconds of the DNS records of the service created in AWS.
+	ConsulCloudMapTTLKey = "cloudmap-ttl"
+	// ConsulCloudMapRoutingPolicyKey is the service meta key setting the
+	// routing policy of the service created in AWS: MULTIVALUE or WEIGHTED.
+	ConsulCloudMapRoutingPolicyKey = "cloudmap-routing-policy"
+	// ConsulCloudMapRecordTypesKey is the service meta key overriding the
+	// comma separated DNS record types of the service created in AWS, for
+	// example "A,SRV".
+	ConsulCloudMapRecordTypesKey = "cloudmap-record-types"
 )
 
 type consul struct {
-	client       *api.Client
+	client       ConsulClient
 	log          hclog.Logger
 	consulPrefix string
 	awsPrefix    string
-	services     map[string]service
+	state        state
 	trigger      chan bool
-	lock         sync.RWMutex
 	toAWS        bool
 	stale        bool
+	filter       serviceFilter
+	optIn        bool
+	status       *Status
+	dryRun       bool
+	deploymentID string
+	adopt        bool
+	guard        *RemovalGuard
 }
 
 func (c *consul) getServices() map[string]service {
-	c.lock.RLock()
-	copy := c.services
-	c.lock.RUnlock()
-	return copy
+	return c.state.load().services
 }
 
 func (c *consul) getService(name string) (service, bool) {
-	c.lock.RLock()
-	copy, ok := c.services[name]
-	c.lock.RUnlock()
-	return copy, ok
-}
-
-func (c *consul) getAWSID(name, host string, port int) (string, bool) {
-	if n, ok := c.getNode(name, host, port); ok {
-		return n.awsID, true
-	}
-	return "", false
-}
-
-func (c *consul) getNode(name, host string, port int) (node, bool) {
-	c.lock.RLock()
-	copy, ok := c.services[name]
-	c.lock.RUnlock()
-	if ok {
-		if nodes, ok := copy.nodes[host]; ok {
-			for _, n := range nodes {
-				if n.port == port {
-					return n, true
-				}
-			}
-		}
-	}
-	return node{}, false
+	s, ok := c.getServices()[name]
+	return s, ok
 }
 
 func (c *consul) getNodeForAWSID(name, id string) (node, bool) {
-	c.lock.RLock()
-	copy, ok := c.services[name]
-	c.lock.RUnlock()
+	copy, ok := c.getService(name)
 	if !ok {
 		return node{}, ok
 	}
@@ -86,31 +80,33 @@ func (c *consul) getNodeForAWSID(name, id string) (node, bool) {
 }
 
 func (c *consul) setServices(services map[string]service) {
-	c.lock.Lock()
-	c.services = services
-	c.lock.Unlock()
+	c.state.replace(services)
+}
+
+func (c *consul) setNode(k string, s service, h string, p int, n node) {
+	c.state.setNode(k, s, h, p, n)
 }
 
-func (c *consul) setNode(k, h string, p int, n node) {
-	c.lock.Lock()
-	if s, ok := c.services[k]; ok {
-		nodes := s.nodes
-		if nodes == nil {
-			nodes = map[string]map[int]node{}
+// servicesForNamespace returns the Consul services as seen by the awsSyncer
+// of the given namespace: only the services imported from that namespace
+// are kept of the services imported from AWS, by the name of their AWS
+// service.
+func servicesForNamespace(consulServices map[string]service, namespace string) map[string]service {
+	services := map[string]service{}
+	for k, s := range consulServices {
+		if !s.fromAWS {
+			services[k] = s
+			continue
 		}
-		ports := nodes[h]
-		if ports == nil {
-			ports = map[int]node{}
+		if s.awsNamespace != namespace || len(s.nodes) == 0 {
+			continue
 		}
-		ports[p] = n
-		nodes[h] = ports
-		s.nodes = nodes
-		c.services[k] = s
+		services[s.name] = s
 	}
-	c.lock.Unlock()
+	return services
 }
 
-func (c *consul) sync(aws *awsSyncer, stop, stopped chan struct{}) {
+func (c *consul) sync(awsSyncers []*awsSyncer, stop, stopped chan struct{}) {
 	defer close(stopped)
 	for {
 		select {
@@ -118,16 +114,10 @@ func (c *consul) sync(aws *awsSyncer, stop, stopped chan struct{}) {
 			if !c.toAWS {
 				continue
 			}
-			create := onlyInFirst(c.getServices(), aws.getServices())
-			count := aws.create(create)
-			if count > 0 {
-				aws.log.Info("created", "count", fmt.Sprintf("%d", count))
-			}
-
-			remove := onlyInFirst(aws.getServices(), c.getServices())
-			count = aws.remove(remove)
-			if count > 0 {
-				aws.log.Info("removed", "count", fmt.Sprintf("%d", count))
+			for _, aws := range awsSyncers {
+				run := newSyncRun(aws.log, directionToAWS, *aws.namespace.Id, aws.dryRun)
+				c.syncToAWS(aws, run)
+				run.finish()
 			}
 		case <-stop:
 			return
@@ -135,19 +125,94 @@ func (c *consul) sync(aws *awsSyncer, stop, stopped chan struct{}) {
 	}
 }
 
-func (c *consul) transformNodes(cnodes []*api.CatalogService) map[string]map[int]node {
+// syncToAWS creates, updates and removes services and instances in the
+// namespace of aws to match the Consul catalog.
+func (c *consul) syncToAWS(aws *awsSyncer, run *syncRun) {
+	source, destination := c.state.load(), aws.state.load()
+	run.log.Trace("reconciling", "consul-version", source.version, "aws-version", destination.version)
+	sourceServices, destinationServices := withoutLegacy(source.services, destination.services)
+	r := reconcile(sourceServices, destinationServices, aws.rules())
+	aws.create(r.create, run)
+	aws.update(r.update, run)
+	aws.clearHealths(r.clear, run)
+	aws.rekey(r.rekey, run)
+
+	synced := func(s service) bool { return s.fromConsul && len(s.awsID) > 0 }
+	remove := aws.awsTombstones.expired(r.remove, synced, time.Now())
+	metricTombstones.WithLabelValues(run.direction, run.namespace).Set(float64(aws.awsTombstones.len()))
+	removals := countNodes(remove, synced)
+	known := countNodes(destinationServices, func(s service) bool { return s.fromConsul })
+	if !c.guard.allow(run, removals, known) {
+		return
+	}
+	aws.remove(remove, run)
+}
+
+// importedKey returns the key in the Consul state of the service imported
+// from the AWS service k of a namespace. Every namespace has its own
+// service, so instances at the same host and port in several namespaces are
+// kept apart.
+func importedKey(namespace, k string) string {
+	return namespace + "/" + k
+}
+
+// splitByNamespace splits a service imported from AWS into a service per
+// namespace its instances were imported from, by namespace.
+func (c *consul) splitByNamespace(s service, cnodes []*api.CatalogService) map[string]service {
+	byNamespace := map[string][]*api.CatalogService{}
+	for _, n := range cnodes {
+		namespace := n.ServiceMeta[ConsulAWSNS]
+		byNamespace[namespace] = append(byNamespace[namespace], n)
+	}
+	result := map[string]service{}
+	for namespace, cnodes := range byNamespace {
+		ns := s
+		ns.awsNamespace = namespace
+		ns.nodes = c.transformNodes(cnodes, func(h string, p int) string { return c.serviceID(namespace, s.name, h, p) })
+		ns.healths = c.rekeyHealths(ns.nodes, s.healths)
+		result[namespace] = ns
+	}
+	return result
+}
+
+// withoutLegacy leaves the services of AWS services created by older
+// versions of consul-aws that are not adopted out of both sides, so they are
+// neither created again nor registered into. The snapshots are left as they
+// are.
+func withoutLegacy(source, destination map[string]service) (map[string]service, map[string]service) {
+	legacy := map[string]bool{}
+	for k, s := range destination {
+		if s.legacy {
+			legacy[k] = true
+		}
+	}
+	if len(legacy) == 0 {
+		return source, destination
+	}
+	without := func(services map[string]service) map[string]service {
+		result := make(map[string]service, len(services))
+		for k, s := range services {
+			if !legacy[k] {
+				result[k] = s
+			}
+		}
+		return result
+	}
+	return without(source), without(destination)
+}
+
+// transformNodes turns the instances of a Consul service into nodes. For
+// services imported from AWS, current returns the ID an instance has, so
+// instances left over from an older ID scheme are found.
+func (c *consul) transformNodes(cnodes []*api.CatalogService, current func(h string, p int) string) map[string]map[int]node {
 	nodes := map[string]map[int]node{}
 	for _, n := range cnodes {
 		address := n.ServiceAddress
 		if len(address) == 0 {
 			address = n.Address
 		}
-		if nodes[address] == nil {
-			nodes[address] = map[int]node{}
-		}
-		ports := nodes[address]
-		ports[n.ServicePort] = node{port: n.ServicePort, host: address, consulID: n.ServiceID, awsID: n.ServiceMeta[ConsulAWSID], attributes: n.ServiceMeta}
-		nodes[address] = ports
+		cn := node{port: n.ServicePort, host: address, consulID: n.ServiceID, awsID: n.ServiceMeta[ConsulAWSID], tags: n.ServiceTags, attributes: n.ServiceMeta}
+		addInstance(nodes, cn, func(n node) string { return n.consulID }, current)
 	}
 	return nodes
 }
@@ -161,17 +226,25 @@ func (c *consul) fetchNodes(service string) ([]*api.CatalogService, error) {
 	return nodes, err
 }
 
+// transformHealth aggregates the checks of every service instance into a
+// single health: critical if any check is critical, unknown if any check is
+// neither passing nor critical, and passing otherwise.
 func (c *consul) transformHealth(chealths api.HealthChecks) map[string]health {
 	healths := map[string]health{}
 	for _, h := range chealths {
+		var status health
 		switch h.Status {
 		case "passing":
-			healths[h.ServiceID] = passing
+			status = passing
 		case "critical":
-			healths[h.ServiceID] = critical
+			status = critical
 		default:
-			healths[h.ServiceID] = unknown
+			status = unknown
 		}
+		if current, ok := healths[h.ServiceID]; ok && healthSeverity(current) > healthSeverity(status) {
+			continue
+		}
+		healths[h.ServiceID] = status
 	}
 	return healths
 }
@@ -199,34 +272,150 @@ func (c *consul) fetchServices(waitIndex uint64) (map[string][]string, uint64, e
 }
 
 func (c *consul) fetch(waitIndex uint64) (uint64, error) {
+	start := time.Now()
+	services, waitIndex, err := c.fetchAll(waitIndex)
+	observeFetch(sideConsul, "", start, services, err)
+	if err != nil {
+		return waitIndex, err
+	}
+	c.setServices(services)
+	c.status.fetched(sideConsul, "")
+	return waitIndex, nil
+}
+
+func (c *consul) fetchAll(waitIndex uint64) (map[string]service, uint64, error) {
 	cservices, waitIndex, err := c.fetchServices(waitIndex)
 	if err != nil {
-		return waitIndex, fmt.Errorf("error fetching services: %s", err)
+		return nil, waitIndex, fmt.Errorf("error fetching services: %s", err)
 	}
 	services := c.transformServices(cservices)
-	for id, s := range c.transformServices(cservices) {
-		if s.fromAWS {
-			id = c.awsPrefix + id
-		}
-		if cnodes, err := c.fetchNodes(id); err == nil {
-			s.nodes = c.transformNodes(cnodes)
-		} else {
+	imported := map[string]service{}
+	for k, s := range services {
+		cnodes, err := c.fetchNodes(s.id)
+		if err != nil {
 			c.log.Error("error fetching nodes", "error", err)
 			continue
 		}
-		if chealths, err := c.fetchHealth(id); err == nil {
+		if c.optIn && !s.fromAWS && !optedIn(cnodes) {
+			c.log.Trace("service not opted in", "name", s.name)
+			delete(services, k)
+			continue
+		}
+		if chealths, err := c.fetchHealth(s.id); err == nil {
 			s.healths = c.transformHealth(chealths)
 		} else {
 			// TODO (hans): decide what to do when health errors
 			c.log.Error("error fetching health", "error", err)
 		}
 		if s.fromAWS {
-			s.healths = c.rekeyHealths(s.name, s.healths)
+			delete(services, k)
+			for namespace, ns := range c.splitByNamespace(s, c.ownNodes(cnodes)) {
+				imported[importedKey(namespace, k)] = ns
+			}
+			continue
 		}
-		services[id] = s
+		s.nodes = c.transformNodes(cnodes, nil)
+		s.overrides = c.transformOverrides(s.name, cnodes)
+		services[k] = s
 	}
-	c.setServices(services)
-	return waitIndex, nil
+	for k, s := range imported {
+		services[k] = s
+	}
+	// Services with a name override are matched with AWS by the name they
+	// have there.
+	for k, s := range services {
+		name := s.overrides.name
+		if len(name) == 0 || name == k {
+			continue
+		}
+		if _, ok := services[name]; ok {
+			c.log.Warn("cannot use cloudmap name, another service has the same name", "service", k, "name", name)
+			continue
+		}
+		delete(services, k)
+		s.name = name
+		services[name] = s
+	}
+	return services, waitIndex, nil
+}
+
+// transformOverrides reads the per service overrides from the service meta.
+// The first instance carrying a key wins, invalid values are ignored.
+func (c *consul) transformOverrides(name string, cnodes []*api.CatalogService) overrides {
+	o := overrides{}
+	for _, n := range cnodes {
+		meta := n.ServiceMeta
+		if v := meta[ConsulCloudMapNameKey]; len(v) > 0 && len(o.name) == 0 {
+			o.name = v
+		}
+		if v := meta[ConsulCloudMapTTLKey]; len(v) > 0 && o.ttl == 0 {
+			ttl, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || ttl <= 0 {
+				c.log.Warn("ignoring invalid cloudmap ttl", "service", name, "value", v)
+			} else {
+				o.ttl = ttl
+			}
+		}
+		if v := meta[ConsulCloudMapRoutingPolicyKey]; len(v) > 0 && len(o.routingPolicy) == 0 {
+			switch policy := strings.ToUpper(v); policy {
+			case "MULTIVALUE", "WEIGHTED":
+				o.routingPolicy = policy
+			default:
+				c.log.Warn("ignoring invalid cloudmap routing policy", "service", name, "value", v)
+			}
+		}
+		if v := meta[ConsulCloudMapRecordTypesKey]; len(v) > 0 && len(o.recordTypes) == 0 {
+			recordTypes := []string{}
+			for _, t := range strings.Split(v, ",") {
+				switch t = strings.ToUpper(strings.TrimSpace(t)); t {
+				case "A", "AAAA", "CNAME", "SRV":
+					recordTypes = append(recordTypes, t)
+				default:
+					c.log.Warn("ignoring invalid cloudmap record type", "service", name, "value", t)
+				}
+			}
+			if len(recordTypes) > 0 {
+				o.recordTypes = recordTypes
+			}
+		}
+	}
+	return o
+}
+
+// ownNodes drops the service instances imported from AWS by other
+// deployments, and the ones not registered on ConsulAWSNodeName.
+func (c *consul) ownNodes(cnodes []*api.CatalogService) []*api.CatalogService {
+	result := []*api.CatalogService{}
+	for _, n := range cnodes {
+		if n.Node == ConsulAWSNodeName && c.owns(n.ServiceMeta) {
+			result = append(result, n)
+		}
+	}
+	return result
+}
+
+// owns returns true if the service instance with the given meta was
+// imported from AWS by this deployment. Instances without a deployment were
+// imported by an older version of consul-aws, which only knew a single
+// deployment, so they belong to DefaultDeploymentID, or to any deployment
+// adopting services.
+func (c *consul) owns(meta map[string]string) bool {
+	deployment, ok := meta[DeploymentKey]
+	if ok {
+		return deployment == c.deploymentID
+	}
+	return meta[ConsulSourceKey] == ConsulAWSTag && (c.deploymentID == DefaultDeploymentID || c.adopt)
+}
+
+// optedIn returns true if any instance of the service has
+// ConsulOptInMetaKey set to true.
+func optedIn(cnodes []*api.CatalogService) bool {
+	for _, n := range cnodes {
+		if isTrue(n.ServiceMeta[ConsulOptInMetaKey]) {
+			return true
+		}
+	}
+	return false
 }
 
 func (c *consul) transformServices(cservices map[string][]string) map[string]service {
@@ -241,18 +430,28 @@ func (c *consul) transformServices(cservices map[string][]string) map[string]ser
 		}
 		if s.fromAWS {
 			s.name = strings.TrimPrefix(k, c.awsPrefix)
+		} else if !c.filter.allow(k, tags) {
+			c.log.Trace("service excluded by filter", "name", k)
+			continue
 		}
 		services[s.name] = s
 	}
 	return services
 }
 
-func (c *consul) rekeyHealths(name string, healths map[string]health) map[string]health {
+// rekeyHealths turns healths keyed by Consul service ID into healths keyed
+// by the ID of the AWS instances the services were imported from, as found
+// in their meta, so they can be compared with the healths fetched from AWS.
+func (c *consul) rekeyHealths(nodes map[string]map[int]node, healths map[string]health) map[string]health {
 	rekeyed := map[string]health{}
-	for id, h := range healths {
-		host, port := hostPortFromID(id)
-		if awsID, ok := c.getAWSID(name, host, port); ok {
-			rekeyed[awsID] = h
+	for _, ports := range nodes {
+		for _, n := range ports {
+			if len(n.awsID) == 0 {
+				continue
+			}
+			if h, ok := healths[n.consulID]; ok {
+				rekeyed[n.awsID] = h
+			}
 		}
 	}
 	return rekeyed
@@ -284,108 +483,275 @@ func (c *consul) fetchIndefinetely(stop, stopped chan struct{}) {
 	}
 }
 
-func (c *consul) create(services map[string]service) int {
+func (c *consul) create(services map[string]service, run *syncRun) {
 	wg := sync.WaitGroup{}
-	count := 0
+	for k, s := range services {
+		if s.fromConsul {
+			continue
+		}
+		c.register(&wg, k, s, ActionRegisterInstance, run)
+	}
+	// The checks of new instances are registered once the instances are.
+	wg.Wait()
 	for k, s := range services {
 		if s.fromConsul {
 			continue
 		}
 		name := c.awsPrefix + k
+		registered := map[string]string{}
 		for h, nodes := range s.nodes {
 			for _, n := range nodes {
-				wg.Add(1)
-				go func(ns, k, name, h string, n node) {
-					defer wg.Done()
-					id := id(k, h, n.port)
-					meta := map[string]string{}
-					for k, v := range n.attributes {
-						meta[k] = v
-					}
-					meta[ConsulSourceKey] = ConsulAWSTag
-					meta[ConsulAWSNS] = ns
-					meta[ConsulAWSID] = n.awsID
-					service := api.AgentService{
-						ID:      id,
-						Service: name,
-						Tags:    []string{ConsulAWSTag},
-						Address: h,
-						Meta:    meta,
-					}
-					if n.port != 0 {
-						service.Port = n.port
-					}
-					reg := api.CatalogRegistration{
-						Node:           ConsulAWSNodeName,
-						Address:        h,
-						NodeMeta:       map[string]string{ConsulSourceKey: ConsulAWSTag},
-						SkipNodeUpdate: true,
-						Service:        &service,
-					}
-					_, err := c.client.Catalog().Register(&reg, nil)
-					if err != nil {
-						c.log.Error("cannot create service", "error", err.Error())
-					} else {
-						c.setNode(k, h, n.port, n)
-						count++
-					}
-				}(s.awsNamespace, k, name, h, n)
+				registered[n.awsID] = c.serviceID(s.awsNamespace, k, h, n.port)
 			}
 		}
 		for awsID, h := range s.healths {
-			n, ok := c.getNodeForAWSID(k, awsID)
+			// New instances are known once registered, except in a dry
+			// run, and get no check if their registration failed.
+			serviceID, ok := registered[awsID]
+			if n, known := c.getNodeForAWSID(importedKey(s.awsNamespace, k), awsID); known {
+				serviceID = n.consulID
+			} else if !ok || !run.dry {
+				continue
+			}
+			if run.dryRun(Change{Action: ActionUpdateHealth, Service: name, Instance: serviceID, Health: string(h)}) {
+				continue
+			}
+			wg.Add(1)
+			go func(serviceID string, h health) {
+				defer wg.Done()
+				if err := c.registerCheck(serviceID, h); err != nil {
+					c.log.Error("cannot create healthcheck", "id", serviceID, "error", err.Error())
+					run.fail(operationHealth)
+				}
+			}(serviceID, h)
+		}
+	}
+	wg.Wait()
+}
+
+// update registers the service instances whose meta changed again.
+func (c *consul) update(services map[string]service, run *syncRun) {
+	wg := sync.WaitGroup{}
+	for k, s := range services {
+		if !s.fromAWS || s.fromConsul {
+			continue
+		}
+		c.register(&wg, k, s, ActionUpdateInstance, run)
+	}
+	wg.Wait()
+}
+
+// clearHealths removes the checks of the service instances whose AWS
+// instances have no health anymore.
+func (c *consul) clearHealths(services map[string]service, run *syncRun) {
+	wg := sync.WaitGroup{}
+	for k, s := range services {
+		if !s.fromAWS || s.fromConsul {
+			continue
+		}
+		for awsID := range s.healths {
+			n, ok := c.getNodeForAWSID(importedKey(s.awsNamespace, k), awsID)
 			if !ok {
 				continue
 			}
+			serviceID := n.consulID
+			if run.dryRun(Change{Action: ActionClearHealth, Service: c.awsPrefix + k, Instance: serviceID}) {
+				continue
+			}
 			wg.Add(1)
-			go func(serviceID string, n node, h health) {
+			go func() {
 				defer wg.Done()
+				_, err := c.client.Catalog().Deregister(&api.CatalogDeregistration{Node: ConsulAWSNodeName, CheckID: "check" + serviceID}, nil)
+				if err != nil {
+					c.log.Error("cannot remove healthcheck", "id", serviceID, "error", err.Error())
+					run.fail(operationHealth)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+// rekey registers the instances of the services imported from AWS that
+// were registered under an older ID scheme again under their current ID,
+// and deregisters the stale ones once replaced.
+func (c *consul) rekey(services map[string]service, run *syncRun) {
+	wg := sync.WaitGroup{}
+	for k, s := range services {
+		if !s.fromAWS || s.fromConsul {
+			continue
+		}
+		c.register(&wg, k, s, ActionRekeyInstance, run)
+	}
+	wg.Wait()
+}
+
+// register registers the instances of the service imported from AWS, which
+// are new with ActionRegisterInstance, changed with ActionUpdateInstance and
+// registered under an older ID scheme with ActionRekeyInstance. Re-keyed
+// instances get their health check before their stale IDs are
+// deregistered, so they are never missing or without health.
+func (c *consul) register(wg *sync.WaitGroup, k string, s service, action string, run *syncRun) {
+	name := c.awsPrefix + k
+	operation := operationCreate
+	if action != ActionRegisterInstance {
+		operation = operationUpdate
+	}
+	// The service as fetched from Consul, known once its first instance
+	// is registered.
+	imported := service{id: name, name: k, consulID: name, fromAWS: true, awsNamespace: s.awsNamespace}
+	for h, nodes := range s.nodes {
+		for _, n := range nodes {
+			serviceID := c.serviceID(s.awsNamespace, k, h, n.port)
+			meta := c.serviceMeta(s, n)
+			if run.dryRun(Change{Action: action, Service: name, Instance: serviceID, Address: h, Port: n.port, Attributes: meta}) {
+				continue
+			}
+			wg.Add(1)
+			go func(h string, n node, meta map[string]string) {
+				defer wg.Done()
+				service := api.AgentService{
+					ID:      serviceID,
+					Service: name,
+					Tags:    []string{ConsulAWSTag},
+					Address: h,
+					Meta:    meta,
+				}
+				if n.port != 0 {
+					service.Port = n.port
+				}
 				reg := api.CatalogRegistration{
 					Node:           ConsulAWSNodeName,
+					Address:        h,
+					NodeMeta:       map[string]string{ConsulSourceKey: ConsulAWSTag},
 					SkipNodeUpdate: true,
-					Check: &api.AgentCheck{
-						CheckID:   "check" + id(serviceID, n.host, n.port),
-						ServiceID: id(serviceID, n.host, n.port),
-						Node:      "consul-aws",
-						Name:      "AWS Route53 Health Check",
-						Status:    string(h),
-					},
+					Service:        &service,
 				}
 				_, err := c.client.Catalog().Register(&reg, nil)
 				if err != nil {
-					c.log.Error("cannot create healthcheck", "id", id(k, n.host, n.port), "error", err.Error())
+					c.log.Error("cannot register service", "action", action, "error", err.Error())
+					run.fail(operation)
+					return
+				}
+				if action == ActionRekeyInstance {
+					if status, ok := s.healths[n.awsID]; ok {
+						if err := c.registerCheck(serviceID, status); err != nil {
+							c.log.Error("cannot create healthcheck", "id", serviceID, "error", err.Error())
+							run.fail(operationHealth)
+							return
+						}
+					}
+					for _, staleID := range n.staleIDs {
+						_, err := c.client.Catalog().Deregister(&api.CatalogDeregistration{Node: ConsulAWSNodeName, ServiceID: staleID}, nil)
+						if err != nil {
+							c.log.Error("cannot remove service", "id", staleID, "error", err.Error())
+							run.fail(operationRemove)
+							return
+						}
+					}
+					c.log.Debug("rekeyed service", "name", name, "id", serviceID, "stale", n.staleIDs)
+				}
+				n.attributes = meta
+				n.consulID = serviceID
+				n.staleIDs = nil
+				c.setNode(importedKey(s.awsNamespace, k), imported, h, n.port, n)
+				if action == ActionRegisterInstance {
+					run.create()
 				} else {
-					count++
+					run.update()
 				}
-			}(k, n, h)
+			}(h, n, meta)
 		}
 	}
-	wg.Wait()
-	return count
 }
 
-func (c *consul) remove(services map[string]service) int {
+// registerCheck sets the health of a service instance imported from AWS.
+func (c *consul) registerCheck(serviceID string, h health) error {
+	_, err := c.client.Catalog().Register(&api.CatalogRegistration{
+		Node:           ConsulAWSNodeName,
+		SkipNodeUpdate: true,
+		Check: &api.AgentCheck{
+			CheckID:   "check" + serviceID,
+			ServiceID: serviceID,
+			Node:      "consul-aws",
+			Name:      "AWS Route53 Health Check",
+			Status:    string(h),
+		},
+	}, nil)
+	return err
+}
+
+// serviceID returns the ID of the Consul service instance registered by
+// this deployment for the instance of the AWS service k of a namespace at
+// host h and port p. The host and port are found in the address of the
+// service instance and the namespace and AWS instance ID in its meta, they
+// are never parsed from the ID.
+func (c *consul) serviceID(namespace, k, h string, p int) string {
+	return encodeID(k, h, strconv.Itoa(p), namespace, c.deploymentID)
+}
+
+// staleIDs returns the IDs of the service instance n of the service k
+// imported from a namespace that aren't its current ID.
+func (c *consul) staleIDs(namespace, k string, n node) []string {
+	stale := append([]string{}, n.staleIDs...)
+	if n.consulID != c.serviceID(namespace, k, n.host, n.port) {
+		stale = append(stale, n.consulID)
+	}
+	return stale
+}
+
+// serviceMeta returns the meta of the Consul service instance registered
+// for an instance of the AWS service s.
+func (c *consul) serviceMeta(s service, n node) map[string]string {
+	meta := map[string]string{}
+	for k, v := range n.attributes {
+		meta[k] = v
+	}
+	meta[ConsulSourceKey] = ConsulAWSTag
+	meta[ConsulAWSNS] = s.awsNamespace
+	meta[ConsulAWSID] = n.awsID
+	meta[DeploymentKey] = c.deploymentID
+	return meta
+}
+
+// rules returns how the services of an AWS namespace are reconciled with
+// the Consul services imported from it.
+func (c *consul) rules(namespace string) reconcileRules {
+	return reconcileRules{
+		attributes: c.serviceMeta,
+		healthKey:  func(n node) string { return n.awsID },
+		staleIDs: func(k string, n node) []string {
+			return c.staleIDs(namespace, k, n)
+		},
+	}
+}
+
+func (c *consul) remove(services map[string]service, run *syncRun) {
 	wg := sync.WaitGroup{}
-	count := 0
 	for k, s := range services {
 		if !s.fromAWS {
 			continue
 		}
 		for h, nodes := range s.nodes {
-			for p := range nodes {
+			for p, n := range nodes {
+				if run.dryRun(Change{Action: ActionDeregisterInstance, Service: c.awsPrefix + k, Instance: n.consulID, Address: h, Port: p}) {
+					continue
+				}
 				wg.Add(1)
-				go func(id string) {
+				go func(ids []string) {
 					defer wg.Done()
-					_, err := c.client.Catalog().Deregister(&api.CatalogDeregistration{Node: ConsulAWSNodeName, ServiceID: id}, nil)
-					if err != nil {
-						c.log.Error("cannot remove service", "error", err.Error())
-					} else {
-						count++
+					for _, id := range ids {
+						_, err := c.client.Catalog().Deregister(&api.CatalogDeregistration{Node: ConsulAWSNodeName, ServiceID: id}, nil)
+						if err != nil {
+							c.log.Error("cannot remove service", "error", err.Error())
+							run.fail(operationRemove)
+							return
+						}
 					}
-				}(id(k, h, p))
+					run.remove()
+				}(append([]string{n.consulID}, n.staleIDs...))
 			}
 		}
 	}
 	wg.Wait()
-	return count
 }
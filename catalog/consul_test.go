@@ -7,6 +7,7 @@ import (
 	"testing"
 
 	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-hclog"
 	"github.com/stretchr/testify/require"
 )
 
@@ -24,28 +25,76 @@ func TestConsulRekeyHealths(t *testing.T) {
 		},
 		{
 			nodes: map[string]map[int]node{
-				"1.1.1.1": {8000: {port: 8000, awsID: "X1"}},
+				"1.1.1.1": {8000: {port: 8000, host: "1.1.1.1", awsID: "X1", consulID: "web_1.1.1.1_8000"}},
+				"fd00::1": {8000: {port: 8000, host: "fd00::1", awsID: "X2", consulID: "my@5fweb_fd00::1_8000_default"}},
+				"1.1.1.2": {8000: {port: 8000, host: "1.1.1.2", consulID: "web_1.1.1.2_8000"}},
 			},
 			healths: map[string]health{
-				"web_1.1.1.1_8000": passing,
+				"web_1.1.1.1_8000":              passing,
+				"my@5fweb_fd00::1_8000_default": critical,
+				"web_1.1.1.2_8000":              passing,
 			},
 			expected: map[string]health{
 				"X1": passing,
+				"X2": critical,
 			},
 		},
 	}
 
 	for _, v := range variants {
-		c := consul{
-			services: map[string]service{
-				"s1": {
-					nodes:   v.nodes,
-					healths: v.healths,
-				},
-			},
-		}
-		require.Equal(t, v.expected, c.rekeyHealths("s1", c.services["s1"].healths))
+		c := &consul{}
+		require.Equal(t, v.expected, c.rekeyHealths(v.nodes, v.healths))
+	}
+}
+
+func TestConsulServiceID(t *testing.T) {
+	c := &consul{deploymentID: DefaultDeploymentID}
+	require.Equal(t, "web_10.0.0.1_80_ns-1_default", c.serviceID("ns-1", "web", "10.0.0.1", 80))
+	require.Equal(t, "my@5fweb_fd00::1_80_ns-1_default", c.serviceID("ns-1", "my_web", "fd00::1", 80))
+	// Used to be the same ID for both.
+	require.NotEqual(t, c.serviceID("ns-1", "a_b", "c", 80), c.serviceID("ns-1", "a", "b_c", 80))
+	require.NotEqual(t, c.serviceID("ns-1", "web", "10.0.0.1", 80), c.serviceID("ns-2", "web", "10.0.0.1", 80))
+	require.NotEqual(t, c.serviceID("ns-1", "web", "10.0.0.1", 80), (&consul{deploymentID: "eu"}).serviceID("ns-1", "web", "10.0.0.1", 80))
+
+	require.Empty(t, c.staleIDs("ns-1", "web", node{host: "10.0.0.1", port: 80, consulID: "web_10.0.0.1_80_ns-1_default"}))
+	// IDs without the namespace are stale.
+	require.Equal(t, []string{"old", "web_10.0.0.1_80_default"}, c.staleIDs("ns-1", "web", node{host: "10.0.0.1", port: 80, consulID: "web_10.0.0.1_80_default", staleIDs: []string{"old"}}))
+}
+
+// TestConsul_SameAddressInNamespaces imports services of the same name with
+// an instance at the same host and port from two namespaces, which used to
+// be registered under the same ID and never converged.
+func TestConsul_SameAddressInNamespaces(t *testing.T) {
+	const otherNamespaceID = "ns-other"
+	cloudMap, awsClient := newFakeCloudMap(t)
+	consul, consulClient := newFakeConsul(t)
+	cloudMap.namespaces[otherNamespaceID] = &fakeNamespace{id: otherNamespaceID, name: "other.test"}
+	cloudMap.createService("api", nil, "10.1.0.1:8080")
+	otherID := cloudMap.createService("api", nil, "10.1.0.1:8080")
+	cloudMap.services[otherID].namespaceID = otherNamespaceID
+	config := Config{
+		ToConsul:   true,
+		Namespaces: []NamespaceConfig{{ID: fakeNamespaceID}, {ID: otherNamespaceID}},
+		AWSPrefix:  "aws_",
 	}
+
+	s, err := newSyncer(config, awsClient, consulClient)
+	require.NoError(t, err)
+	require.NoError(t, s.fetch())
+	require.ElementsMatch(t, []Summary{
+		{Direction: directionToConsul, Namespace: fakeNamespaceID, Created: 1},
+		{Direction: directionToConsul, Namespace: otherNamespaceID, Created: 1},
+	}, summaries(s.run(false)))
+	services := consul.serviceInstances("aws_api")
+	require.Len(t, services, 2)
+	require.Contains(t, services, "api_10.1.0.1_8080_"+fakeNamespaceID+"_default")
+	require.Contains(t, services, "api_10.1.0.1_8080_"+otherNamespaceID+"_default")
+
+	require.NoError(t, s.fetch())
+	require.ElementsMatch(t, []Summary{
+		{Direction: directionToConsul, Namespace: fakeNamespaceID},
+		{Direction: directionToConsul, Namespace: otherNamespaceID},
+	}, summaries(s.run(false)))
 }
 
 func TestConsulTransformServices(t *testing.T) {
@@ -56,6 +105,31 @@ func TestConsulTransformServices(t *testing.T) {
 	require.Equal(t, expected, c.transformServices(services))
 }
 
+func TestConsulTransformServices_Filter(t *testing.T) {
+	filter, err := newServiceFilter(Filter{Exclude: []string{"consul"}, ExcludeTags: []string{"internal"}})
+	require.NoError(t, err)
+	c := consul{awsPrefix: "aws_", filter: filter, log: hclog.NewNullLogger()}
+	services := map[string][]string{"consul": {}, "s1": {"internal"}, "s2": {}, "aws_consul": {ConsulAWSTag}}
+	expected := map[string]service{
+		"s2":     {id: "s2", name: "s2", consulID: "s2"},
+		"consul": {id: "aws_consul", name: "consul", consulID: "aws_consul", fromAWS: true},
+	}
+
+	require.Equal(t, expected, c.transformServices(services))
+}
+
+func TestConsulOptedIn(t *testing.T) {
+	require.False(t, optedIn(nil))
+	require.False(t, optedIn([]*api.CatalogService{
+		{ServiceMeta: map[string]string{ConsulOptInMetaKey: "false"}},
+		{ServiceMeta: map[string]string{"A": "B"}},
+	}))
+	require.True(t, optedIn([]*api.CatalogService{
+		{ServiceMeta: map[string]string{"A": "B"}},
+		{ServiceMeta: map[string]string{ConsulOptInMetaKey: "true"}},
+	}))
+}
+
 func TestConsulTransformNodes(t *testing.T) {
 	c := consul{}
 	nodes := []*api.CatalogService{
@@ -83,7 +157,7 @@ func TestConsulTransformNodes(t *testing.T) {
 		"1.1.1.2": {1: {port: 1, host: "1.1.1.2", awsID: "aws1", consulID: "s1", attributes: map[string]string{ConsulAWSID: "aws1"}}},
 		"1.1.1.3": {3: {port: 3, host: "1.1.1.3", consulID: "s2", attributes: map[string]string{"A": "B"}}},
 	}
-	require.Equal(t, expected, c.transformNodes(nodes))
+	require.Equal(t, expected, c.transformNodes(nodes, nil))
 }
 
 func TestConsulTransformHeath(t *testing.T) {
@@ -92,11 +166,88 @@ func TestConsulTransformHeath(t *testing.T) {
 		&api.HealthCheck{Status: "passing", ServiceID: "s1"},
 		&api.HealthCheck{Status: "critical", ServiceID: "s2"},
 		&api.HealthCheck{Status: "warning", ServiceID: "s3"},
+		&api.HealthCheck{Status: "passing", ServiceID: "s4"},
+		&api.HealthCheck{Status: "critical", ServiceID: "s4"},
+		&api.HealthCheck{Status: "passing", ServiceID: "s4"},
+		&api.HealthCheck{Status: "warning", ServiceID: "s5"},
+		&api.HealthCheck{Status: "passing", ServiceID: "s5"},
 	}
 	expected := map[string]health{
 		"s1": passing,
 		"s2": critical,
 		"s3": unknown,
+		"s4": critical,
+		"s5": unknown,
 	}
 	require.Equal(t, expected, c.transformHealth(healths))
 }
+
+func TestServicesForNamespace(t *testing.T) {
+	services := map[string]service{
+		"s1": {
+			name: "s1",
+			nodes: map[string]map[int]node{
+				"1.1.1.1": {1: {port: 1, host: "1.1.1.1"}},
+			},
+		},
+		importedKey("ns1", "s2"): {
+			name:         "s2",
+			fromAWS:      true,
+			awsNamespace: "ns1",
+			nodes: map[string]map[int]node{
+				"1.1.1.1": {1: {port: 1, host: "1.1.1.1", awsID: "a1", attributes: map[string]string{ConsulAWSNS: "ns1"}}},
+			},
+			healths: map[string]health{"a1": passing},
+		},
+		importedKey("ns2", "s2"): {
+			name:         "s2",
+			fromAWS:      true,
+			awsNamespace: "ns2",
+			nodes: map[string]map[int]node{
+				"1.1.1.1": {1: {port: 1, host: "1.1.1.1", awsID: "a2", attributes: map[string]string{ConsulAWSNS: "ns2"}}},
+			},
+			healths: map[string]health{"a2": critical},
+		},
+		importedKey("ns2", "s3"): {
+			name:         "s3",
+			fromAWS:      true,
+			awsNamespace: "ns2",
+			nodes: map[string]map[int]node{
+				"1.1.1.3": {3: {port: 3, host: "1.1.1.3", awsID: "a3", attributes: map[string]string{ConsulAWSNS: "ns2"}}},
+			},
+		},
+	}
+	expected := map[string]service{
+		"s1": services["s1"],
+		"s2": services[importedKey("ns1", "s2")],
+	}
+	require.Equal(t, expected, servicesForNamespace(services, "ns1"))
+}
+
+func TestConsulTransformOverrides(t *testing.T) {
+	c := consul{log: hclog.NewNullLogger()}
+	nodes := []*api.CatalogService{
+		{ServiceMeta: map[string]string{"A": "B"}},
+		{ServiceMeta: map[string]string{
+			ConsulCloudMapNameKey:          "web",
+			ConsulCloudMapTTLKey:           "10",
+			ConsulCloudMapRoutingPolicyKey: "weighted",
+			ConsulCloudMapRecordTypesKey:   "a, aaaa,TXT",
+		}},
+		{ServiceMeta: map[string]string{
+			ConsulCloudMapNameKey: "other",
+			ConsulCloudMapTTLKey:  "20",
+		}},
+	}
+	expected := overrides{name: "web", ttl: 10, routingPolicy: "WEIGHTED", recordTypes: []string{"A", "AAAA"}}
+	require.Equal(t, expected, c.transformOverrides("s1", nodes))
+
+	nodes = []*api.CatalogService{
+		{ServiceMeta: map[string]string{
+			ConsulCloudMapTTLKey:           "-1",
+			ConsulCloudMapRoutingPolicyKey: "nearest",
+			ConsulCloudMapRecordTypesKey:   "TXT",
+		}},
+	}
+	require.Equal(t, overrides{}, c.transformOverrides("s1", nodes))
+}
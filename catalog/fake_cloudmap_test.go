@@ -0,0 +1,575 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package catalog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awssd "github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+)
+
+const (
+	fakeNamespaceID   = "ns-fake"
+	fakeNamespaceName = "consul-aws.test"
+)
+
+// fakeCloudMap is an in-process CloudMap speaking the JSON 1.1 protocol of
+// the AWS SDK. Operations complete immediately unless held or failed. It
+// starts with one HTTP namespace, fakeNamespaceID.
+type fakeCloudMap struct {
+	lock       sync.Mutex
+	namespaces map[string]*fakeNamespace
+	services   map[string]*fakeService
+	operations map[string]*fakeOperation
+	nextID     int
+	// throttled is the number of requests of an operation still to be
+	// rejected with a ThrottlingException.
+	throttled map[string]int
+	// failing is the number of registrations still to fail
+	// asynchronously.
+	failing int
+	// hold keeps new operations pending until they are released.
+	hold bool
+}
+
+type fakeOperation struct {
+	targets map[string]string
+	status  string
+	// apply makes the change of a pending operation once it is released.
+	apply func()
+}
+
+type fakeNamespace struct {
+	id, name, description string
+}
+
+type fakeService struct {
+	id, name, namespaceID, description string
+	customHealth                       bool
+	dnsConfig                          interface{}
+	tags                               map[string]string
+	instances                          map[string]*fakeInstance
+}
+
+type fakeInstance struct {
+	attributes map[string]string
+	health     string
+}
+
+type fakeCloudMapError struct {
+	code, message string
+}
+
+// newFakeCloudMap starts a fake CloudMap and returns it with a client
+// talking to it.
+func newFakeCloudMap(t *testing.T) (*fakeCloudMap, *awssd.Client) {
+	f := &fakeCloudMap{
+		namespaces: map[string]*fakeNamespace{
+			fakeNamespaceID: {id: fakeNamespaceID, name: fakeNamespaceName},
+		},
+		services:   map[string]*fakeService{},
+		operations: map[string]*fakeOperation{},
+		throttled:  map[string]int{},
+	}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+
+	// Some operations prepend a prefix like "data-" to the host, so every
+	// connection goes to the server whatever the host.
+	addr := server.Listener.Addr().String()
+	httpClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}}
+	client := awssd.New(awssd.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(server.URL),
+		Credentials:  aws.AnonymousCredentials{},
+		HTTPClient:   httpClient,
+	})
+	return f, client
+}
+
+func (f *fakeCloudMap) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	target := r.Header.Get("X-Amz-Target")
+	op := target[strings.LastIndex(target, ".")+1:]
+	var in map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.lock.Lock()
+	out, err := f.handle(op, in)
+	f.lock.Unlock()
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	if err != nil {
+		w.Header().Set("X-Amzn-ErrorType", err.code)
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"__type": err.code, "Message": err.message})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+type jsonObject = map[string]interface{}
+
+func (f *fakeCloudMap) handle(op string, in jsonObject) (jsonObject, *fakeCloudMapError) {
+	if f.throttled[op] > 0 {
+		f.throttled[op]--
+		return nil, &fakeCloudMapError{"ThrottlingException", "rate exceeded"}
+	}
+	switch op {
+	case "GetNamespace":
+		ns, ok := f.namespaces[jsonString(in["Id"])]
+		if !ok {
+			return nil, &fakeCloudMapError{"NamespaceNotFound", "namespace not found"}
+		}
+		return jsonObject{"Namespace": ns.summary()}, nil
+	case "ListNamespaces":
+		name := jsonFilter(in, "NAME")
+		namespaces := []jsonObject{}
+		for _, ns := range f.namespaces {
+			if len(name) == 0 || ns.name == name {
+				namespaces = append(namespaces, ns.summary())
+			}
+		}
+		return jsonObject{"Namespaces": namespaces}, nil
+	case "CreateHttpNamespace", "CreatePrivateDnsNamespace":
+		ns := &fakeNamespace{id: f.newID("ns"), name: jsonString(in["Name"]), description: jsonString(in["Description"])}
+		f.namespaces[ns.id] = ns
+		return jsonObject{"OperationId": f.newOperation("NAMESPACE", ns.id)}, nil
+	case "GetOperation":
+		o, ok := f.operations[jsonString(in["OperationId"])]
+		if !ok {
+			return nil, &fakeCloudMapError{"OperationNotFound", "operation not found"}
+		}
+		operation := jsonObject{
+			"Id":      jsonString(in["OperationId"]),
+			"Status":  o.status,
+			"Targets": o.targets,
+		}
+		if o.status == "FAIL" {
+			operation["ErrorCode"] = "INTERNAL_FAILURE"
+			operation["ErrorMessage"] = "registration failed"
+		}
+		return jsonObject{"Operation": operation}, nil
+	case "ListServices":
+		namespaceID := jsonFilter(in, "NAMESPACE_ID")
+		services := []jsonObject{}
+		for _, s := range f.services {
+			if len(namespaceID) == 0 || s.namespaceID == namespaceID {
+				services = append(services, s.summary())
+			}
+		}
+		return jsonObject{"Services": services}, nil
+	case "GetService":
+		s, err := f.service(in["Id"])
+		if err != nil {
+			return nil, err
+		}
+		return jsonObject{"Service": s.summary()}, nil
+	case "CreateService":
+		namespaceID := jsonString(in["NamespaceId"])
+		if _, ok := f.namespaces[namespaceID]; !ok {
+			return nil, &fakeCloudMapError{"NamespaceNotFound", "namespace not found"}
+		}
+		for _, s := range f.services {
+			if s.namespaceID == namespaceID && s.name == jsonString(in["Name"]) {
+				return nil, &fakeCloudMapError{"ServiceAlreadyExists", "service already exists"}
+			}
+		}
+		s := &fakeService{
+			id:           f.newID("srv"),
+			name:         jsonString(in["Name"]),
+			namespaceID:  namespaceID,
+			description:  jsonString(in["Description"]),
+			customHealth: in["HealthCheckCustomConfig"] != nil,
+			dnsConfig:    in["DnsConfig"],
+			tags:         jsonTags(in["Tags"]),
+			instances:    map[string]*fakeInstance{},
+		}
+		f.services[s.id] = s
+		return jsonObject{"Service": s.summary()}, nil
+	case "DeleteService":
+		s, err := f.service(in["Id"])
+		if err != nil {
+			return nil, err
+		}
+		if len(s.instances) > 0 {
+			return nil, &fakeCloudMapError{"ResourceInUse", "service has instances"}
+		}
+		delete(f.services, s.id)
+		return jsonObject{}, nil
+	case "ListTagsForResource":
+		arn := jsonString(in["ResourceARN"])
+		for _, s := range f.services {
+			if s.arn() == arn {
+				list := []jsonObject{}
+				for k, v := range s.tags {
+					list = append(list, jsonObject{"Key": k, "Value": v})
+				}
+				return jsonObject{"Tags": list}, nil
+			}
+		}
+		return nil, &fakeCloudMapError{"ResourceNotFoundException", "resource not found"}
+	case "TagResource":
+		arn := jsonString(in["ResourceARN"])
+		for _, s := range f.services {
+			if s.arn() == arn {
+				for k, v := range jsonTags(in["Tags"]) {
+					s.tags[k] = v
+				}
+				return jsonObject{}, nil
+			}
+		}
+		return nil, &fakeCloudMapError{"ResourceNotFoundException", "resource not found"}
+	case "RegisterInstance":
+		s, err := f.service(in["ServiceId"])
+		if err != nil {
+			return nil, err
+		}
+		attributes := map[string]string{}
+		for k, v := range in["Attributes"].(jsonObject) {
+			attributes[k] = jsonString(v)
+		}
+		instanceID := jsonString(in["InstanceId"])
+		id := f.newOperation("INSTANCE", instanceID)
+		if f.failing > 0 {
+			f.failing--
+			f.operations[id].status = "FAIL"
+			return jsonObject{"OperationId": id}, nil
+		}
+		instance := &fakeInstance{attributes: attributes}
+		if s.customHealth {
+			instance.health = "HEALTHY"
+		}
+		apply := func() { s.instances[instanceID] = instance }
+		if f.hold {
+			f.operations[id].apply = apply
+		} else {
+			apply()
+		}
+		return jsonObject{"OperationId": id}, nil
+	case "DeregisterInstance":
+		s, err := f.service(in["ServiceId"])
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := s.instances[jsonString(in["InstanceId"])]; !ok {
+			return nil, &fakeCloudMapError{"InstanceNotFound", "instance not found"}
+		}
+		delete(s.instances, jsonString(in["InstanceId"]))
+		return jsonObject{"OperationId": f.newOperation("INSTANCE", jsonString(in["InstanceId"]))}, nil
+	case "ListInstances":
+		s, err := f.service(in["ServiceId"])
+		if err != nil {
+			return nil, err
+		}
+		instances := []jsonObject{}
+		for id, i := range s.instances {
+			instances = append(instances, jsonObject{"Id": id, "Attributes": i.attributes})
+		}
+		return jsonObject{"Instances": instances}, nil
+	case "DiscoverInstances":
+		instances := []jsonObject{}
+		for _, s := range f.services {
+			ns := f.namespaces[s.namespaceID]
+			if ns.name != jsonString(in["NamespaceName"]) || s.name != jsonString(in["ServiceName"]) {
+				continue
+			}
+			for id, i := range s.instances {
+				health := i.health
+				if len(health) == 0 {
+					health = "UNKNOWN"
+				}
+				if status := jsonString(in["HealthStatus"]); (status == "HEALTHY" || status == "") && health == "UNHEALTHY" {
+					continue
+				}
+				instances = append(instances, jsonObject{
+					"InstanceId":    id,
+					"NamespaceName": ns.name,
+					"ServiceName":   s.name,
+					"HealthStatus":  health,
+					"Attributes":    i.attributes,
+				})
+			}
+		}
+		return jsonObject{"Instances": instances}, nil
+	case "GetInstancesHealthStatus":
+		s, err := f.service(in["ServiceId"])
+		if err != nil {
+			return nil, err
+		}
+		status := map[string]string{}
+		for id, i := range s.instances {
+			if len(i.health) > 0 {
+				status[id] = i.health
+			}
+		}
+		return jsonObject{"Status": status}, nil
+	case "UpdateInstanceCustomHealthStatus":
+		s, err := f.service(in["ServiceId"])
+		if err != nil {
+			return nil, err
+		}
+		if !s.customHealth {
+			return nil, &fakeCloudMapError{"CustomHealthNotFound", "service has no custom health check"}
+		}
+		i, ok := s.instances[jsonString(in["InstanceId"])]
+		if !ok {
+			return nil, &fakeCloudMapError{"InstanceNotFound", "instance not found"}
+		}
+		i.health = jsonString(in["Status"])
+		return jsonObject{}, nil
+	}
+	return nil, &fakeCloudMapError{"UnknownOperationException", fmt.Sprintf("operation %s is not supported by the fake", op)}
+}
+
+func (f *fakeCloudMap) newID(prefix string) string {
+	f.nextID++
+	return fmt.Sprintf("%s-%d", prefix, f.nextID)
+}
+
+func (f *fakeCloudMap) newOperation(targetType, target string) string {
+	id := f.newID("op")
+	status := "SUCCESS"
+	if f.hold {
+		status = "PENDING"
+	}
+	f.operations[id] = &fakeOperation{targets: map[string]string{targetType: target}, status: status}
+	return id
+}
+
+func (f *fakeCloudMap) service(id interface{}) (*fakeService, *fakeCloudMapError) {
+	s, ok := f.services[jsonString(id)]
+	if !ok {
+		return nil, &fakeCloudMapError{"ServiceNotFound", "service not found"}
+	}
+	return s, nil
+}
+
+func (ns *fakeNamespace) summary() jsonObject {
+	return jsonObject{
+		"Id":          ns.id,
+		"Arn":         "arn:aws:servicediscovery:us-east-1:123456789012:namespace/" + ns.id,
+		"Name":        ns.name,
+		"Description": ns.description,
+		"Type":        "HTTP",
+		"Properties": jsonObject{
+			"HttpProperties": jsonObject{"HttpName": ns.name},
+		},
+	}
+}
+
+func (s *fakeService) arn() string {
+	return "arn:aws:servicediscovery:us-east-1:123456789012:service/" + s.id
+}
+
+func (s *fakeService) summary() jsonObject {
+	summary := jsonObject{
+		"Id":            s.id,
+		"Arn":           s.arn(),
+		"Name":          s.name,
+		"NamespaceId":   s.namespaceID,
+		"InstanceCount": len(s.instances),
+	}
+	if len(s.description) > 0 {
+		summary["Description"] = s.description
+	}
+	if s.dnsConfig != nil {
+		summary["DnsConfig"] = s.dnsConfig
+	}
+	if s.customHealth {
+		summary["HealthCheckCustomConfig"] = jsonObject{}
+	}
+	return summary
+}
+
+// createService adds a service that was not created by consul-aws, with
+// one instance per address.
+func (f *fakeCloudMap) createService(name string, tags map[string]string, addresses ...string) string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	s := &fakeService{
+		id:          f.newID("srv"),
+		name:        name,
+		namespaceID: fakeNamespaceID,
+		tags:        tags,
+		instances:   map[string]*fakeInstance{},
+	}
+	if s.tags == nil {
+		s.tags = map[string]string{}
+	}
+	for i, address := range addresses {
+		host, port, _ := strings.Cut(address, ":")
+		s.instances[fmt.Sprintf("%s-%d", name, i)] = &fakeInstance{attributes: map[string]string{
+			"AWS_INSTANCE_IPV4": host,
+			"AWS_INSTANCE_PORT": port,
+		}}
+	}
+	f.services[s.id] = s
+	return s.id
+}
+
+// describeService sets the description of a service.
+func (f *fakeCloudMap) describeService(id, description string) {
+	f.lock.Lock()
+	f.services[id].description = description
+	f.lock.Unlock()
+}
+
+// tags returns the resource tags of the service with the given name, or nil
+// if there is no such service.
+func (f *fakeCloudMap) tags(name string) map[string]string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, s := range f.services {
+		if s.name == name {
+			result := map[string]string{}
+			for k, v := range s.tags {
+				result[k] = v
+			}
+			return result
+		}
+	}
+	return nil
+}
+
+// throttle rejects the next n requests of the operation with a
+// ThrottlingException.
+func (f *fakeCloudMap) throttle(op string, n int) {
+	f.lock.Lock()
+	f.throttled[op] = n
+	f.lock.Unlock()
+}
+
+// failRegistrations makes the operations of the next n registrations fail,
+// without registering the instances.
+func (f *fakeCloudMap) failRegistrations(n int) {
+	f.lock.Lock()
+	f.failing = n
+	f.lock.Unlock()
+}
+
+// holdOperations keeps new operations pending until releaseOperations.
+// Registrations made meanwhile only show once released.
+func (f *fakeCloudMap) holdOperations() {
+	f.lock.Lock()
+	f.hold = true
+	f.lock.Unlock()
+}
+
+// releaseOperations completes the pending operations successfully.
+func (f *fakeCloudMap) releaseOperations() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.hold = false
+	for _, o := range f.operations {
+		if o.status == "PENDING" {
+			o.status = "SUCCESS"
+			if o.apply != nil {
+				o.apply()
+			}
+		}
+	}
+}
+
+// operationCount returns the number of operations started.
+func (f *fakeCloudMap) operationCount() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return len(f.operations)
+}
+
+// deleteService removes a service and its instances.
+func (f *fakeCloudMap) deleteService(id string) {
+	f.lock.Lock()
+	delete(f.services, id)
+	f.lock.Unlock()
+}
+
+// instances returns the attributes of the instances of the service with the
+// given name, keyed by instance ID, or nil if there is no such service.
+func (f *fakeCloudMap) instances(name string) map[string]map[string]string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, s := range f.services {
+		if s.name != name {
+			continue
+		}
+		result := map[string]map[string]string{}
+		for id, i := range s.instances {
+			result[id] = i.attributes
+		}
+		return result
+	}
+	return nil
+}
+
+// health returns the health status of an instance of the service with the
+// given name.
+func (f *fakeCloudMap) health(name, instanceID string) string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, s := range f.services {
+		if i, ok := s.instances[instanceID]; ok && s.name == name {
+			return i.health
+		}
+	}
+	return ""
+}
+
+// setHealth sets the health status of an instance of the service with the
+// given name.
+func (f *fakeCloudMap) setHealth(name, instanceID, health string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, s := range f.services {
+		if i, ok := s.instances[instanceID]; ok && s.name == name {
+			i.health = health
+		}
+	}
+}
+
+func jsonString(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
+
+// jsonFilter returns the first value of the filter with the given name.
+func jsonFilter(in jsonObject, name string) string {
+	filters, _ := in["Filters"].([]interface{})
+	for _, filter := range filters {
+		filter, _ := filter.(jsonObject)
+		if jsonString(filter["Name"]) != name {
+			continue
+		}
+		if values, _ := filter["Values"].([]interface{}); len(values) > 0 {
+			return jsonString(values[0])
+		}
+	}
+	return ""
+}
+
+func jsonTags(v interface{}) map[string]string {
+	result := map[string]string{}
+	list, _ := v.([]interface{})
+	for _, t := range list {
+		t, _ := t.(jsonObject)
+		result[jsonString(t["Key"])] = jsonString(t["Value"])
+	}
+	return result
+}
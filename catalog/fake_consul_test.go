@@ -0,0 +1,417 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package catalog
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// fakeConsulMaxWait caps the wait time of blocking queries, so the sync
+// notices stop quickly.
+const fakeConsulMaxWait = 200 * time.Millisecond
+
+// fakeConsul is an in-process Consul serving the catalog and health
+// endpoints used by consul-aws. Blocking queries on the services return as
+// soon as the catalog changes. Locks are taken with lockClient.
+type fakeConsul struct {
+	lock     sync.Mutex
+	index    uint64
+	changed  chan struct{}
+	nodes    map[string]*api.Node
+	services map[string]*fakeConsulService
+	checks   map[string]*api.HealthCheck
+	locks    map[string]*fakeKVLock
+}
+
+type fakeConsulService struct {
+	node    string
+	service *api.AgentService
+}
+
+// newFakeConsul starts a fake Consul and returns it with a client talking to
+// it.
+func newFakeConsul(t *testing.T) (*fakeConsul, ConsulClient) {
+	f := &fakeConsul{
+		index:    1,
+		changed:  make(chan struct{}),
+		nodes:    map[string]*api.Node{},
+		services: map[string]*fakeConsulService{},
+		checks:   map[string]*api.HealthCheck{},
+		locks:    map[string]*fakeKVLock{},
+	}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+
+	client, err := api.NewClient(&api.Config{Address: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, NewConsulClient(client)
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	switch {
+	case path == "/v1/catalog/services":
+		f.wait(r)
+		f.respond(w, f.catalogServices())
+	case strings.HasPrefix(path, "/v1/catalog/service/"):
+		f.respond(w, f.catalogService(strings.TrimPrefix(path, "/v1/catalog/service/"), r.URL.Query().Get("tag")))
+	case strings.HasPrefix(path, "/v1/catalog/node/"):
+		f.respond(w, f.catalogNode(strings.TrimPrefix(path, "/v1/catalog/node/")))
+	case strings.HasPrefix(path, "/v1/health/checks/"):
+		f.respond(w, f.healthChecks(strings.TrimPrefix(path, "/v1/health/checks/")))
+	case strings.HasPrefix(path, "/v1/kv/") && r.Method == http.MethodGet:
+		f.wait(r)
+		f.respond(w, f.kvGet(strings.TrimPrefix(path, "/v1/kv/")))
+	case path == "/v1/catalog/register" && r.Method == http.MethodPut:
+		var reg api.CatalogRegistration
+		if err := json.NewDecoder(r.Body).Decode(&reg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.register(&reg)
+		f.respond(w, true)
+	case path == "/v1/catalog/deregister" && r.Method == http.MethodPut:
+		var dereg api.CatalogDeregistration
+		if err := json.NewDecoder(r.Body).Decode(&dereg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.deregister(&dereg)
+		f.respond(w, true)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// wait blocks until the index is past the index of the query, or the wait
+// time of the query passed.
+func (f *fakeConsul) wait(r *http.Request) {
+	index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+	wait, _ := time.ParseDuration(r.URL.Query().Get("wait"))
+	if wait == 0 || wait > fakeConsulMaxWait {
+		wait = fakeConsulMaxWait
+	}
+	f.lock.Lock()
+	current, changed := f.index, f.changed
+	f.lock.Unlock()
+	if index == 0 || current > index {
+		return
+	}
+	select {
+	case <-changed:
+	case <-time.After(wait):
+	}
+}
+
+func (f *fakeConsul) respond(w http.ResponseWriter, v interface{}) {
+	f.lock.Lock()
+	index := f.index
+	f.lock.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(index, 10))
+	w.Header().Set("X-Consul-LastContact", "0")
+	w.Header().Set("X-Consul-KnownLeader", "true")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// bump records a change of the catalog. It has to be called with the lock
+// held.
+func (f *fakeConsul) bump() {
+	f.index++
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeConsul) catalogServices() map[string][]string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	result := map[string][]string{}
+	for _, s := range f.services {
+		tags := result[s.service.Service]
+		if tags == nil {
+			tags = []string{}
+		}
+		for _, t := range s.service.Tags {
+			if !contains(tags, t) {
+				tags = append(tags, t)
+			}
+		}
+		result[s.service.Service] = tags
+	}
+	return result
+}
+
+func (f *fakeConsul) catalogService(name, tag string) []*api.CatalogService {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	result := []*api.CatalogService{}
+	for _, s := range f.services {
+		if s.service.Service != name || (len(tag) > 0 && !contains(s.service.Tags, tag)) {
+			continue
+		}
+		node := f.nodes[s.node]
+		result = append(result, &api.CatalogService{
+			Node:           node.Node,
+			Address:        node.Address,
+			NodeMeta:       node.Meta,
+			ServiceID:      s.service.ID,
+			ServiceName:    s.service.Service,
+			ServiceAddress: s.service.Address,
+			ServicePort:    s.service.Port,
+			ServiceTags:    s.service.Tags,
+			ServiceMeta:    s.service.Meta,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ServiceID < result[j].ServiceID })
+	return result
+}
+
+func (f *fakeConsul) catalogNode(name string) *api.CatalogNode {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	node, ok := f.nodes[name]
+	if !ok {
+		return nil
+	}
+	result := &api.CatalogNode{Node: node, Services: map[string]*api.AgentService{}}
+	for _, s := range f.services {
+		if s.node == name {
+			result.Services[s.service.ID] = s.service
+		}
+	}
+	return result
+}
+
+func (f *fakeConsul) healthChecks(name string) api.HealthChecks {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	result := api.HealthChecks{}
+	for _, c := range f.checks {
+		if c.ServiceName == name {
+			result = append(result, c)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].CheckID < result[j].CheckID })
+	return result
+}
+
+func (f *fakeConsul) register(reg *api.CatalogRegistration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if _, ok := f.nodes[reg.Node]; !ok || !reg.SkipNodeUpdate {
+		f.nodes[reg.Node] = &api.Node{Node: reg.Node, Address: reg.Address, Meta: reg.NodeMeta}
+	}
+	if reg.Service != nil {
+		f.services[reg.Service.ID] = &fakeConsulService{node: reg.Node, service: reg.Service}
+	}
+	if reg.Check != nil {
+		check := &api.HealthCheck{
+			Node:      reg.Node,
+			CheckID:   reg.Check.CheckID,
+			Name:      reg.Check.Name,
+			Status:    reg.Check.Status,
+			ServiceID: reg.Check.ServiceID,
+		}
+		if s, ok := f.services[check.ServiceID]; ok {
+			check.ServiceName = s.service.Service
+		}
+		f.checks[check.CheckID] = check
+	}
+	f.bump()
+}
+
+func (f *fakeConsul) deregister(dereg *api.CatalogDeregistration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if len(dereg.CheckID) > 0 {
+		delete(f.checks, dereg.CheckID)
+		f.bump()
+		return
+	}
+	delete(f.services, dereg.ServiceID)
+	for id, c := range f.checks {
+		if c.ServiceID == dereg.ServiceID {
+			delete(f.checks, id)
+		}
+	}
+	f.bump()
+}
+
+// registerService adds a service instance on its own node, as a Consul agent
+// would.
+func (f *fakeConsul) registerService(service *api.AgentService, checkStatus string) {
+	f.register(&api.CatalogRegistration{
+		Node:    service.ID + "-node",
+		Address: service.Address,
+		Service: service,
+	})
+	if len(checkStatus) > 0 {
+		f.register(&api.CatalogRegistration{
+			Node:           service.ID + "-node",
+			SkipNodeUpdate: true,
+			Check: &api.AgentCheck{
+				CheckID:   "check-" + service.ID,
+				ServiceID: service.ID,
+				Name:      "check",
+				Status:    checkStatus,
+			},
+		})
+	}
+}
+
+// serviceInstances returns the instances of the service with the given
+// name, keyed by service ID.
+func (f *fakeConsul) serviceInstances(name string) map[string]*api.AgentService {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	result := map[string]*api.AgentService{}
+	for _, s := range f.services {
+		if s.service.Service == name {
+			result[s.service.ID] = s.service
+		}
+	}
+	return result
+}
+
+// checkStatus returns the status of the checks of a service instance.
+func (f *fakeConsul) checkStatus(serviceID string) string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, c := range f.checks {
+		if c.ServiceID == serviceID {
+			return c.Status
+		}
+	}
+	return ""
+}
+
+// fakeKVLock is a lock key of the fake: the value of the last holder, the
+// channel closed when the current holder loses the lock and how many times
+// it was acquired.
+type fakeKVLock struct {
+	value    []byte
+	held     bool
+	lost     chan struct{}
+	acquired int
+}
+
+// kvGet returns the lock key as Consul does, with a session while it is
+// held.
+func (f *fakeConsul) kvGet(key string) []*api.KVPair {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	l, ok := f.locks[key]
+	if !ok {
+		return []*api.KVPair{}
+	}
+	pair := &api.KVPair{Key: key, Value: l.value}
+	if l.held {
+		pair.Session = "fake-session"
+	}
+	return []*api.KVPair{pair}
+}
+
+// loseLock takes the lock on the key from its holder, like an invalidated
+// session.
+func (f *fakeConsul) loseLock(key string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if l, ok := f.locks[key]; ok && l.held {
+		l.held = false
+		close(l.lost)
+		f.bump()
+	}
+}
+
+// lockAcquired returns how many times the lock on the key was acquired.
+func (f *fakeConsul) lockAcquired(key string) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if l, ok := f.locks[key]; ok {
+		return l.acquired
+	}
+	return 0
+}
+
+// lockClient wraps a client of the fake, so its locks are taken on the fake
+// instead of with the session endpoints, which the fake doesn't serve.
+func (f *fakeConsul) lockClient(client ConsulClient) ConsulClient {
+	return fakeLockClient{ConsulClient: client, consul: f}
+}
+
+type fakeLockClient struct {
+	ConsulClient
+	consul *fakeConsul
+}
+
+func (c fakeLockClient) LockOpts(opts *api.LockOptions) (ConsulLocker, error) {
+	return &fakeLocker{consul: c.consul, key: opts.Key, value: opts.Value}, nil
+}
+
+// fakeLocker is a ConsulLocker on a lock key of the fake.
+type fakeLocker struct {
+	consul *fakeConsul
+	key    string
+	value  []byte
+	lost   chan struct{}
+}
+
+func (l *fakeLocker) Lock(stop <-chan struct{}) (<-chan struct{}, error) {
+	f := l.consul
+	for {
+		f.lock.Lock()
+		if current, ok := f.locks[l.key]; !ok || !current.held {
+			acquired := 1
+			if ok {
+				acquired += current.acquired
+			}
+			l.lost = make(chan struct{})
+			f.locks[l.key] = &fakeKVLock{value: l.value, held: true, lost: l.lost, acquired: acquired}
+			f.bump()
+			f.lock.Unlock()
+			return l.lost, nil
+		}
+		changed := f.changed
+		f.lock.Unlock()
+		select {
+		case <-stop:
+			return nil, nil
+		case <-changed:
+		}
+	}
+}
+
+func (l *fakeLocker) Unlock() error {
+	f := l.consul
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	current, ok := f.locks[l.key]
+	if !ok || !current.held || current.lost != l.lost {
+		return api.ErrLockNotHeld
+	}
+	current.held = false
+	f.bump()
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
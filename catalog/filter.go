@@ -0,0 +1,137 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package catalog
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Filter decides which services are synced in one direction. A service is
+// synced when its name matches one of the Include patterns, or there are
+// none, and none of the Exclude patterns. Patterns are globs as understood by
+// path.Match, or regular expressions when enclosed in slashes, like
+// "/^web-.*$/".
+//
+// IncludeTags and ExcludeTags only apply to Consul services: a service is
+// synced when it has one of the IncludeTags, or there are none, and none of
+// the ExcludeTags.
+//
+// Services that stop matching a filter are removed from the other side like
+// services that have been deregistered.
+type Filter struct {
+	Include     []string
+	Exclude     []string
+	IncludeTags []string
+	ExcludeTags []string
+}
+
+// Validate returns an error if any of the patterns is invalid.
+func (f Filter) Validate() error {
+	for _, p := range append(append([]string{}, f.Include...), f.Exclude...) {
+		if _, err := newMatcher(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type matcher func(name string) bool
+
+func newMatcher(pattern string) (matcher, error) {
+	if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression %q: %s", pattern, err)
+		}
+		return re.MatchString, nil
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid glob %q: %s", pattern, err)
+	}
+	return func(name string) bool {
+		ok, _ := path.Match(pattern, name)
+		return ok
+	}, nil
+}
+
+// serviceFilter is the compiled form of a Filter. The zero value allows
+// every service.
+type serviceFilter struct {
+	include     []matcher
+	exclude     []matcher
+	includeTags map[string]struct{}
+	excludeTags map[string]struct{}
+}
+
+func newServiceFilter(f Filter) (serviceFilter, error) {
+	sf := serviceFilter{}
+	for _, p := range f.Include {
+		m, err := newMatcher(p)
+		if err != nil {
+			return sf, err
+		}
+		sf.include = append(sf.include, m)
+	}
+	for _, p := range f.Exclude {
+		m, err := newMatcher(p)
+		if err != nil {
+			return sf, err
+		}
+		sf.exclude = append(sf.exclude, m)
+	}
+	if len(f.IncludeTags) > 0 {
+		sf.includeTags = map[string]struct{}{}
+		for _, t := range f.IncludeTags {
+			sf.includeTags[t] = struct{}{}
+		}
+	}
+	if len(f.ExcludeTags) > 0 {
+		sf.excludeTags = map[string]struct{}{}
+		for _, t := range f.ExcludeTags {
+			sf.excludeTags[t] = struct{}{}
+		}
+	}
+	return sf, nil
+}
+
+// allow returns true if the service with the given name and tags should be
+// synced.
+func (f serviceFilter) allow(name string, tags []string) bool {
+	if len(f.include) > 0 && !matchAny(f.include, name) {
+		return false
+	}
+	if matchAny(f.exclude, name) {
+		return false
+	}
+	if f.includeTags != nil {
+		found := false
+		for _, t := range tags {
+			if _, ok := f.includeTags[t]; ok {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for _, t := range tags {
+		if _, ok := f.excludeTags[t]; ok {
+			return false
+		}
+	}
+	return true
+}
+
+func matchAny(matchers []matcher, name string) bool {
+	for _, m := range matchers {
+		if m(name) {
+			return true
+		}
+	}
+	return false
+}
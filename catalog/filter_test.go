@@ -0,0 +1,45 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package catalog
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServiceFilterAllow(t *testing.T) {
+	type variant struct {
+		filter   Filter
+		name     string
+		tags     []string
+		expected bool
+	}
+	variants := []variant{
+		{filter: Filter{}, name: "web", expected: true},
+		{filter: Filter{Include: []string{"web*"}}, name: "web-1", expected: true},
+		{filter: Filter{Include: []string{"web*"}}, name: "api", expected: false},
+		{filter: Filter{Exclude: []string{"consul"}}, name: "consul", expected: false},
+		{filter: Filter{Exclude: []string{"*-sidecar-proxy"}}, name: "web-sidecar-proxy", expected: false},
+		{filter: Filter{Exclude: []string{"*-sidecar-proxy"}}, name: "web", expected: true},
+		{filter: Filter{Include: []string{"/^(web|api)$/"}}, name: "api", expected: true},
+		{filter: Filter{Include: []string{"/^(web|api)$/"}}, name: "api-2", expected: false},
+		{filter: Filter{Include: []string{"*"}, Exclude: []string{"/^db/"}}, name: "db-main", expected: false},
+		{filter: Filter{IncludeTags: []string{"public"}}, name: "web", tags: []string{"v1", "public"}, expected: true},
+		{filter: Filter{IncludeTags: []string{"public"}}, name: "web", tags: []string{"v1"}, expected: false},
+		{filter: Filter{ExcludeTags: []string{"internal"}}, name: "web", tags: []string{"internal"}, expected: false},
+		{filter: Filter{ExcludeTags: []string{"internal"}}, name: "web", expected: true},
+	}
+	for _, v := range variants {
+		f, err := newServiceFilter(v.filter)
+		require.NoError(t, err)
+		require.Equal(t, v.expected, f.allow(v.name, v.tags), "%+v %s %v", v.filter, v.name, v.tags)
+	}
+}
+
+func TestFilterValidate(t *testing.T) {
+	require.NoError(t, Filter{Include: []string{"web*", "/^api$/"}}.Validate())
+	require.Error(t, Filter{Include: []string{"/(/"}}.Validate())
+	require.Error(t, Filter{Exclude: []string{"[a-"}}.Validate())
+}
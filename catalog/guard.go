@@ -0,0 +1,159 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package catalog
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// RemovalGuard refuses the removals of sync runs that would remove more
+// than the allowed number or share of the known instances at once, which is
+// what a truncated fetch looks like. Refused removals are made once an
+// operator confirmed them, or after they have been refused for a number of
+// sync runs in a row. A nil RemovalGuard allows everything. It is safe for
+// concurrent use.
+type RemovalGuard struct {
+	maxRemovals int
+	maxPercent  int
+	cycles      int
+
+	lock    sync.Mutex
+	blocked map[fetcher]*BlockedRemoval
+}
+
+// BlockedRemoval describes the refused removals of one direction and
+// namespace. Cycles is the number of sync runs in a row they were refused.
+type BlockedRemoval struct {
+	Direction string    `json:"direction"`
+	Namespace string    `json:"namespace"`
+	Removals  int       `json:"removals"`
+	Known     int       `json:"known"`
+	Cycles    int       `json:"cycles"`
+	Since     time.Time `json:"since"`
+	Confirmed bool      `json:"confirmed"`
+}
+
+// NewRemovalGuard returns a guard refusing more than maxRemovals removals
+// or more than maxPercent percent of the known instances in a single sync
+// run. A limit of 0 is not checked. With cycles greater than 0, removals
+// refused for that many sync runs in a row are made.
+func NewRemovalGuard(maxRemovals, maxPercent, cycles int) *RemovalGuard {
+	return &RemovalGuard{
+		maxRemovals: maxRemovals,
+		maxPercent:  maxPercent,
+		cycles:      cycles,
+		blocked:     map[fetcher]*BlockedRemoval{},
+	}
+}
+
+// exceeded returns true if removing removals of known instances is over
+// the limits.
+func (g *RemovalGuard) exceeded(removals, known int) bool {
+	return (g.maxRemovals > 0 && removals > g.maxRemovals) ||
+		(g.maxPercent > 0 && removals*100 > known*g.maxPercent)
+}
+
+// allow returns true if the run may remove removals of the known
+// instances. Refused removals are recorded in the run. Dry runs only look
+// at the state of the guard, so a plan doesn't count as a refused run and
+// the apply following it decides like the plan did.
+func (g *RemovalGuard) allow(run *syncRun, removals, known int) bool {
+	if g == nil || removals == 0 {
+		return true
+	}
+	key := fetcher{side: run.direction, namespace: run.namespace}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if run.dry {
+		if !g.exceeded(removals, known) {
+			return true
+		}
+		if b, ok := g.blocked[key]; ok && (b.Confirmed || (g.cycles > 0 && b.Cycles >= g.cycles)) {
+			return true
+		}
+		run.log.Error("refusing removals over the limits, confirm them if they are expected", "count", removals, "known", known)
+		run.block(removals)
+		return false
+	}
+	if !g.exceeded(removals, known) {
+		delete(g.blocked, key)
+		metricRemovalsBlocked.WithLabelValues(run.direction, run.namespace).Set(0)
+		return true
+	}
+
+	b, ok := g.blocked[key]
+	if !ok {
+		b = &BlockedRemoval{Direction: run.direction, Namespace: run.namespace, Since: time.Now()}
+		g.blocked[key] = b
+	}
+	switch {
+	case b.Confirmed:
+		run.log.Warn("making removals confirmed by an operator", "count", removals, "known", known)
+	case g.cycles > 0 && b.Cycles >= g.cycles:
+		run.log.Warn("making removals refused for too many sync runs in a row", "count", removals, "known", known, "runs", b.Cycles)
+	default:
+		b.Removals = removals
+		b.Known = known
+		b.Cycles++
+		run.log.Error("refusing removals over the limits, confirm them if they are expected",
+			"count", removals, "known", known, "runs", b.Cycles)
+		run.block(removals)
+		metricRemovalsBlocked.WithLabelValues(run.direction, run.namespace).Set(float64(removals))
+		return false
+	}
+	delete(g.blocked, key)
+	metricRemovalsBlocked.WithLabelValues(run.direction, run.namespace).Set(0)
+	return true
+}
+
+// Blocked returns the refused removals, sorted by direction and namespace.
+func (g *RemovalGuard) Blocked() []BlockedRemoval {
+	if g == nil {
+		return []BlockedRemoval{}
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	result := make([]BlockedRemoval, 0, len(g.blocked))
+	for _, b := range g.blocked {
+		result = append(result, *b)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Direction != result[j].Direction {
+			return result[i].Direction < result[j].Direction
+		}
+		return result[i].Namespace < result[j].Namespace
+	})
+	return result
+}
+
+// Confirm allows the refused removals to be made by the next sync run of
+// their direction and namespace. It returns how many were confirmed.
+func (g *RemovalGuard) Confirm() int {
+	if g == nil {
+		return 0
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for _, b := range g.blocked {
+		b.Confirmed = true
+	}
+	return len(g.blocked)
+}
+
+// countNodes returns the number of nodes of the services selected by
+// include.
+func countNodes(services map[string]service, include func(service) bool) int {
+	count := 0
+	for _, s := range services {
+		if !include(s) {
+			continue
+		}
+		for _, ports := range s.nodes {
+			count += len(ports)
+		}
+	}
+	return count
+}
@@ -0,0 +1,79 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package catalog
+
+import (
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemovalGuard(t *testing.T) {
+	newRun := func() *syncRun { return newSyncRun(hclog.NewNullLogger(), directionToConsul, "ns-guard", false) }
+
+	var nilGuard *RemovalGuard
+	require.True(t, nilGuard.allow(newRun(), 100, 100))
+	require.Empty(t, nilGuard.Blocked())
+
+	guard := NewRemovalGuard(5, 50, 3)
+	require.True(t, guard.allow(newRun(), 5, 100))
+	require.True(t, guard.allow(newRun(), 2, 4))
+
+	// Over the absolute limit.
+	run := newRun()
+	require.False(t, guard.allow(run, 6, 100))
+	require.Equal(t, int64(6), run.blocked.Load())
+	require.Equal(t, float64(6), testutil.ToFloat64(metricRemovalsBlocked.WithLabelValues(directionToConsul, "ns-guard")))
+	blocked := guard.Blocked()
+	require.Len(t, blocked, 1)
+	require.Equal(t, 1, blocked[0].Cycles)
+
+	// Back under the limits, nothing is refused anymore.
+	require.True(t, guard.allow(newRun(), 1, 100))
+	require.Empty(t, guard.Blocked())
+	require.Equal(t, float64(0), testutil.ToFloat64(metricRemovalsBlocked.WithLabelValues(directionToConsul, "ns-guard")))
+
+	// Over the percentage, made after being refused for three runs.
+	for i := 0; i < 3; i++ {
+		require.False(t, guard.allow(newRun(), 3, 4))
+	}
+	require.Equal(t, 3, guard.Blocked()[0].Cycles)
+	require.True(t, guard.allow(newRun(), 3, 4))
+	require.Empty(t, guard.Blocked())
+
+	// Made once confirmed.
+	require.False(t, guard.allow(newRun(), 3, 4))
+	require.Equal(t, 1, guard.Confirm())
+	require.True(t, guard.Blocked()[0].Confirmed)
+	require.True(t, guard.allow(newRun(), 3, 4))
+	require.False(t, guard.allow(newRun(), 3, 4))
+}
+
+func TestRemovalGuard_Sync(t *testing.T) {
+	cloudMap, awsClient := newFakeCloudMap(t)
+	consul, consulClient := newFakeConsul(t)
+	config := Config{
+		ToConsul:     true,
+		Namespaces:   []NamespaceConfig{{ID: fakeNamespaceID}},
+		RemovalGuard: NewRemovalGuard(0, 50, 0),
+	}
+	awsID := cloudMap.createService("api", nil, "10.1.0.1:8080", "10.1.0.2:8080", "10.1.0.3:8080")
+
+	s, err := newSyncer(config, awsClient, consulClient)
+	require.NoError(t, err)
+	require.NoError(t, s.fetch())
+	require.Equal(t, []Summary{{Direction: directionToConsul, Namespace: fakeNamespaceID, Created: 3}}, summaries(s.run(false)))
+
+	// A namespace that looks empty doesn't remove everything from Consul.
+	cloudMap.deleteService(awsID)
+	require.NoError(t, s.fetch())
+	require.Equal(t, []Summary{{Direction: directionToConsul, Namespace: fakeNamespaceID, Blocked: 3}}, summaries(s.run(false)))
+	require.Len(t, consul.serviceInstances("api"), 3)
+
+	config.RemovalGuard.Confirm()
+	require.Equal(t, []Summary{{Direction: directionToConsul, Namespace: fakeNamespaceID, Removed: 3}}, summaries(s.run(false)))
+	require.Empty(t, consul.serviceInstances("api"))
+}
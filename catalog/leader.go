@@ -0,0 +1,140 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package catalog
+
+import (
+	"context"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-hclog"
+)
+
+const (
+	lockSessionName = "consul-aws"
+	lockSessionTTL  = "15s"
+	lockRetryTime   = 5 * time.Second
+)
+
+// leader acquires the Consul lock on a KV key, so only one of several
+// consul-aws processes syncs at a time.
+type leader struct {
+	client ConsulClient
+	log    hclog.Logger
+	key    string
+	id     string
+	status *Status
+	lock   ConsulLocker
+}
+
+func newLeader(client ConsulClient, key, id string, status *Status) (*leader, error) {
+	lock, err := client.LockOpts(&api.LockOptions{
+		Key:            key,
+		Value:          []byte(id),
+		SessionName:    lockSessionName,
+		SessionTTL:     lockSessionTTL,
+		MonitorRetries: 3,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &leader{
+		client: client,
+		log:    hclog.Default().Named("leader").With("id", id),
+		key:    key,
+		id:     id,
+		status: status,
+		lock:   lock,
+	}, nil
+}
+
+// acquire blocks until the lock is held and returns a channel that is
+// closed when it is lost. It returns nil if stop is closed first.
+func (l *leader) acquire(stop chan struct{}) <-chan struct{} {
+	l.status.setLeader(l.currentLeader(), false)
+	for {
+		l.log.Info("waiting for leadership", "leader", l.currentLeader())
+		lost, err := l.lock.Lock(stop)
+		if err != nil {
+			l.log.Error("cannot acquire leadership", "error", err)
+			select {
+			case <-stop:
+				return nil
+			case <-time.After(lockRetryTime):
+				continue
+			}
+		}
+		if lost == nil {
+			return nil
+		}
+		l.log.Info("acquired leadership")
+		l.status.setLeader(l.id, true)
+		return lost
+	}
+}
+
+// release gives up the lock, so a standby can take over right away.
+func (l *leader) release() {
+	if err := l.lock.Unlock(); err != nil && err != api.ErrLockNotHeld {
+		l.log.Error("cannot release leadership", "error", err)
+	}
+}
+
+// watch keeps the leader known to the status up to date while standing by.
+func (l *leader) watch(stop, stopped chan struct{}) {
+	defer close(stopped)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	waitIndex := uint64(0)
+	for {
+		opts := &api.QueryOptions{
+			WaitIndex: waitIndex,
+			WaitTime:  WaitTime * time.Second,
+		}
+		pair, meta, err := l.client.KV().Get(l.key, opts.WithContext(ctx))
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if err != nil {
+			l.log.Debug("cannot watch leader", "error", err)
+			select {
+			case <-stop:
+				return
+			case <-time.After(lockRetryTime):
+				continue
+			}
+		}
+		waitIndex = meta.LastIndex
+		leader := leaderFromPair(pair)
+		if l.status.observeLeader(leader) {
+			l.log.Info("leader changed", "leader", leader)
+		}
+	}
+}
+
+// currentLeader returns the ID of the process holding the lock, or an empty
+// string.
+func (l *leader) currentLeader() string {
+	pair, _, err := l.client.KV().Get(l.key, nil)
+	if err != nil {
+		return ""
+	}
+	return leaderFromPair(pair)
+}
+
+func leaderFromPair(pair *api.KVPair) string {
+	if pair == nil || len(pair.Session) == 0 {
+		return ""
+	}
+	return string(pair.Value)
+}
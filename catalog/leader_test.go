@@ -0,0 +1,101 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package catalog
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLeaderFromPair(t *testing.T) {
+	require.Equal(t, "", leaderFromPair(nil))
+	require.Equal(t, "", leaderFromPair(&api.KVPair{Value: []byte("host-a")}), "lock was released")
+	require.Equal(t, "host-a", leaderFromPair(&api.KVPair{Value: []byte("host-a"), Session: "abc"}))
+}
+
+// TestLeader_WatchStop stops watching the leader while waiting to retry a
+// failed KV read.
+func TestLeader_WatchStop(t *testing.T) {
+	server := httptest.NewServer(nil)
+	server.Close()
+	client, err := api.NewClient(&api.Config{Address: server.URL})
+	require.NoError(t, err)
+	l := &leader{
+		client: NewConsulClient(client),
+		log:    hclog.NewNullLogger(),
+		key:    "consul-aws/leader",
+		status: NewStatus(),
+	}
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go l.watch(stop, stopped)
+	time.Sleep(100 * time.Millisecond)
+	close(stop)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("watch did not stop")
+	}
+}
+
+// TestLeader_Failover runs two processes with the same lock key: only the
+// leader syncs, and the standby takes over once it stops or loses the lock.
+func TestLeader_Failover(t *testing.T) {
+	cloudMap, awsClient := newFakeCloudMap(t)
+	consul, consulClient := newFakeConsul(t)
+	consulClient = consul.lockClient(consulClient)
+	config := Config{
+		ToAWS:           true,
+		Namespaces:      []NamespaceConfig{{ID: fakeNamespaceID}},
+		ConsulPrefix:    "consul_",
+		AWSPullInterval: time.Second,
+		LockKey:         "consul-aws/leader",
+	}
+	configA, configB := config, config
+	configA.LockID, configA.Status = "a", NewStatus()
+	configB.LockID, configB.Status = "b", NewStatus()
+	leads := func(status *Status, leader string, isLeader bool) func() bool {
+		return func() bool {
+			current, is := status.Leader()
+			return current == leader && is == isLeader
+		}
+	}
+	instances := func(n int) func() bool {
+		return func() bool { return len(cloudMap.instances("consul_web")) == n }
+	}
+
+	stopA, stoppedA := make(chan struct{}), make(chan struct{})
+	go Sync(configA, awsClient, consulClient, stopA, stoppedA)
+	require.Eventually(t, leads(configA.Status, "a", true), 5*time.Second, 10*time.Millisecond)
+	stopB, stoppedB := make(chan struct{}), make(chan struct{})
+	go Sync(configB, awsClient, consulClient, stopB, stoppedB)
+	require.Eventually(t, leads(configB.Status, "a", false), 5*time.Second, 10*time.Millisecond)
+
+	consul.registerService(&api.AgentService{ID: "web1", Service: "web", Address: "10.0.0.1", Port: 80}, "")
+	require.Eventually(t, instances(1), 5*time.Second, 10*time.Millisecond)
+
+	// The standby takes over when the leader stops.
+	close(stopA)
+	<-stoppedA
+	require.Eventually(t, leads(configB.Status, "b", true), 5*time.Second, 10*time.Millisecond)
+	consul.registerService(&api.AgentService{ID: "web2", Service: "web", Address: "10.0.0.2", Port: 80}, "")
+	require.Eventually(t, instances(2), 5*time.Second, 10*time.Millisecond)
+
+	// A leader that loses the lock stops syncing and competes for it
+	// again.
+	acquired := consul.lockAcquired(config.LockKey)
+	consul.loseLock(config.LockKey)
+	require.Eventually(t, func() bool {
+		return consul.lockAcquired(config.LockKey) == acquired+1 && leads(configB.Status, "b", true)()
+	}, 5*time.Second, 10*time.Millisecond)
+	consul.registerService(&api.AgentService{ID: "web3", Service: "web", Address: "10.0.0.3", Port: 80}, "")
+	require.Eventually(t, instances(3), 5*time.Second, 10*time.Millisecond)
+
+	close(stopB)
+	<-stoppedB
+}
@@ -0,0 +1,153 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package catalog
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	metricsNamespace = "consul_aws"
+	// metricsCloudMap is the subsystem of the metrics of the CloudMap
+	// client.
+	metricsCloudMap = "cloudmap"
+
+	// directionToAWS and directionToConsul label the metrics of the sync
+	// in each direction.
+	directionToAWS    = "to-aws"
+	directionToConsul = "to-consul"
+
+	// sideConsul and sideAWS label the metrics of the fetchers.
+	sideConsul = "consul"
+	sideAWS    = "aws"
+
+	operationCreate = "create"
+	operationUpdate = "update"
+	operationRemove = "remove"
+	operationHealth = "health"
+)
+
+// The metrics are registered with the default Prometheus registry and served
+// by sync-catalog on /metrics. Metrics of the AWS side carry the ID of the
+// CloudMap namespace, the Consul side has an empty namespace.
+var (
+	metricCreated = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "registrations_created_total",
+		Help:      "Number of services and instances created on the destination side.",
+	}, []string{"direction", "namespace"})
+	metricUpdated = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "registrations_updated_total",
+		Help:      "Number of instances registered again on the destination side because they changed.",
+	}, []string{"direction", "namespace"})
+	metricRemoved = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "registrations_removed_total",
+		Help:      "Number of services and instances removed from the destination side.",
+	}, []string{"direction", "namespace"})
+	metricFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "registrations_failed_total",
+		Help:      "Number of create, update, remove and health operations that failed on the destination side.",
+	}, []string{"direction", "namespace", "operation"})
+	metricRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsCloudMap,
+		Name:      "retries_total",
+		Help:      "Number of retried AWS mutations by result, success or failure.",
+	}, []string{"namespace", "operation", "result"})
+	metricRetryQueue = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsCloudMap,
+		Name:      "retry_queue_length",
+		Help:      "Number of failed AWS mutations waiting to be retried.",
+	}, []string{"namespace"})
+	metricThrottled = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsCloudMap,
+		Name:      "throttled_requests_total",
+		Help:      "Number of AWS requests rejected by the CloudMap rate limits.",
+	})
+	metricOperations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsCloudMap,
+		Name:      "operations_total",
+		Help:      "Number of completed asynchronous CloudMap operations by action and status, success, fail or timeout.",
+	}, []string{"namespace", "action", "status"})
+	metricPendingOperations = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsCloudMap,
+		Name:      "pending_operations",
+		Help:      "Number of asynchronous CloudMap operations being tracked.",
+	}, []string{"namespace"})
+	metricRemovalsBlocked = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "removals_blocked",
+		Help:      "Number of removals refused by the last sync run for being over the limits.",
+	}, []string{"direction", "namespace"})
+	metricTombstones = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "tombstones",
+		Help:      "Number of synced instances missing from their source that wait for the grace period to be removed.",
+	}, []string{"direction", "namespace"})
+	metricLastSync = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "last_successful_sync_timestamp_seconds",
+		Help:      "Unix time of the last sync run without failed operations or refused removals.",
+	}, []string{"direction", "namespace"})
+
+	metricServices = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "services",
+		Help:      "Number of services known from the last successful fetch.",
+	}, []string{"side", "namespace"})
+	metricInstances = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "instances",
+		Help:      "Number of service instances known from the last successful fetch.",
+	}, []string{"side", "namespace"})
+	metricFetchDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "fetch_duration_seconds",
+		Help:      "Duration of fetches. Consul fetches include the time blocking queries wait for changes.",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 15, 30, 60},
+	}, []string{"side", "namespace"})
+	metricFetchErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "fetch_errors_total",
+		Help:      "Number of failed fetches.",
+	}, []string{"side", "namespace"})
+	metricLastFetch = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "last_successful_fetch_timestamp_seconds",
+		Help:      "Unix time of the last successful fetch.",
+	}, []string{"side", "namespace"})
+)
+
+// observeFetch records the outcome of a fetch that started at start and the
+// services it resulted in.
+func observeFetch(side, namespace string, start time.Time, services map[string]service, err error) {
+	metricFetchDuration.WithLabelValues(side, namespace).Observe(time.Since(start).Seconds())
+	if err != nil {
+		metricFetchErrors.WithLabelValues(side, namespace).Inc()
+		return
+	}
+	metricLastFetch.WithLabelValues(side, namespace).SetToCurrentTime()
+	metricServices.WithLabelValues(side, namespace).Set(float64(len(services)))
+	metricInstances.WithLabelValues(side, namespace).Set(float64(countInstances(services)))
+}
+
+func countInstances(services map[string]service) int {
+	count := 0
+	for _, s := range services {
+		for _, ports := range s.nodes {
+			count += len(ports)
+		}
+	}
+	return count
+}
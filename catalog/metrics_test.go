@@ -0,0 +1,44 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package catalog
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestObserveFetch(t *testing.T) {
+	services := map[string]service{
+		"web": {nodes: map[string]map[int]node{
+			"1.1.1.1": {80: {}, 8080: {}},
+			"2.2.2.2": {80: {}},
+		}},
+		"db": {nodes: map[string]map[int]node{"3.3.3.3": {5432: {}}}},
+	}
+	observeFetch(sideAWS, "ns-observe", time.Now(), services, nil)
+	require.Equal(t, 2.0, testutil.ToFloat64(metricServices.WithLabelValues(sideAWS, "ns-observe")))
+	require.Equal(t, 4.0, testutil.ToFloat64(metricInstances.WithLabelValues(sideAWS, "ns-observe")))
+	require.NotZero(t, testutil.ToFloat64(metricLastFetch.WithLabelValues(sideAWS, "ns-observe")))
+
+	fetchErrors := testutil.ToFloat64(metricFetchErrors.WithLabelValues(sideAWS, "ns-observe"))
+	observeFetch(sideAWS, "ns-observe", time.Now(), nil, fmt.Errorf("boom"))
+	require.Equal(t, fetchErrors+1, testutil.ToFloat64(metricFetchErrors.WithLabelValues(sideAWS, "ns-observe")))
+	require.Equal(t, 2.0, testutil.ToFloat64(metricServices.WithLabelValues(sideAWS, "ns-observe")))
+}
+
+func TestMetricNames_CloudMap(t *testing.T) {
+	metricRetries.WithLabelValues("ns-names", "register", "success")
+	metricRetryQueue.WithLabelValues("ns-names")
+	metricOperations.WithLabelValues("ns-names", "register", "success")
+	metricPendingOperations.WithLabelValues("ns-names")
+	require.NotZero(t, testutil.CollectAndCount(metricRetries, "consul_aws_cloudmap_retries_total"))
+	require.NotZero(t, testutil.CollectAndCount(metricRetryQueue, "consul_aws_cloudmap_retry_queue_length"))
+	require.Equal(t, 1, testutil.CollectAndCount(metricThrottled, "consul_aws_cloudmap_throttled_requests_total"))
+	require.NotZero(t, testutil.CollectAndCount(metricOperations, "consul_aws_cloudmap_operations_total"))
+	require.NotZero(t, testutil.CollectAndCount(metricPendingOperations, "consul_aws_cloudmap_pending_operations"))
+}
@@ -0,0 +1,48 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package catalog
+
+// Summary is the outcome of syncing one direction with one namespace once.
+type Summary struct {
+	Direction string
+	Namespace string
+	Created   int64
+	Updated   int64
+	Removed   int64
+	Failed    int64
+	// Blocked is the number of removals refused by the RemovalGuard.
+	Blocked int64
+}
+
+// SyncOnce fetches Consul and AWS once, syncs every enabled direction and
+// returns the outcome.
+func SyncOnce(config Config, awsClient CloudMapClient, consulClient ConsulClient) ([]Summary, error) {
+	config.RemovalGracePeriod = 0
+	s, err := newSyncer(config, awsClient, consulClient)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.fetch(); err != nil {
+		return nil, err
+	}
+	runs := s.run(config.DryRun)
+	s.waitForOperations()
+	return summaries(runs), nil
+}
+
+func summaries(runs []*syncRun) []Summary {
+	result := make([]Summary, 0, len(runs))
+	for _, run := range runs {
+		result = append(result, Summary{
+			Direction: run.direction,
+			Namespace: run.namespace,
+			Created:   run.created.Load(),
+			Updated:   run.updated.Load(),
+			Removed:   run.removed.Load(),
+			Failed:    run.failed.Load(),
+			Blocked:   run.blocked.Load(),
+		})
+	}
+	return result
+}
@@ -0,0 +1,136 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package catalog
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	awssd "github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyncOnce_Fake(t *testing.T) {
+	cloudMap, awsClient := newFakeCloudMap(t)
+	consul, consulClient := newFakeConsul(t)
+	config := Config{
+		ToAWS:        true,
+		ToConsul:     true,
+		Namespaces:   []NamespaceConfig{{ID: fakeNamespaceID}},
+		ConsulPrefix: "consul_",
+		AWSPrefix:    "aws_",
+	}
+
+	consul.registerService(&api.AgentService{ID: "web1", Service: "web", Address: "10.0.0.1", Port: 80}, "passing")
+	consul.registerService(&api.AgentService{ID: "web2", Service: "web", Address: "10.0.0.2", Port: 80}, "critical")
+	awsID := cloudMap.createService("api", nil, "10.1.0.1:8080")
+	cloudMap.setHealth("api", "api-0", "HEALTHY")
+
+	summaries, err := SyncOnce(config, awsClient, consulClient)
+	require.NoError(t, err)
+	require.Equal(t, []Summary{
+		{Direction: directionToAWS, Namespace: fakeNamespaceID, Created: 3},
+		{Direction: directionToConsul, Namespace: fakeNamespaceID, Created: 1},
+	}, summaries)
+
+	instances := cloudMap.instances("consul_web")
+	require.Len(t, instances, 2)
+	for _, attributes := range instances {
+		require.Contains(t, []string{"web1", "web2"}, attributes[AWSConsulID])
+		require.Equal(t, "80", attributes["AWS_INSTANCE_PORT"])
+	}
+	imported := consul.serviceInstances("aws_api")
+	require.Len(t, imported, 1)
+	for id, s := range imported {
+		require.Equal(t, string(passing), consul.checkStatus(id))
+		require.Equal(t, "10.1.0.1", s.Address)
+		require.Equal(t, 8080, s.Port)
+		require.Equal(t, ConsulAWSTag, s.Meta[ConsulSourceKey])
+		require.Equal(t, fakeNamespaceID, s.Meta[ConsulAWSNS])
+		require.Equal(t, "api-0", s.Meta[ConsulAWSID])
+	}
+	for id, attributes := range instances {
+		expected := "HEALTHY"
+		if attributes[AWSConsulID] == "web2" {
+			expected = "UNHEALTHY"
+		}
+		require.Equal(t, expected, cloudMap.health("consul_web", id))
+	}
+
+	summaries, err = SyncOnce(config, awsClient, consulClient)
+	require.NoError(t, err)
+	require.Equal(t, []Summary{
+		{Direction: directionToAWS, Namespace: fakeNamespaceID},
+		{Direction: directionToConsul, Namespace: fakeNamespaceID},
+	}, summaries)
+
+	cloudMap.deleteService(awsID)
+	summaries, err = SyncOnce(config, awsClient, consulClient)
+	require.NoError(t, err)
+	require.Equal(t, []Summary{
+		{Direction: directionToAWS, Namespace: fakeNamespaceID},
+		{Direction: directionToConsul, Namespace: fakeNamespaceID, Removed: 1},
+	}, summaries)
+	require.Empty(t, consul.serviceInstances("aws_api"))
+}
+
+// failingCloudMap fails to register instances.
+type failingCloudMap struct {
+	CloudMapClient
+}
+
+func (failingCloudMap) RegisterInstance(context.Context, *awssd.RegisterInstanceInput, ...func(*awssd.Options)) (*awssd.RegisterInstanceOutput, error) {
+	return nil, errors.New("injected failure")
+}
+
+// failingConsul fails to register services.
+type failingConsul struct {
+	ConsulClient
+}
+
+func (c failingConsul) Catalog() ConsulCatalog {
+	return failingConsulCatalog{c.ConsulClient.Catalog()}
+}
+
+type failingConsulCatalog struct {
+	ConsulCatalog
+}
+
+func (failingConsulCatalog) Register(*api.CatalogRegistration, *api.WriteOptions) (*api.WriteMeta, error) {
+	return nil, errors.New("injected failure")
+}
+
+func TestSyncOnce_Failures(t *testing.T) {
+	cloudMap, awsClient := newFakeCloudMap(t)
+	consul, consulClient := newFakeConsul(t)
+	config := Config{
+		ToAWS:        true,
+		ToConsul:     true,
+		Namespaces:   []NamespaceConfig{{ID: fakeNamespaceID}},
+		ConsulPrefix: "consul_",
+		AWSPrefix:    "aws_",
+	}
+
+	consul.registerService(&api.AgentService{ID: "web1", Service: "web", Address: "10.0.0.1", Port: 80}, "")
+	cloudMap.createService("api", nil, "10.1.0.1:8080")
+
+	summaries, err := SyncOnce(config, failingCloudMap{awsClient}, failingConsul{consulClient})
+	require.NoError(t, err)
+	require.Equal(t, []Summary{
+		{Direction: directionToAWS, Namespace: fakeNamespaceID, Created: 1, Failed: 1},
+		{Direction: directionToConsul, Namespace: fakeNamespaceID, Failed: 1},
+	}, summaries)
+	require.Empty(t, cloudMap.instances("consul_web"))
+	require.Empty(t, consul.serviceInstances("aws_api"))
+
+	// Everything is retried by the next sync.
+	summaries, err = SyncOnce(config, awsClient, consulClient)
+	require.NoError(t, err)
+	require.Equal(t, []Summary{
+		{Direction: directionToAWS, Namespace: fakeNamespaceID, Created: 1},
+		{Direction: directionToConsul, Namespace: fakeNamespaceID, Created: 1},
+	}, summaries)
+}
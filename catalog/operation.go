@@ -0,0 +1,208 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package catalog
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awssd "github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+	awssdtypes "github.com/aws/aws-sdk-go-v2/service/servicediscovery/types"
+)
+
+const (
+	operationResultSuccess = "success"
+	operationResultFail    = "fail"
+	operationResultTimeout = "timeout"
+)
+
+// operationTracker follows the asynchronous operations CloudMap returns for
+// registering and deregistering instances until they complete. Instances
+// with a tracked operation are left alone by the sync, so the same change
+// isn't made again while AWS is still working on it.
+type operationTracker struct {
+	lock       sync.Mutex
+	operations map[string]*pendingOperation
+}
+
+type pendingOperation struct {
+	mutation
+	id      string
+	run     *syncRun
+	started time.Time
+	// completed is set once the operation succeeded. The operation is
+	// still tracked until a fetch started after it completed, since
+	// fetches before that don't show its outcome.
+	completed time.Time
+}
+
+func newOperationTracker() *operationTracker {
+	return &operationTracker{operations: map[string]*pendingOperation{}}
+}
+
+func operationKey(serviceID, instanceID string) string {
+	return serviceID + "/" + instanceID
+}
+
+// track starts following the operation made by the mutation. Failures of
+// the operation are counted in run.
+func (t *operationTracker) track(m mutation, id *string, run *syncRun, now time.Time) {
+	if id == nil {
+		return
+	}
+	t.lock.Lock()
+	t.operations[operationKey(m.serviceID, m.instanceID)] = &pendingOperation{
+		mutation: m,
+		id:       *id,
+		run:      run,
+		started:  now,
+	}
+	t.lock.Unlock()
+}
+
+// pending returns true if an operation on the instance is tracked.
+func (t *operationTracker) pending(serviceID, instanceID string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	_, ok := t.operations[operationKey(serviceID, instanceID)]
+	return ok
+}
+
+// pendingService returns true if an operation on any instance of the
+// service is tracked.
+func (t *operationTracker) pendingService(serviceID string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, o := range t.operations {
+		if o.serviceID == serviceID {
+			return true
+		}
+	}
+	return false
+}
+
+// incomplete returns the operations that haven't completed yet.
+func (t *operationTracker) incomplete() []*pendingOperation {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	result := []*pendingOperation{}
+	for _, o := range t.operations {
+		if o.completed.IsZero() {
+			result = append(result, o)
+		}
+	}
+	return result
+}
+
+// complete records that the operation succeeded.
+func (t *operationTracker) complete(o *pendingOperation, now time.Time) {
+	t.lock.Lock()
+	if t.operations[operationKey(o.serviceID, o.instanceID)] == o {
+		o.completed = now
+	}
+	t.lock.Unlock()
+}
+
+// forget stops tracking the operation, unless the instance has a newer
+// operation meanwhile.
+func (t *operationTracker) forget(o *pendingOperation) {
+	t.lock.Lock()
+	key := operationKey(o.serviceID, o.instanceID)
+	if t.operations[key] == o {
+		delete(t.operations, key)
+	}
+	t.lock.Unlock()
+}
+
+// fetched stops tracking the operations that completed before a fetch
+// started at the given time, since that fetch shows their outcome.
+func (t *operationTracker) fetched(start time.Time) {
+	t.lock.Lock()
+	for k, o := range t.operations {
+		if !o.completed.IsZero() && o.completed.Before(start) {
+			delete(t.operations, k)
+		}
+	}
+	t.lock.Unlock()
+}
+
+func (t *operationTracker) len() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.operations)
+}
+
+// pollOperations checks the operations that haven't completed yet. Failed
+// operations are logged, counted as failed in the run that made them and
+// queued to be retried.
+func (a *awsSyncer) pollOperations(now time.Time) {
+	namespace := *a.namespace.Id
+	for _, o := range a.operations.incomplete() {
+		resp, err := a.client.GetOperation(context.TODO(), &awssd.GetOperationInput{OperationId: &o.id})
+		if err != nil {
+			var notFound *awssdtypes.OperationNotFound
+			if errors.As(err, &notFound) {
+				a.log.Warn("operation not found", "id", o.id, "action", o.action, "service", o.service, "instance", o.instanceID)
+				a.operations.forget(o)
+				continue
+			}
+			a.log.Debug("cannot get operation", "id", o.id, "error", err)
+			continue
+		}
+		switch resp.Operation.Status {
+		case awssdtypes.OperationStatusSuccess:
+			a.log.Trace("operation succeeded", "id", o.id, "action", o.action, "service", o.service, "instance", o.instanceID)
+			metricOperations.WithLabelValues(namespace, o.action, operationResultSuccess).Inc()
+			a.operations.complete(o, now)
+		case awssdtypes.OperationStatusFail:
+			a.log.Error("operation failed", "id", o.id, "action", o.action, "service", o.service, "instance", o.instanceID,
+				"error-code", aws.ToString(resp.Operation.ErrorCode), "error", aws.ToString(resp.Operation.ErrorMessage))
+			metricOperations.WithLabelValues(namespace, o.action, operationResultFail).Inc()
+			o.run.fail(o.operation)
+			a.operations.forget(o)
+			a.retries.add(o.mutation, now)
+		default:
+			if now.Sub(o.started) <= operationTimeout {
+				continue
+			}
+			a.log.Error("timed out waiting for operation", "id", o.id, "action", o.action, "service", o.service, "instance", o.instanceID)
+			metricOperations.WithLabelValues(namespace, o.action, operationResultTimeout).Inc()
+			o.run.fail(o.operation)
+			a.operations.forget(o)
+		}
+	}
+	metricPendingOperations.WithLabelValues(namespace).Set(float64(a.operations.len()))
+	metricRetryQueue.WithLabelValues(namespace).Set(float64(a.retries.len()))
+}
+
+// pollOperationsIndefinitely checks the pending operations every
+// operationPollInterval.
+func (a *awsSyncer) pollOperationsIndefinitely(stop, stopped chan struct{}) {
+	defer close(stopped)
+	ticker := time.NewTicker(operationPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			a.pollOperations(now)
+		}
+	}
+}
+
+// waitForOperations polls the pending operations until all of them
+// completed, failed or timed out.
+func (a *awsSyncer) waitForOperations() {
+	for {
+		a.pollOperations(time.Now())
+		if len(a.operations.incomplete()) == 0 {
+			return
+		}
+		time.Sleep(operationPollInterval)
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package catalog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/hashicorp/consul/api"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOperationTracker(t *testing.T) {
+	tracker := newOperationTracker()
+	now := time.Now()
+	m := mutation{action: ActionRegisterInstance, serviceID: "srv-1", instanceID: "i-1"}
+	tracker.track(m, nil, nil, now)
+	require.False(t, tracker.pending("srv-1", "i-1"))
+
+	tracker.track(m, aws.String("op-1"), nil, now)
+	require.True(t, tracker.pending("srv-1", "i-1"))
+	require.True(t, tracker.pendingService("srv-1"))
+	require.False(t, tracker.pending("srv-1", "i-2"))
+	require.False(t, tracker.pendingService("srv-2"))
+
+	// A completed operation is tracked until a later fetch.
+	o := tracker.incomplete()[0]
+	tracker.complete(o, now)
+	require.Empty(t, tracker.incomplete())
+	tracker.fetched(now.Add(-time.Second))
+	require.True(t, tracker.pending("srv-1", "i-1"))
+	tracker.fetched(now.Add(time.Second))
+	require.False(t, tracker.pending("srv-1", "i-1"))
+
+	// Forgetting an operation keeps a newer one of the instance.
+	tracker.track(m, aws.String("op-2"), nil, now)
+	o = tracker.incomplete()[0]
+	tracker.track(m, aws.String("op-3"), nil, now)
+	tracker.forget(o)
+	require.True(t, tracker.pending("srv-1", "i-1"))
+	tracker.forget(tracker.incomplete()[0])
+	require.Equal(t, 0, tracker.len())
+}
+
+func TestOperations_Failed(t *testing.T) {
+	cloudMap, awsClient := newFakeCloudMap(t)
+	consul, consulClient := newFakeConsul(t)
+	config := Config{
+		ToAWS:      true,
+		Namespaces: []NamespaceConfig{{ID: fakeNamespaceID}},
+	}
+	consul.registerService(&api.AgentService{ID: "web1", Service: "web", Address: "10.0.0.1", Port: 80}, "")
+	cloudMap.failRegistrations(1)
+	failed := testutil.ToFloat64(metricOperations.WithLabelValues(fakeNamespaceID, ActionRegisterInstance, operationResultFail))
+
+	s, err := newSyncer(config, awsClient, consulClient)
+	require.NoError(t, err)
+	require.NoError(t, s.fetch())
+	runs := s.run(false)
+	s.waitForOperations()
+	require.Equal(t, []Summary{{Direction: directionToAWS, Namespace: fakeNamespaceID, Created: 2, Failed: 1}}, summaries(runs))
+	require.Equal(t, failed+1, testutil.ToFloat64(metricOperations.WithLabelValues(fakeNamespaceID, ActionRegisterInstance, operationResultFail)))
+	require.Empty(t, cloudMap.instances("web"))
+
+	// The failed registration is retried.
+	aws := s.awsSyncers[0]
+	require.Equal(t, 1, aws.retries.len())
+	aws.retryDue(time.Now().Add(retryMaxDelay))
+	aws.waitForOperations()
+	require.Len(t, cloudMap.instances("web"), 1)
+}
+
+func TestOperations_Pending(t *testing.T) {
+	cloudMap, awsClient := newFakeCloudMap(t)
+	consul, consulClient := newFakeConsul(t)
+	config := Config{
+		ToAWS:      true,
+		Namespaces: []NamespaceConfig{{ID: fakeNamespaceID}},
+	}
+	consul.registerService(&api.AgentService{ID: "web1", Service: "web", Address: "10.0.0.1", Port: 80}, "")
+	cloudMap.holdOperations()
+
+	s, err := newSyncer(config, awsClient, consulClient)
+	require.NoError(t, err)
+	require.NoError(t, s.fetch())
+	require.Equal(t, []Summary{{Direction: directionToAWS, Namespace: fakeNamespaceID, Created: 2}}, summaries(s.run(false)))
+	operations := cloudMap.operationCount()
+
+	// Syncing again doesn't register the instance again while its
+	// registration is pending.
+	aws := s.awsSyncers[0]
+	aws.pollOperations(time.Now())
+	require.NoError(t, s.fetch())
+	require.Empty(t, cloudMap.instances("web"))
+	require.Equal(t, []Summary{{Direction: directionToAWS, Namespace: fakeNamespaceID}}, summaries(s.run(false)))
+	require.Equal(t, operations, cloudMap.operationCount())
+
+	// The instance is left alone until a fetch shows the outcome of the
+	// completed registration.
+	cloudMap.releaseOperations()
+	aws.pollOperations(time.Now())
+	require.Equal(t, 1, aws.operations.len())
+	require.NoError(t, s.fetch())
+	require.Equal(t, 0, aws.operations.len())
+	require.Equal(t, []Summary{{Direction: directionToAWS, Namespace: fakeNamespaceID}}, summaries(s.run(false)))
+	require.Equal(t, operations, cloudMap.operationCount())
+}
@@ -0,0 +1,194 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package catalog
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awssd "github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+	awssdtypes "github.com/aws/aws-sdk-go-v2/service/servicediscovery/types"
+)
+
+const (
+	// AWSOwnerTagKey is the resource tag marking the CloudMap services
+	// created by consul-aws, with AWSOwnerTagValue as value.
+	AWSOwnerTagKey   = "managed-by"
+	AWSOwnerTagValue = "consul-aws"
+	// AWSDeploymentTagKey is the resource tag holding the ID of the
+	// consul-aws deployment that created a CloudMap service.
+	AWSDeploymentTagKey = DeploymentKey
+	// DeploymentKey is the instance attribute and the Consul service meta
+	// key holding the ID of the consul-aws deployment that registered a
+	// CloudMap instance or a Consul service instance.
+	DeploymentKey = "consul-aws-deployment"
+	// DefaultDeploymentID identifies the deployment unless configured
+	// otherwise.
+	DefaultDeploymentID = "default"
+)
+
+// owner tells who created a CloudMap service.
+type owner int
+
+const (
+	// ownerNone is a service that was not created by consul-aws.
+	ownerNone owner = iota
+	// ownerSelf is a service created by this deployment.
+	ownerSelf
+	// ownerOther is a service created by another deployment.
+	ownerOther
+	// ownerLegacy is a service created by a version of consul-aws that
+	// only marked services with their description.
+	ownerLegacy
+)
+
+// ownerTags returns the resource tags marking a service as created by this
+// deployment.
+func (a *awsSyncer) ownerTags() []awssdtypes.Tag {
+	return []awssdtypes.Tag{
+		{Key: aws.String(AWSOwnerTagKey), Value: aws.String(AWSOwnerTagValue)},
+		{Key: aws.String(AWSDeploymentTagKey), Value: aws.String(a.deploymentID)},
+	}
+}
+
+// ownerFromTags returns who created a service with the given tags.
+func ownerFromTags(tags map[string]string, deploymentID string) owner {
+	if tags[AWSOwnerTagKey] != AWSOwnerTagValue {
+		return ownerNone
+	}
+	if tags[AWSDeploymentTagKey] != deploymentID {
+		return ownerOther
+	}
+	return ownerSelf
+}
+
+// owner returns who created the service. The owner is looked up in the
+// resource tags of the service once and cached, since consul-aws is the
+// only one changing the owner tags.
+func (a *awsSyncer) owner(as awssdtypes.ServiceSummary) (owner, error) {
+	id := aws.ToString(as.Id)
+	a.ownersLock.Lock()
+	o, ok := a.owners[id]
+	a.ownersLock.Unlock()
+	if ok {
+		return o, nil
+	}
+
+	tags, err := a.fetchTags(aws.ToString(as.Arn))
+	if err != nil {
+		return ownerNone, err
+	}
+	o = ownerFromTags(tags, a.deploymentID)
+	if o == ownerNone && aws.ToString(as.Description) == awsServiceDescription {
+		o = ownerLegacy
+		if !a.adopt {
+			a.log.Warn("service created by an older version of consul-aws is left alone, use -aws-adopt-services to manage it",
+				"name", aws.ToString(as.Name), "id", id)
+		}
+	}
+	a.setOwner(id, o)
+	return o, nil
+}
+
+func (a *awsSyncer) setOwner(id string, o owner) {
+	a.ownersLock.Lock()
+	if a.owners == nil {
+		a.owners = map[string]owner{}
+	}
+	a.owners[id] = o
+	a.ownersLock.Unlock()
+}
+
+// resolveOwners returns the services to sync and their owners by service
+// ID. Services created by older versions of consul-aws are adopted by
+// tagging them if configured, and kept as ownerLegacy otherwise, so they
+// are known to exist but left alone.
+func (a *awsSyncer) resolveOwners(awsServices []awssdtypes.ServiceSummary) ([]awssdtypes.ServiceSummary, map[string]owner, error) {
+	result := []awssdtypes.ServiceSummary{}
+	owners := map[string]owner{}
+	listed := map[string]bool{}
+	for _, as := range awsServices {
+		listed[aws.ToString(as.Id)] = true
+		o, err := a.owner(as)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error fetching tags of %s: %s", aws.ToString(as.Name), err)
+		}
+		if o == ownerLegacy && a.adopt {
+			if err := a.adoptService(as); err != nil {
+				a.log.Error("cannot adopt service", "name", aws.ToString(as.Name), "error", err)
+			} else {
+				o = ownerSelf
+			}
+		}
+		owners[aws.ToString(as.Id)] = o
+		result = append(result, as)
+	}
+
+	// Deleted services are dropped from the cache.
+	a.ownersLock.Lock()
+	for id := range a.owners {
+		if !listed[id] {
+			delete(a.owners, id)
+		}
+	}
+	a.ownersLock.Unlock()
+	return result, owners, nil
+}
+
+// ownInstances drops the instances registered by other deployments from
+// the instances of a service created by consul-aws. Instances without a
+// deployment belong to the owner of the service, since they were
+// registered by an older version of consul-aws. It returns false if any
+// instance was dropped.
+func (a *awsSyncer) ownInstances(instances []awssdtypes.InstanceSummary, o owner) ([]awssdtypes.InstanceSummary, bool) {
+	result := []awssdtypes.InstanceSummary{}
+	for _, i := range instances {
+		deployment, ok := i.Attributes[DeploymentKey]
+		if deployment == a.deploymentID || (!ok && o == ownerSelf) {
+			result = append(result, i)
+		}
+	}
+	return result, len(result) == len(instances)
+}
+
+// adoptService tags a service created by an older version of consul-aws as
+// owned by this deployment. In a dry run the service is only treated as
+// owned, which is cached like the owner of a tagged service so the
+// adoption is logged once.
+func (a *awsSyncer) adoptService(as awssdtypes.ServiceSummary) error {
+	if a.dryRun {
+		a.log.Info("dry-run", "action", "adopt-service", "service", aws.ToString(as.Name))
+		a.setOwner(aws.ToString(as.Id), ownerSelf)
+		a.ownersLock.Lock()
+		a.dryAdopted = append(a.dryAdopted, as)
+		a.ownersLock.Unlock()
+		return nil
+	}
+	_, err := a.client.TagResource(context.TODO(), &awssd.TagResourceInput{
+		ResourceARN: as.Arn,
+		Tags:        a.ownerTags(),
+	})
+	if err != nil {
+		return err
+	}
+	a.log.Info("adopted service", "name", aws.ToString(as.Name), "id", aws.ToString(as.Id))
+	a.setOwner(aws.ToString(as.Id), ownerSelf)
+	return nil
+}
+
+// adoptDryRun leaves the dry run and tags the services adopted in it.
+func (a *awsSyncer) adoptDryRun() error {
+	a.dryRun = false
+	a.ownersLock.Lock()
+	adopted := a.dryAdopted
+	a.dryAdopted = nil
+	a.ownersLock.Unlock()
+	for _, as := range adopted {
+		if err := a.adoptService(as); err != nil {
+			return fmt.Errorf("cannot adopt service %s: %s", aws.ToString(as.Name), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package catalog
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOwnerFromTags(t *testing.T) {
+	require.Equal(t, ownerNone, ownerFromTags(map[string]string{}, "blue"))
+	require.Equal(t, ownerNone, ownerFromTags(map[string]string{AWSDeploymentTagKey: "blue"}, "blue"))
+	require.Equal(t, ownerSelf, ownerFromTags(map[string]string{AWSOwnerTagKey: AWSOwnerTagValue, AWSDeploymentTagKey: "blue"}, "blue"))
+	require.Equal(t, ownerOther, ownerFromTags(map[string]string{AWSOwnerTagKey: AWSOwnerTagValue, AWSDeploymentTagKey: "green"}, "blue"))
+	require.Equal(t, ownerOther, ownerFromTags(map[string]string{AWSOwnerTagKey: AWSOwnerTagValue}, "blue"))
+}
+
+func TestOwner_Fake(t *testing.T) {
+	cloudMap, awsClient := newFakeCloudMap(t)
+	consul, consulClient := newFakeConsul(t)
+	config := Config{
+		ToAWS:        true,
+		ToConsul:     true,
+		Namespaces:   []NamespaceConfig{{ID: fakeNamespaceID}},
+		AWSPrefix:    "aws_",
+		DeploymentID: "blue",
+	}
+	consul.registerService(&api.AgentService{ID: "web1", Service: "web", Address: "10.0.0.1", Port: 80}, "")
+	consul.registerService(&api.AgentService{ID: "db1", Service: "db", Address: "10.0.0.2", Port: 5432}, "")
+	legacyID := cloudMap.createService("web", nil, "10.0.0.1:80")
+	cloudMap.describeService(legacyID, awsServiceDescription)
+	cloudMap.createService("api", map[string]string{AWSOwnerTagKey: AWSOwnerTagValue, AWSDeploymentTagKey: "green"}, "10.1.0.1:8080")
+
+	// Services of older versions are left alone: neither managed nor
+	// imported into Consul.
+	summaries, err := SyncOnce(config, awsClient, consulClient)
+	require.NoError(t, err)
+	require.Equal(t, []Summary{
+		{Direction: directionToAWS, Namespace: fakeNamespaceID, Created: 2},
+		{Direction: directionToConsul, Namespace: fakeNamespaceID},
+	}, summaries)
+	require.Equal(t, map[string]string{AWSOwnerTagKey: AWSOwnerTagValue, AWSDeploymentTagKey: "blue"}, cloudMap.tags("db"))
+	require.Empty(t, cloudMap.tags("web"))
+	require.Len(t, cloudMap.instances("web"), 1)
+
+	// They are not created again either, so later runs are clean.
+	summaries, err = SyncOnce(config, awsClient, consulClient)
+	require.NoError(t, err)
+	require.Equal(t, []Summary{
+		{Direction: directionToAWS, Namespace: fakeNamespaceID},
+		{Direction: directionToConsul, Namespace: fakeNamespaceID},
+	}, summaries)
+	require.Empty(t, consul.serviceInstances("aws_web"))
+	// Services of other deployments come from Consul and are not imported.
+	require.Empty(t, consul.serviceInstances("aws_api"))
+
+	// They are purged all the same, as legacy services.
+	owned, err := ListOwned(config, awsClient, consulClient)
+	require.NoError(t, err)
+	require.Len(t, owned, 2)
+	require.Equal(t, "db", owned[0].Name)
+	require.False(t, owned[0].Legacy)
+	require.Equal(t, "web", owned[1].Name)
+	require.True(t, owned[1].Legacy)
+
+	// Adopted services are tagged and managed, their instances are
+	// registered again with the attributes of consul-aws.
+	config.AWSAdoptServices = true
+	summaries, err = SyncOnce(config, awsClient, consulClient)
+	require.NoError(t, err)
+	require.Equal(t, []Summary{
+		{Direction: directionToAWS, Namespace: fakeNamespaceID, Updated: 1},
+		{Direction: directionToConsul, Namespace: fakeNamespaceID},
+	}, summaries)
+	require.Equal(t, map[string]string{AWSOwnerTagKey: AWSOwnerTagValue, AWSDeploymentTagKey: "blue"}, cloudMap.tags("web"))
+
+	config.AWSAdoptServices = false
+	owned, err = ListOwned(config, awsClient, consulClient)
+	require.NoError(t, err)
+	require.Len(t, owned, 2)
+	require.Equal(t, "db", owned[0].Name)
+	require.Equal(t, "web", owned[1].Name)
+	require.False(t, owned[1].Legacy)
+}
+
+func TestOwner_DryRunAdopt(t *testing.T) {
+	cloudMap, awsClient := newFakeCloudMap(t)
+	_, consulClient := newFakeConsul(t)
+	config := Config{
+		ToAWS:            true,
+		Namespaces:       []NamespaceConfig{{ID: fakeNamespaceID}},
+		DryRun:           true,
+		AWSAdoptServices: true,
+	}
+	legacyID := cloudMap.createService("web", nil, "10.0.0.1:80")
+	cloudMap.describeService(legacyID, awsServiceDescription)
+
+	s, err := newSyncer(config, awsClient, consulClient)
+	require.NoError(t, err)
+	aws := s.awsSyncers[0]
+	var out bytes.Buffer
+	aws.log = hclog.New(&hclog.LoggerOptions{Output: &out})
+	for i := 0; i < 3; i++ {
+		require.NoError(t, aws.fetch())
+	}
+
+	// The service is treated as adopted without being tagged, and the
+	// adoption is only logged once.
+	require.Equal(t, 1, strings.Count(out.String(), "adopt-service"))
+	require.Contains(t, aws.getServices(), "web")
+	require.Empty(t, cloudMap.tags("web"))
+}
+
+func TestDeployments_Fake(t *testing.T) {
+	cloudMap, awsClient := newFakeCloudMap(t)
+	consulA, consulClientA := newFakeConsul(t)
+	consulB, consulClientB := newFakeConsul(t)
+	config := Config{
+		ToAWS:      true,
+		ToConsul:   true,
+		Namespaces: []NamespaceConfig{{ID: fakeNamespaceID}},
+		AWSPrefix:  "aws_",
+	}
+	configA, configB := config, config
+	configA.DeploymentID = "a"
+	configB.DeploymentID = "b"
+	consulA.registerService(&api.AgentService{ID: "web-a", Service: "web", Address: "10.0.0.1", Port: 80}, "")
+	consulB.registerService(&api.AgentService{ID: "web-b", Service: "web", Address: "10.0.1.1", Port: 80}, "")
+
+	summaries, err := SyncOnce(configA, awsClient, consulClientA)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), summaries[0].Created)
+
+	// The second deployment registers its instances in the service of
+	// the first one.
+	summaries, err = SyncOnce(configB, awsClient, consulClientB)
+	require.NoError(t, err)
+	require.Equal(t, []Summary{
+		{Direction: directionToAWS, Namespace: fakeNamespaceID, Created: 1},
+		{Direction: directionToConsul, Namespace: fakeNamespaceID},
+	}, summaries)
+	require.Equal(t, "a", cloudMap.tags("web")[AWSDeploymentTagKey])
+	deployments := []string{}
+	for _, attributes := range cloudMap.instances("web") {
+		deployments = append(deployments, attributes[DeploymentKey])
+	}
+	require.ElementsMatch(t, []string{"a", "b"}, deployments)
+	require.Empty(t, consulB.serviceInstances("aws_web"))
+
+	// Neither deployment removes the instances of the other.
+	for _, c := range []struct {
+		config Config
+		client ConsulClient
+	}{{configA, consulClientA}, {configB, consulClientB}} {
+		summaries, err = SyncOnce(c.config, awsClient, c.client)
+		require.NoError(t, err)
+		require.Equal(t, []Summary{
+			{Direction: directionToAWS, Namespace: fakeNamespaceID},
+			{Direction: directionToConsul, Namespace: fakeNamespaceID},
+		}, summaries)
+	}
+
+	// The service is only deleted by its owner, once the instances of the
+	// other deployment are gone.
+	consulA.deregister(&api.CatalogDeregistration{ServiceID: "web-a"})
+	summaries, err = SyncOnce(configA, awsClient, consulClientA)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), summaries[0].Removed)
+	summaries, err = SyncOnce(configA, awsClient, consulClientA)
+	require.NoError(t, err)
+	require.Zero(t, summaries[0].Removed)
+	require.Len(t, cloudMap.instances("web"), 1)
+
+	consulB.deregister(&api.CatalogDeregistration{ServiceID: "web-b"})
+	summaries, err = SyncOnce(configB, awsClient, consulClientB)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), summaries[0].Removed)
+	require.Empty(t, cloudMap.instances("web"))
+	summaries, err = SyncOnce(configA, awsClient, consulClientA)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), summaries[0].Removed)
+	require.Nil(t, cloudMap.instances("web"))
+}
+
+func TestConsulOwns(t *testing.T) {
+	legacy := map[string]string{ConsulSourceKey: ConsulAWSTag}
+	c := &consul{deploymentID: "a"}
+	require.True(t, c.owns(map[string]string{DeploymentKey: "a"}))
+	require.False(t, c.owns(map[string]string{DeploymentKey: "b"}))
+	require.False(t, c.owns(legacy))
+	c.adopt = true
+	require.True(t, c.owns(legacy))
+	require.False(t, c.owns(map[string]string{}))
+	require.False(t, c.owns(map[string]string{DeploymentKey: "b"}))
+
+	// Older versions only had the default deployment.
+	c = &consul{deploymentID: DefaultDeploymentID}
+	require.True(t, c.owns(legacy))
+	require.False(t, c.owns(map[string]string{}))
+}
+
+// TestOwner_LegacyImport syncs a Consul registration imported by an older
+// version, without a deployment, which is re-keyed instead of registered a
+// second time.
+func TestOwner_LegacyImport(t *testing.T) {
+	cloudMap, awsClient := newFakeCloudMap(t)
+	consul, consulClient := newFakeConsul(t)
+	config := Config{
+		ToConsul:   true,
+		Namespaces: []NamespaceConfig{{ID: fakeNamespaceID}},
+		AWSPrefix:  "aws_",
+	}
+	cloudMap.createService("api", nil, "10.1.0.1:8080")
+	consul.register(&api.CatalogRegistration{
+		Node:    ConsulAWSNodeName,
+		Address: "10.1.0.1",
+		Service: &api.AgentService{
+			ID:      "api_10.1.0.1_8080",
+			Service: "aws_api",
+			Tags:    []string{ConsulAWSTag},
+			Address: "10.1.0.1",
+			Port:    8080,
+			Meta:    map[string]string{ConsulSourceKey: ConsulAWSTag, ConsulAWSNS: fakeNamespaceID, ConsulAWSID: "api-0"},
+		},
+	})
+
+	for i := 0; i < 2; i++ {
+		_, err := SyncOnce(config, awsClient, consulClient)
+		require.NoError(t, err)
+	}
+	services := consul.serviceInstances("aws_api")
+	require.Len(t, services, 1)
+	require.Contains(t, services, "api_10.1.0.1_8080_"+fakeNamespaceID+"_"+DefaultDeploymentID)
+}
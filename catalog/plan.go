@@ -0,0 +1,99 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package catalog
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+)
+
+// ErrDrift is returned by Apply when the changes needed to sync differ from
+// the changes of the plan.
+var ErrDrift = errors.New("consul or aws changed since the plan was made")
+
+// Plan fetches Consul and AWS once and returns the changes a sync would
+// make, sorted by direction, namespace, service and instance. Nothing is
+// changed, namespaces that don't exist are not created.
+func Plan(config Config, awsClient CloudMapClient, consulClient ConsulClient) ([]Change, error) {
+	config.DryRun = true
+	config.RemovalGracePeriod = 0
+	s, err := newSyncer(config, awsClient, consulClient)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.fetch(); err != nil {
+		return nil, err
+	}
+	return changes(s.run(true)), nil
+}
+
+// Apply fetches Consul and AWS once and makes the changes of the plan. It
+// returns ErrDrift without changing anything if the changes needed to sync
+// are not exactly the changes of the plan. Like Plan, it neither creates
+// namespaces nor adopts services before the plan is confirmed.
+func Apply(config Config, awsClient CloudMapClient, consulClient ConsulClient, plan []Change) ([]Summary, error) {
+	config.DryRun = true
+	config.RemovalGracePeriod = 0
+	s, err := newSyncer(config, awsClient, consulClient)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.fetch(); err != nil {
+		return nil, err
+	}
+	if !sameChanges(changes(s.run(true)), plan) {
+		return nil, ErrDrift
+	}
+	s.consul.dryRun = false
+	for _, aws := range s.awsSyncers {
+		if err := aws.adoptDryRun(); err != nil {
+			return nil, err
+		}
+	}
+	runs := s.run(false)
+	s.waitForOperations()
+	return summaries(runs), nil
+}
+
+func changes(runs []*syncRun) []Change {
+	result := []Change{}
+	for _, run := range runs {
+		result = append(result, run.getChanges()...)
+	}
+	sortChanges(result)
+	return result
+}
+
+func sortChanges(changes []Change) {
+	sort.Slice(changes, func(i, j int) bool {
+		a, b := changes[i], changes[j]
+		if a.Direction != b.Direction {
+			return a.Direction < b.Direction
+		}
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		if a.Service != b.Service {
+			return a.Service < b.Service
+		}
+		if a.Instance != b.Instance {
+			return a.Instance < b.Instance
+		}
+		return a.String() < b.String()
+	})
+}
+
+// sameChanges returns true if a and b contain the same changes in any
+// order.
+func sameChanges(a, b []Change) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]Change{}, a...)
+	b = append([]Change{}, b...)
+	sortChanges(a)
+	sortChanges(b)
+	return reflect.DeepEqual(a, b)
+}
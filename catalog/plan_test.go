@@ -0,0 +1,158 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package catalog
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSameChanges(t *testing.T) {
+	a := []Change{
+		{Direction: directionToAWS, Action: ActionCreateService, Service: "web"},
+		{Direction: directionToConsul, Action: ActionRegisterInstance, Service: "db", Instance: "db_1.1.1.1_80"},
+	}
+	b := []Change{a[1], a[0]}
+	require.True(t, sameChanges(a, b))
+	require.True(t, sameChanges(nil, []Change{}))
+
+	b[0].Health = "passing"
+	require.False(t, sameChanges(a, b))
+	require.False(t, sameChanges(a, a[:1]))
+
+	b = []Change{a[0], a[1]}
+	b[1].Attributes = map[string]string{"version": "2"}
+	require.False(t, sameChanges(a, b))
+}
+
+func TestPlanApply_Fake(t *testing.T) {
+	cloudMap, awsClient := newFakeCloudMap(t)
+	consul, consulClient := newFakeConsul(t)
+	config := Config{
+		ToAWS:        true,
+		Namespaces:   []NamespaceConfig{{ID: fakeNamespaceID}},
+		ConsulPrefix: "consul_",
+	}
+
+	consul.registerService(&api.AgentService{ID: "web1", Service: "web", Address: "10.0.0.1", Port: 80}, "")
+	plan, err := Plan(config, awsClient, consulClient)
+	require.NoError(t, err)
+	require.Equal(t, []Change{
+		{Direction: directionToAWS, Namespace: fakeNamespaceID, Action: ActionCreateService, Service: "consul_web"},
+		{Direction: directionToAWS, Namespace: fakeNamespaceID, Action: ActionRegisterInstance, Service: "consul_web", Instance: "10.0.0.1_80_default", Address: "10.0.0.1", Port: 80, Attributes: map[string]string{
+			"AWS_INSTANCE_IPV4": "10.0.0.1",
+			"AWS_INSTANCE_PORT": "80",
+			AWSConsulID:         "web1",
+			DeploymentKey:       DefaultDeploymentID,
+		}},
+	}, plan)
+	require.Nil(t, cloudMap.instances("consul_web"))
+
+	consul.registerService(&api.AgentService{ID: "web2", Service: "web", Address: "10.0.0.2", Port: 80}, "")
+	_, err = Apply(config, awsClient, consulClient, plan)
+	require.ErrorIs(t, err, ErrDrift)
+	require.Nil(t, cloudMap.instances("consul_web"))
+
+	plan, err = Plan(config, awsClient, consulClient)
+	require.NoError(t, err)
+	summaries, err := Apply(config, awsClient, consulClient, plan)
+	require.NoError(t, err)
+	require.Equal(t, []Summary{{Direction: directionToAWS, Namespace: fakeNamespaceID, Created: 3}}, summaries)
+	require.Len(t, cloudMap.instances("consul_web"), 2)
+}
+
+// TestPlanApply_MetaDrift checks that a change to the meta of a Consul
+// instance alone is drift, since it changes the attributes written to AWS.
+func TestPlanApply_MetaDrift(t *testing.T) {
+	cloudMap, awsClient := newFakeCloudMap(t)
+	consul, consulClient := newFakeConsul(t)
+	config := Config{
+		ToAWS:        true,
+		Namespaces:   []NamespaceConfig{{ID: fakeNamespaceID}},
+		ConsulPrefix: "consul_",
+	}
+
+	consul.registerService(&api.AgentService{ID: "web1", Service: "web", Address: "10.0.0.1", Port: 80, Meta: map[string]string{"version": "1"}}, "")
+	plan, err := Plan(config, awsClient, consulClient)
+	require.NoError(t, err)
+
+	consul.registerService(&api.AgentService{ID: "web1", Service: "web", Address: "10.0.0.1", Port: 80, Meta: map[string]string{"version": "2"}}, "")
+	_, err = Apply(config, awsClient, consulClient, plan)
+	require.ErrorIs(t, err, ErrDrift)
+	require.Nil(t, cloudMap.instances("consul_web"))
+}
+
+func TestPlanApply_RemovalGuard(t *testing.T) {
+	cloudMap, awsClient := newFakeCloudMap(t)
+	consul, consulClient := newFakeConsul(t)
+	config := Config{
+		ToConsul:     true,
+		Namespaces:   []NamespaceConfig{{ID: fakeNamespaceID}},
+		RemovalGuard: NewRemovalGuard(1, 0, 1),
+	}
+	awsID := cloudMap.createService("api", nil, "10.1.0.1:8080", "10.1.0.2:8080")
+	_, err := SyncOnce(config, awsClient, consulClient)
+	require.NoError(t, err)
+	require.Len(t, consul.serviceInstances("api"), 2)
+	cloudMap.deleteService(awsID)
+
+	// The removals are refused in the plan, so apply doesn't make them
+	// either, and planning doesn't count as a refused run.
+	plan, err := Plan(config, awsClient, consulClient)
+	require.NoError(t, err)
+	require.Empty(t, plan)
+	require.Empty(t, config.RemovalGuard.Blocked())
+	summaries, err := Apply(config, awsClient, consulClient, plan)
+	require.NoError(t, err)
+	require.Equal(t, []Summary{{Direction: directionToConsul, Namespace: fakeNamespaceID, Blocked: 2}}, summaries)
+	require.Len(t, consul.serviceInstances("api"), 2)
+
+	// Once refused for a run, the removals are planned and applied.
+	plan, err = Plan(config, awsClient, consulClient)
+	require.NoError(t, err)
+	require.Len(t, plan, 2)
+	summaries, err = Apply(config, awsClient, consulClient, plan)
+	require.NoError(t, err)
+	require.Equal(t, []Summary{{Direction: directionToConsul, Namespace: fakeNamespaceID, Removed: 2}}, summaries)
+	require.Empty(t, consul.serviceInstances("api"))
+}
+
+// TestPlanApply_SideEffects checks that a drifted Apply neither adopts
+// services nor creates namespaces.
+func TestPlanApply_SideEffects(t *testing.T) {
+	cloudMap, awsClient := newFakeCloudMap(t)
+	consul, consulClient := newFakeConsul(t)
+	config := Config{
+		ToAWS:            true,
+		Namespaces:       []NamespaceConfig{{ID: fakeNamespaceID}},
+		ConsulPrefix:     "consul_",
+		AWSAdoptServices: true,
+	}
+	id := cloudMap.createService("consul_web", nil, "10.0.0.1:80")
+	cloudMap.describeService(id, awsServiceDescription)
+	consul.registerService(&api.AgentService{ID: "web1", Service: "web", Address: "10.0.0.1", Port: 80}, "")
+	consul.registerService(&api.AgentService{ID: "web2", Service: "web", Address: "10.0.0.2", Port: 80}, "")
+
+	plan, err := Plan(config, awsClient, consulClient)
+	require.NoError(t, err)
+	require.Len(t, plan, 2)
+	consul.registerService(&api.AgentService{ID: "web3", Service: "web", Address: "10.0.0.3", Port: 80}, "")
+	_, err = Apply(config, awsClient, consulClient, plan)
+	require.ErrorIs(t, err, ErrDrift)
+	require.Empty(t, cloudMap.tags("consul_web"))
+
+	plan, err = Plan(config, awsClient, consulClient)
+	require.NoError(t, err)
+	summaries, err := Apply(config, awsClient, consulClient, plan)
+	require.NoError(t, err)
+	require.Equal(t, []Summary{{Direction: directionToAWS, Namespace: fakeNamespaceID, Created: 2, Updated: 1}}, summaries)
+	require.Equal(t, DefaultDeploymentID, cloudMap.tags("consul_web")[AWSDeploymentTagKey])
+
+	config.Namespaces = []NamespaceConfig{{Name: "missing.test", Create: true}}
+	_, err = Apply(config, awsClient, consulClient, nil)
+	require.Error(t, err)
+	require.Len(t, cloudMap.namespaces, 1)
+}
@@ -0,0 +1,260 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package catalog
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awssd "github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-hclog"
+)
+
+// OwnedService is a service created by consul-aws, either in CloudMap or in
+// Consul. ID is the ID of CloudMap services, Instances the IDs of the
+// CloudMap instances or Consul service instances. Shared CloudMap services
+// also have instances of other deployments, which are left alone, and so
+// is the service. Legacy services were created by a version of consul-aws
+// without deployments, and belong to any deployment.
+type OwnedService struct {
+	Side      string
+	Namespace string
+	Name      string
+	ID        string
+	Instances []string
+	Shared    bool
+	Legacy    bool
+}
+
+// ListOwned returns the services created by consul-aws: the CloudMap
+// services in config.Namespaces owned by the deployment and the services
+// registered on the ConsulAWSNodeName node imported from them, including
+// the legacy ones whether or not config.AWSAdoptServices is set.
+// Namespaces are never created.
+func ListOwned(config Config, awsClient CloudMapClient, consulClient ConsulClient) ([]OwnedService, error) {
+	config.DryRun = true
+	s, err := newSyncer(config, awsClient, consulClient)
+	if err != nil {
+		return nil, err
+	}
+	owned := []OwnedService{}
+	namespaces := map[string]bool{}
+	for _, aws := range s.awsSyncers {
+		services, err := aws.listOwned()
+		if err != nil {
+			return nil, err
+		}
+		owned = append(owned, services...)
+		namespaces[*aws.namespace.Id] = true
+	}
+	services, err := s.consul.listOwned(namespaces)
+	if err != nil {
+		return nil, err
+	}
+	owned = append(owned, services...)
+	sort.Slice(owned, func(i, j int) bool {
+		if owned[i].Side != owned[j].Side {
+			return owned[i].Side < owned[j].Side
+		}
+		if owned[i].Namespace != owned[j].Namespace {
+			return owned[i].Namespace < owned[j].Namespace
+		}
+		if owned[i].Name != owned[j].Name {
+			return owned[i].Name < owned[j].Name
+		}
+		return !owned[i].Legacy && owned[j].Legacy
+	})
+	return owned, nil
+}
+
+// Purge removes the given services, as returned by ListOwned. CloudMap
+// instances are deregistered before their service is deleted. It returns
+// how many services and instances were removed and how many removals
+// failed.
+func Purge(config Config, awsClient CloudMapClient, consulClient ConsulClient, services []OwnedService) (int, int, error) {
+	config.DryRun = true
+	s, err := newSyncer(config, awsClient, consulClient)
+	if err != nil {
+		return 0, 0, err
+	}
+	awsSyncers := map[string]*awsSyncer{}
+	for _, aws := range s.awsSyncers {
+		awsSyncers[*aws.namespace.Id] = aws
+	}
+	// Nothing is removed unless every service is in a configured
+	// namespace.
+	for _, o := range services {
+		if _, ok := awsSyncers[o.Namespace]; !ok {
+			return 0, 0, fmt.Errorf("namespace %s is not configured", o.Namespace)
+		}
+	}
+	run := newSyncRun(hclog.Default().Named("purge"), "purge", "", false)
+	wg := sync.WaitGroup{}
+	for _, o := range services {
+		switch o.Side {
+		case sideAWS:
+			wg.Add(1)
+			go func(o OwnedService) {
+				defer wg.Done()
+				awsSyncers[o.Namespace].purge(o, run)
+			}(o)
+		case sideConsul:
+			wg.Add(1)
+			go func(o OwnedService) {
+				defer wg.Done()
+				s.consul.purge(o, run)
+			}(o)
+		}
+	}
+	wg.Wait()
+	return int(run.removed.Load()), int(run.failed.Load()), nil
+}
+
+func (a *awsSyncer) listOwned() ([]OwnedService, error) {
+	services, err := a.fetchServices()
+	if err != nil {
+		return nil, err
+	}
+	owned := []OwnedService{}
+	for _, as := range services {
+		o, err := a.owner(as)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching tags of %s: %s", aws.ToString(as.Name), err)
+		}
+		if o != ownerSelf && o != ownerLegacy {
+			continue
+		}
+		instances, err := a.fetchNodes(*as.Id)
+		if err != nil {
+			return nil, err
+		}
+		// Legacy services are purged like owned ones, with the instances
+		// without a deployment.
+		instances, all := a.ownInstances(instances, ownerSelf)
+		s := OwnedService{
+			Side:      sideAWS,
+			Namespace: *a.namespace.Id,
+			Name:      *as.Name,
+			ID:        *as.Id,
+			Instances: []string{},
+			Shared:    !all,
+			Legacy:    o == ownerLegacy,
+		}
+		for _, i := range instances {
+			s.Instances = append(s.Instances, *i.Id)
+		}
+		sort.Strings(s.Instances)
+		owned = append(owned, s)
+	}
+	return owned, nil
+}
+
+// listOwned returns the services imported from the given namespaces by
+// this deployment, and the ones imported without a deployment as legacy
+// services.
+func (c *consul) listOwned(namespaces map[string]bool) ([]OwnedService, error) {
+	node, _, err := c.client.Catalog().Node(ConsulAWSNodeName, &api.QueryOptions{AllowStale: c.stale})
+	if err != nil {
+		return nil, fmt.Errorf("error fetching node %s: %s", ConsulAWSNodeName, err)
+	}
+	if node == nil {
+		return nil, nil
+	}
+	byName := map[string]*OwnedService{}
+	for _, s := range node.Services {
+		if s.Meta[ConsulSourceKey] != ConsulAWSTag || !namespaces[s.Meta[ConsulAWSNS]] {
+			continue
+		}
+		_, ok := s.Meta[DeploymentKey]
+		legacy := !ok
+		if !legacy && !c.owns(s.Meta) {
+			continue
+		}
+		key := fmt.Sprintf("%s/%s/%t", s.Meta[ConsulAWSNS], s.Service, legacy)
+		o, ok := byName[key]
+		if !ok {
+			o = &OwnedService{
+				Side:      sideConsul,
+				Namespace: s.Meta[ConsulAWSNS],
+				Name:      s.Service,
+				Legacy:    legacy,
+			}
+			byName[key] = o
+		}
+		o.Instances = append(o.Instances, s.ID)
+	}
+	owned := make([]OwnedService, 0, len(byName))
+	for _, o := range byName {
+		sort.Strings(o.Instances)
+		owned = append(owned, *o)
+	}
+	return owned, nil
+}
+
+// purge deregisters the instances of the service, waits for the
+// deregistrations to finish and deletes the service unless it is shared.
+func (a *awsSyncer) purge(o OwnedService, run *syncRun) {
+	wg := sync.WaitGroup{}
+	var failed atomic.Int64
+	for _, instanceID := range o.Instances {
+		wg.Add(1)
+		go func(instanceID string) {
+			defer wg.Done()
+			resp, err := a.client.DeregisterInstance(context.TODO(), &awssd.DeregisterInstanceInput{
+				ServiceId:  &o.ID,
+				InstanceId: &instanceID,
+			})
+			if err == nil {
+				if resp.OperationId == nil {
+					err = fmt.Errorf("no operation returned")
+				} else {
+					_, err = a.waitForOperation(*resp.OperationId)
+				}
+			}
+			if err != nil {
+				a.log.Error("cannot remove instance", "service", o.Name, "id", instanceID, "error", err)
+				failed.Add(1)
+				run.fail(operationRemove)
+				return
+			}
+			run.remove()
+		}(instanceID)
+	}
+	wg.Wait()
+	if failed.Load() > 0 {
+		a.log.Error("not removing service with remaining instances", "name", o.Name)
+		run.fail(operationRemove)
+		return
+	}
+	if o.Shared {
+		a.log.Info("not removing service with instances of other deployments", "name", o.Name)
+		return
+	}
+	_, err := a.client.DeleteService(context.TODO(), &awssd.DeleteServiceInput{Id: &o.ID})
+	if err != nil {
+		a.log.Error("cannot remove service", "name", o.Name, "error", err)
+		run.fail(operationRemove)
+		return
+	}
+	run.remove()
+}
+
+// purge deregisters all instances of the service, which removes the service
+// with them.
+func (c *consul) purge(o OwnedService, run *syncRun) {
+	for _, id := range o.Instances {
+		_, err := c.client.Catalog().Deregister(&api.CatalogDeregistration{Node: ConsulAWSNodeName, ServiceID: id}, nil)
+		if err != nil {
+			c.log.Error("cannot remove service", "name", o.Name, "id", id, "error", err)
+			run.fail(operationRemove)
+			continue
+		}
+		run.remove()
+	}
+}
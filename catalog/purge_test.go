@@ -0,0 +1,165 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package catalog
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPurge_Fake(t *testing.T) {
+	cloudMap, awsClient := newFakeCloudMap(t)
+	consul, consulClient := newFakeConsul(t)
+	config := Config{
+		ToAWS:        true,
+		ToConsul:     true,
+		Namespaces:   []NamespaceConfig{{ID: fakeNamespaceID}},
+		ConsulPrefix: "consul_",
+		AWSPrefix:    "aws_",
+	}
+
+	consul.registerService(&api.AgentService{ID: "web1", Service: "web", Address: "10.0.0.1", Port: 80}, "")
+	cloudMap.createService("api", nil, "10.1.0.1:8080", "10.1.0.2:8080")
+	_, err := SyncOnce(config, awsClient, consulClient)
+	require.NoError(t, err)
+
+	owned, err := ListOwned(config, awsClient, consulClient)
+	require.NoError(t, err)
+	require.Len(t, owned, 2)
+	require.Equal(t, sideAWS, owned[0].Side)
+	require.Equal(t, "consul_web", owned[0].Name)
+	require.Len(t, owned[0].Instances, 1)
+	require.Equal(t, sideConsul, owned[1].Side)
+	require.Equal(t, "aws_api", owned[1].Name)
+	require.Len(t, owned[1].Instances, 2)
+
+	removed, failed, err := Purge(config, awsClient, consulClient, owned)
+	require.NoError(t, err)
+	require.Equal(t, 4, removed)
+	require.Zero(t, failed)
+
+	require.Nil(t, cloudMap.instances("consul_web"))
+	require.Len(t, cloudMap.instances("api"), 2)
+	require.Empty(t, consul.serviceInstances("aws_api"))
+	require.Len(t, consul.serviceInstances("web"), 1)
+
+	owned, err = ListOwned(config, awsClient, consulClient)
+	require.NoError(t, err)
+	require.Empty(t, owned)
+}
+
+// TestPurge_Deployments purges the instances of one deployment from a
+// service shared with another one, which keeps its instances and the
+// service.
+func TestPurge_Deployments(t *testing.T) {
+	cloudMap, awsClient := newFakeCloudMap(t)
+	consulA, consulClientA := newFakeConsul(t)
+	consulB, consulClientB := newFakeConsul(t)
+	config := Config{
+		ToAWS:      true,
+		Namespaces: []NamespaceConfig{{ID: fakeNamespaceID}},
+	}
+	configA, configB := config, config
+	configA.DeploymentID = "a"
+	configB.DeploymentID = "b"
+	consulA.registerService(&api.AgentService{ID: "web-a", Service: "web", Address: "10.0.0.1", Port: 80}, "")
+	consulB.registerService(&api.AgentService{ID: "web-b", Service: "web", Address: "10.0.1.1", Port: 80}, "")
+	_, err := SyncOnce(configA, awsClient, consulClientA)
+	require.NoError(t, err)
+	_, err = SyncOnce(configB, awsClient, consulClientB)
+	require.NoError(t, err)
+	require.Len(t, cloudMap.instances("web"), 2)
+
+	owned, err := ListOwned(configA, awsClient, consulClientA)
+	require.NoError(t, err)
+	require.Len(t, owned, 1)
+	require.Equal(t, []string{"10.0.0.1_80_a"}, owned[0].Instances)
+	require.True(t, owned[0].Shared)
+
+	removed, failed, err := Purge(configA, awsClient, consulClientA, owned)
+	require.NoError(t, err)
+	require.Equal(t, 1, removed)
+	require.Zero(t, failed)
+	instances := cloudMap.instances("web")
+	require.Len(t, instances, 1)
+	require.Contains(t, instances, "10.0.1.1_80_b")
+}
+
+// TestPurge_Namespaces only lists and purges the services imported from the
+// configured namespaces.
+func TestPurge_Namespaces(t *testing.T) {
+	_, awsClient := newFakeCloudMap(t)
+	consul, consulClient := newFakeConsul(t)
+	config := Config{
+		ToConsul:   true,
+		Namespaces: []NamespaceConfig{{ID: fakeNamespaceID}},
+		AWSPrefix:  "aws_",
+	}
+	for _, namespace := range []string{fakeNamespaceID, "ns-other"} {
+		consul.register(&api.CatalogRegistration{
+			Node:    ConsulAWSNodeName,
+			Address: "10.1.0.1",
+			Service: &api.AgentService{
+				ID:      "api_10.1.0.1_8080_" + namespace + "_default",
+				Service: "aws_api",
+				Tags:    []string{ConsulAWSTag},
+				Address: "10.1.0.1",
+				Port:    8080,
+				Meta:    map[string]string{ConsulSourceKey: ConsulAWSTag, ConsulAWSNS: namespace, ConsulAWSID: "api-0", DeploymentKey: DefaultDeploymentID},
+			},
+		})
+	}
+
+	owned, err := ListOwned(config, awsClient, consulClient)
+	require.NoError(t, err)
+	require.Len(t, owned, 1)
+	require.Equal(t, fakeNamespaceID, owned[0].Namespace)
+
+	_, _, err = Purge(config, awsClient, consulClient, []OwnedService{{Side: sideConsul, Namespace: "ns-other", Name: "aws_api", Instances: []string{"api_10.1.0.1_8080_ns-other_default"}}})
+	require.Error(t, err)
+	require.Len(t, consul.serviceInstances("aws_api"), 2)
+}
+
+// TestPurge_Legacy lists and purges the services created by a version
+// without deployments, which are not adopted.
+func TestPurge_Legacy(t *testing.T) {
+	cloudMap, awsClient := newFakeCloudMap(t)
+	consul, consulClient := newFakeConsul(t)
+	config := Config{
+		ToAWS:        true,
+		ToConsul:     true,
+		Namespaces:   []NamespaceConfig{{ID: fakeNamespaceID}},
+		DeploymentID: "b",
+	}
+	id := cloudMap.createService("web", nil, "10.0.0.1:80")
+	cloudMap.describeService(id, awsServiceDescription)
+	consul.register(&api.CatalogRegistration{
+		Node:    ConsulAWSNodeName,
+		Address: "10.1.0.1",
+		Service: &api.AgentService{
+			ID:      "api_10.1.0.1_8080",
+			Service: "api",
+			Tags:    []string{ConsulAWSTag},
+			Address: "10.1.0.1",
+			Port:    8080,
+			Meta:    map[string]string{ConsulSourceKey: ConsulAWSTag, ConsulAWSNS: fakeNamespaceID, ConsulAWSID: "api-0"},
+		},
+	})
+
+	owned, err := ListOwned(config, awsClient, consulClient)
+	require.NoError(t, err)
+	require.Equal(t, []OwnedService{
+		{Side: sideAWS, Namespace: fakeNamespaceID, Name: "web", ID: id, Instances: []string{"web-0"}, Legacy: true},
+		{Side: sideConsul, Namespace: fakeNamespaceID, Name: "api", Instances: []string{"api_10.1.0.1_8080"}, Legacy: true},
+	}, owned)
+
+	removed, failed, err := Purge(config, awsClient, consulClient, owned)
+	require.NoError(t, err)
+	require.Equal(t, 3, removed)
+	require.Zero(t, failed)
+	require.Nil(t, cloudMap.instances("web"))
+	require.Empty(t, consul.serviceInstances("api"))
+}
@@ -0,0 +1,202 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package catalog
+
+// reconciliation holds the operations turning the services on the
+// destination side of a sync into the services on the source side. Every
+// map holds partial services by name, carrying the IDs known on either
+// side.
+type reconciliation struct {
+	// create holds the services and instances missing on the destination
+	// side, and the healths differing from it.
+	create map[string]service
+	// update holds the instances whose attributes differ on the
+	// destination side. They are registered again.
+	update map[string]service
+	// remove holds the services and instances missing on the source side.
+	remove map[string]service
+	// clear holds the healths on the destination side of instances that
+	// have no health on the source side anymore.
+	clear map[string]service
+	// rekey holds the instances registered on the destination side under
+	// an older ID scheme, with the stale IDs set on their nodes and their
+	// healths on the source side. They are registered under their current
+	// ID before the stale ones are deregistered.
+	rekey map[string]service
+}
+
+// reconcileRules are the parts of reconciling that depend on the
+// direction of the sync.
+type reconcileRules struct {
+	// attributes returns the attributes the destination instance of a
+	// source instance has.
+	attributes func(s service, n node) map[string]string
+	// healthKey returns the key of the health of a source instance.
+	healthKey func(n node) string
+	// staleIDs returns the IDs of the destination instance of service k
+	// that aren't its current ID.
+	staleIDs func(k string, n node) []string
+}
+
+// reconcile compares the services of the source side with the services of
+// the destination side of a sync. It doesn't change either side.
+func reconcile(source, destination map[string]service, rules reconcileRules) reconciliation {
+	r := reconciliation{
+		create: map[string]service{},
+		update: map[string]service{},
+		remove: map[string]service{},
+		clear:  map[string]service{},
+		rekey:  map[string]service{},
+	}
+	for k, s := range source {
+		d, ok := destination[k]
+		if !ok {
+			r.create[k] = s
+			continue
+		}
+		create := map[string]map[int]node{}
+		update := map[string]map[int]node{}
+		rekey := map[string]map[int]node{}
+		rekeyedHealths := map[string]health{}
+		keys := map[string]bool{}
+		rekeyed := map[string]bool{}
+		for h, ports := range s.nodes {
+			for p, n := range ports {
+				key := rules.healthKey(n)
+				keys[key] = true
+				dn, ok := d.nodes[h][p]
+				if !ok {
+					addNode(create, h, p, n)
+				} else if stale := rules.staleIDs(k, dn); len(stale) > 0 {
+					n.staleIDs = stale
+					addNode(rekey, h, p, n)
+					rekeyed[key] = true
+					if health, ok := s.healths[key]; ok {
+						rekeyedHealths[key] = health
+					}
+				} else if !sameAttributes(rules.attributes(s, n), dn.attributes) {
+					addNode(update, h, p, n)
+				}
+			}
+		}
+		// The healths of re-keyed instances are set with their new
+		// registrations.
+		healths := map[string]health{}
+		for key, h := range s.healths {
+			if rekeyed[key] {
+				continue
+			}
+			if dh, ok := d.healths[key]; !ok || dh != h {
+				healths[key] = h
+			}
+		}
+		clear := map[string]health{}
+		for key, h := range d.healths {
+			if _, ok := s.healths[key]; !ok && keys[key] && !rekeyed[key] {
+				clear[key] = h
+			}
+		}
+
+		if len(create) > 0 || len(healths) > 0 {
+			c := mergeServices(s, d)
+			if len(create) > 0 {
+				c.nodes = create
+			}
+			if len(healths) > 0 {
+				c.healths = healths
+			}
+			r.create[k] = c
+		}
+		if len(update) > 0 {
+			u := mergeServices(s, d)
+			u.nodes = update
+			r.update[k] = u
+		}
+		if len(clear) > 0 {
+			c := mergeServices(s, d)
+			c.healths = clear
+			r.clear[k] = c
+		}
+		if len(rekey) > 0 {
+			rk := mergeServices(s, d)
+			rk.nodes = rekey
+			rk.healths = rekeyedHealths
+			r.rekey[k] = rk
+		}
+	}
+
+	for k, d := range destination {
+		s, ok := source[k]
+		if !ok {
+			r.remove[k] = d
+			continue
+		}
+		remove := map[string]map[int]node{}
+		for h, ports := range d.nodes {
+			for p, n := range ports {
+				if _, ok := s.nodes[h][p]; !ok {
+					addNode(remove, h, p, n)
+				}
+			}
+		}
+		if len(remove) > 0 {
+			rm := mergeServices(d, s)
+			rm.nodes = remove
+			r.remove[k] = rm
+		}
+	}
+	return r
+}
+
+// mergeServices returns the identity of a service known on both sides,
+// preferring the values of a. The result has neither nodes nor healths.
+func mergeServices(a, b service) service {
+	s := service{
+		id:           a.id,
+		name:         a.name,
+		awsID:        a.awsID,
+		consulID:     a.consulID,
+		awsNamespace: a.awsNamespace,
+		fromConsul:   a.fromConsul || b.fromConsul,
+		fromAWS:      a.fromAWS || b.fromAWS,
+		overrides:    a.overrides,
+	}
+	if len(s.id) == 0 {
+		s.id = b.id
+	}
+	if len(s.name) == 0 {
+		s.name = b.name
+	}
+	if len(s.awsID) == 0 {
+		s.awsID = b.awsID
+	}
+	if len(s.consulID) == 0 {
+		s.consulID = b.consulID
+	}
+	if len(s.awsNamespace) == 0 {
+		s.awsNamespace = b.awsNamespace
+	}
+	return s
+}
+
+func addNode(nodes map[string]map[int]node, h string, p int, n node) {
+	if nodes[h] == nil {
+		nodes[h] = map[int]node{}
+	}
+	nodes[h][p] = n
+}
+
+// sameAttributes returns true if a and b hold the same attributes. Nil and
+// empty attributes are the same.
+func sameAttributes(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,398 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package catalog
+
+import (
+	"testing"
+
+	awssdtypes "github.com/aws/aws-sdk-go-v2/service/servicediscovery/types"
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+)
+
+// testRules reconcile instances with the same attributes on both sides,
+// with healths keyed by Consul ID.
+var testRules = reconcileRules{
+	attributes: func(s service, n node) map[string]string { return n.attributes },
+	healthKey:  func(n node) string { return n.consulID },
+	staleIDs:   func(k string, n node) []string { return n.staleIDs },
+}
+
+func TestReconcile_Create(t *testing.T) {
+	type variant struct {
+		a        map[string]service
+		b        map[string]service
+		expected map[string]service
+	}
+
+	table := []variant{
+		{
+			a:        map[string]service{},
+			b:        map[string]service{},
+			expected: map[string]service{},
+		},
+		{
+			a: map[string]service{
+				"s1": {fromConsul: true},
+			},
+			b: map[string]service{},
+			expected: map[string]service{
+				"s1": {fromConsul: true},
+			},
+		},
+		{
+			a: map[string]service{
+				"s2": {fromConsul: true, nodes: map[string]map[int]node{"h1": {1: {}}}},
+			},
+			b: map[string]service{
+				"s2": {nodes: map[string]map[int]node{"h2": {2: {}}}},
+			},
+			expected: map[string]service{
+				"s2": {fromConsul: true, nodes: map[string]map[int]node{"h1": {1: {}}}},
+			},
+		},
+		{
+			a: map[string]service{
+				"s3": {fromConsul: false, nodes: map[string]map[int]node{"h1": {1: {port: 1}}}},
+			},
+			b: map[string]service{
+				"s3": {fromConsul: true, nodes: map[string]map[int]node{"h2": {2: {port: 2}}}},
+			},
+			expected: map[string]service{
+				"s3": {fromConsul: true, nodes: map[string]map[int]node{"h1": {1: {port: 1}}}},
+			},
+		},
+		{
+			a: map[string]service{
+				"s4": {fromAWS: true},
+			},
+			b: map[string]service{},
+			expected: map[string]service{
+				"s4": {fromAWS: true},
+			},
+		},
+		{
+			a: map[string]service{
+				"s5": {fromAWS: true, nodes: map[string]map[int]node{"h1": {1: {port: 1}}}},
+			},
+			b: map[string]service{
+				"s5": {nodes: map[string]map[int]node{"h2": {2: {port: 2}}}},
+			},
+			expected: map[string]service{
+				"s5": {fromAWS: true, nodes: map[string]map[int]node{"h1": {1: {port: 1}}}},
+			},
+		},
+		{
+			a: map[string]service{
+				"s6": {fromAWS: false, nodes: map[string]map[int]node{"h1": {1: {port: 1}}}},
+			},
+			b: map[string]service{
+				"s6": {fromAWS: true, nodes: map[string]map[int]node{"h2": {2: {port: 2}}}},
+			},
+			expected: map[string]service{
+				"s6": {fromAWS: true, nodes: map[string]map[int]node{"h1": {1: {port: 1}}}},
+			},
+		},
+		{
+			a:        map[string]service{"s7": {}},
+			b:        map[string]service{},
+			expected: map[string]service{"s7": {}},
+		},
+		{
+			a:        map[string]service{"s8": {}},
+			b:        map[string]service{"s8": {}},
+			expected: map[string]service{},
+		},
+		{
+			a:        map[string]service{"s9": {}, "s10": {}},
+			b:        map[string]service{"s9": {}},
+			expected: map[string]service{"s10": {}},
+		},
+		{
+			a: map[string]service{
+				"s11": {nodes: map[string]map[int]node{"h1": {1: {port: 1}}, "h2": {2: {port: 2}}}},
+			},
+			b: map[string]service{
+				"s11": {nodes: map[string]map[int]node{"h1": {1: {port: 1}}, "h2": {2: {port: 2}}}},
+			},
+			expected: map[string]service{},
+		},
+		{
+			a: map[string]service{
+				"s12": {nodes: map[string]map[int]node{"h1": {1: {port: 1}}, "h2": {2: {port: 2}}}},
+			},
+			b: map[string]service{
+				"s12": {nodes: map[string]map[int]node{"h2": {2: {port: 2}}}},
+			},
+			expected: map[string]service{
+				"s12": {nodes: map[string]map[int]node{"h1": {1: {port: 1}}}},
+			},
+		},
+		{
+			a: map[string]service{
+				"s13": {nodes: map[string]map[int]node{"h1": {1: {port: 1}}, "h2": {2: {port: 2}}}},
+			},
+			b: map[string]service{
+				"s13": {awsID: "id", nodes: map[string]map[int]node{"h2": {2: {port: 2}}}},
+			},
+			expected: map[string]service{
+				"s13": {awsID: "id", nodes: map[string]map[int]node{"h1": {1: {port: 1}}}},
+			},
+		},
+		{
+			a: map[string]service{
+				"s14": {nodes: map[string]map[int]node{"h1": {1: {port: 1}}, "h2": {2: {port: 2}}}},
+			},
+			b: map[string]service{
+				"s14": {awsNamespace: "ns1", nodes: map[string]map[int]node{"h2": {2: {port: 2}}}},
+			},
+			expected: map[string]service{
+				"s14": {awsNamespace: "ns1", nodes: map[string]map[int]node{"h1": {1: {port: 1}}}},
+			},
+		},
+		{
+			a: map[string]service{
+				"s15": {nodes: map[string]map[int]node{"h1": {1: {awsID: "a1"}}}},
+			},
+			b: map[string]service{
+				"s15": {nodes: map[string]map[int]node{"h2": {}}},
+			},
+			expected: map[string]service{
+				"s15": {nodes: map[string]map[int]node{"h1": {1: {awsID: "a1"}}}},
+			},
+		},
+		{
+			a: map[string]service{
+				"s16": {healths: map[string]health{"h1": passing, "h2": critical}},
+			},
+			b: map[string]service{
+				"s16": {healths: map[string]health{"h1": passing}},
+			},
+			expected: map[string]service{
+				"s16": {healths: map[string]health{"h2": critical}},
+			},
+		},
+		{
+			a: map[string]service{
+				"s17": {healths: map[string]health{"h1": passing}},
+			},
+			b: map[string]service{
+				"s17": {healths: map[string]health{"h1": critical}},
+			},
+			expected: map[string]service{
+				"s17": {healths: map[string]health{"h1": passing}},
+			},
+		},
+		{
+			a: map[string]service{
+				"s18": {healths: map[string]health{"h1": passing, "h2": critical}},
+			},
+			b: map[string]service{
+				"s18": {healths: map[string]health{"h2": critical, "h1": passing}},
+			},
+			expected: map[string]service{},
+		},
+		{
+			a: map[string]service{
+				"s19": {nodes: map[string]map[int]node{"h1": {1: {port: 1}}, "h2": {2: {port: 2}}}},
+			},
+			b: map[string]service{
+				"s19": {consulID: "id", nodes: map[string]map[int]node{"h2": {2: {port: 2}}}},
+			},
+			expected: map[string]service{
+				"s19": {consulID: "id", nodes: map[string]map[int]node{"h1": {1: {port: 1}}}},
+			},
+		},
+		{
+			a: map[string]service{
+				"s20": {nodes: map[string]map[int]node{"h1": {1: {port: 1}}, "h2": {2: {port: 2}}}},
+			},
+			b: map[string]service{
+				"s20": {id: "id", name: "name", nodes: map[string]map[int]node{"h2": {2: {port: 2}}}},
+			},
+			expected: map[string]service{
+				"s20": {id: "id", name: "name", nodes: map[string]map[int]node{"h1": {1: {port: 1}}}},
+			},
+		},
+	}
+
+	for _, v := range table {
+		require.Equal(t, v.expected, reconcile(v.a, v.b, testRules).create)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	source := map[string]service{
+		"web": {name: "web", fromAWS: true, nodes: map[string]map[int]node{
+			"h1": {1: {host: "h1", port: 1, consulID: "web1", attributes: map[string]string{"version": "2"}}},
+			"h2": {2: {host: "h2", port: 2, consulID: "web2"}},
+		}, healths: map[string]health{"web1": passing}},
+		"api": {name: "api", nodes: map[string]map[int]node{"h3": {3: {host: "h3", port: 3}}}},
+	}
+	destination := map[string]service{
+		"web": {name: "web", awsID: "srv-1", fromConsul: true, nodes: map[string]map[int]node{
+			"h1": {1: {host: "h1", port: 1, awsID: "i-1", attributes: map[string]string{"version": "1"}}},
+			"h2": {2: {host: "h2", port: 2, awsID: "i-2"}},
+			"h4": {4: {host: "h4", port: 4, awsID: "i-4"}},
+		}, healths: map[string]health{"web1": passing, "web2": critical, "web4": critical}},
+		"db": {name: "db", awsID: "srv-2", fromConsul: true, nodes: map[string]map[int]node{"h5": {5: {host: "h5", port: 5}}}},
+	}
+	web := service{name: "web", awsID: "srv-1", fromConsul: true, fromAWS: true}
+
+	r := reconcile(source, destination, testRules)
+	require.Equal(t, map[string]service{"api": source["api"]}, r.create)
+	update := web
+	update.nodes = map[string]map[int]node{"h1": {1: source["web"].nodes["h1"][1]}}
+	require.Equal(t, map[string]service{"web": update}, r.update)
+	remove := web
+	remove.nodes = map[string]map[int]node{"h4": {4: destination["web"].nodes["h4"][4]}}
+	require.Equal(t, map[string]service{"web": remove, "db": destination["db"]}, r.remove)
+	// Only the healths of instances still on the source side are cleared.
+	clear := web
+	clear.healths = map[string]health{"web2": critical}
+	require.Equal(t, map[string]service{"web": clear}, r.clear)
+
+	// Nothing changes once both sides are the same.
+	r = reconcile(source, source, testRules)
+	require.Empty(t, r.create)
+	require.Empty(t, r.update)
+	require.Empty(t, r.remove)
+	require.Empty(t, r.clear)
+}
+
+func TestReconcile_Sync(t *testing.T) {
+	cloudMap, awsClient := newFakeCloudMap(t)
+	consul, consulClient := newFakeConsul(t)
+	config := Config{
+		ToAWS:        true,
+		Namespaces:   []NamespaceConfig{{ID: fakeNamespaceID}},
+		ConsulPrefix: "consul_",
+	}
+	consul.registerService(&api.AgentService{ID: "web1", Service: "web", Address: "10.0.0.1", Port: 80, Meta: map[string]string{"version": "1"}}, "critical")
+
+	summaries, err := SyncOnce(config, awsClient, consulClient)
+	require.NoError(t, err)
+	require.Equal(t, []Summary{{Direction: directionToAWS, Namespace: fakeNamespaceID, Created: 2}}, summaries)
+	var instanceID string
+	for id := range cloudMap.instances("consul_web") {
+		instanceID = id
+	}
+	require.Equal(t, string(awssdtypes.CustomHealthStatusUnhealthy), cloudMap.health("consul_web", instanceID))
+
+	// Changed meta and tags are propagated, and so are removed checks.
+	consul.registerService(&api.AgentService{ID: "web1", Service: "web", Address: "10.0.0.1", Port: 80, Tags: []string{"v2", "canary"}, Meta: map[string]string{"version": "2"}}, "")
+	consul.deregister(&api.CatalogDeregistration{CheckID: "check-web1"})
+	summaries, err = SyncOnce(config, awsClient, consulClient)
+	require.NoError(t, err)
+	require.Equal(t, []Summary{{Direction: directionToAWS, Namespace: fakeNamespaceID, Updated: 1}}, summaries)
+	attributes := cloudMap.instances("consul_web")[instanceID]
+	require.Equal(t, "2", attributes["version"])
+	require.Equal(t, "canary,v2", attributes[AWSConsulTags])
+	require.Equal(t, string(awssdtypes.CustomHealthStatusHealthy), cloudMap.health("consul_web", instanceID))
+
+	summaries, err = SyncOnce(config, awsClient, consulClient)
+	require.NoError(t, err)
+	require.Equal(t, []Summary{{Direction: directionToAWS, Namespace: fakeNamespaceID}}, summaries)
+}
+
+func TestReconcile_Rekey(t *testing.T) {
+	source := map[string]service{
+		"web": {name: "web", fromAWS: true, healths: map[string]health{"web1": critical, "web2": passing}, nodes: map[string]map[int]node{
+			"h1": {1: {host: "h1", port: 1, consulID: "web1"}},
+			"h2": {1: {host: "h2", port: 1, consulID: "web2"}},
+		}},
+	}
+	destination := map[string]service{
+		"web": {name: "web", fromAWS: true, healths: map[string]health{"web1": passing}, nodes: map[string]map[int]node{
+			"h1": {1: {host: "h1", port: 1, consulID: "web1", staleIDs: []string{"web_h1_1"}}},
+			"h2": {1: {host: "h2", port: 1, consulID: "web2"}},
+		}},
+	}
+
+	// The health of the re-keyed instance comes with it.
+	r := reconcile(source, destination, testRules)
+	require.Equal(t, map[string]service{
+		"web": {name: "web", fromAWS: true, healths: map[string]health{"web1": critical}, nodes: map[string]map[int]node{
+			"h1": {1: {host: "h1", port: 1, consulID: "web1", staleIDs: []string{"web_h1_1"}}},
+		}},
+	}, r.rekey)
+	require.Equal(t, map[string]service{
+		"web": {name: "web", fromAWS: true, healths: map[string]health{"web2": passing}},
+	}, r.create)
+	require.Empty(t, r.update)
+	require.Empty(t, r.remove)
+	require.Empty(t, r.clear)
+}
+
+func TestReconcile_RekeySync(t *testing.T) {
+	cloudMap, awsClient := newFakeCloudMap(t)
+	consul, consulClient := newFakeConsul(t)
+	config := Config{
+		ToAWS:        true,
+		ToConsul:     true,
+		Namespaces:   []NamespaceConfig{{ID: fakeNamespaceID}},
+		ConsulPrefix: "consul_",
+		AWSPrefix:    "aws_",
+	}
+
+	// Registrations made by an older version, with IDs that aren't the
+	// current ones.
+	consul.registerService(&api.AgentService{ID: "web1", Service: "web", Address: "10.0.0.1", Port: 80}, api.HealthCritical)
+	webID := cloudMap.createService("consul_web", map[string]string{AWSOwnerTagKey: AWSOwnerTagValue, AWSDeploymentTagKey: DefaultDeploymentID}, "10.0.0.1:80")
+	cloudMap.services[webID].customHealth = true
+	cloudMap.createService("api", nil, "10.1.0.1:8080")
+	consul.register(&api.CatalogRegistration{
+		Node:    ConsulAWSNodeName,
+		Address: "10.1.0.1",
+		Service: &api.AgentService{
+			ID:      "api_10.1.0.1_8080",
+			Service: "aws_api",
+			Tags:    []string{ConsulAWSTag},
+			Address: "10.1.0.1",
+			Port:    8080,
+			Meta:    map[string]string{ConsulSourceKey: ConsulAWSTag, ConsulAWSNS: fakeNamespaceID, ConsulAWSID: "api-0", DeploymentKey: DefaultDeploymentID},
+		},
+	})
+	// Imported before deployments were recorded, which doesn't need
+	// -aws-adopt-services to be re-keyed.
+	cloudMap.createService("db", nil, "10.1.0.2:5432")
+	consul.register(&api.CatalogRegistration{
+		Node:    ConsulAWSNodeName,
+		Address: "10.1.0.2",
+		Service: &api.AgentService{
+			ID:      "db_10.1.0.2_5432",
+			Service: "aws_db",
+			Tags:    []string{ConsulAWSTag},
+			Address: "10.1.0.2",
+			Port:    5432,
+			Meta:    map[string]string{ConsulSourceKey: ConsulAWSTag, ConsulAWSNS: fakeNamespaceID, ConsulAWSID: "db-0"},
+		},
+	})
+
+	s, err := newSyncer(config, awsClient, consulClient)
+	require.NoError(t, err)
+	require.NoError(t, s.fetch())
+	require.Equal(t, []Summary{
+		{Direction: directionToAWS, Namespace: fakeNamespaceID, Updated: 1},
+		{Direction: directionToConsul, Namespace: fakeNamespaceID, Updated: 2},
+	}, summaries(s.run(false)))
+	s.waitForOperations()
+
+	instances := cloudMap.instances("consul_web")
+	require.Len(t, instances, 1)
+	require.Contains(t, instances, "10.0.0.1_80_default")
+	require.Equal(t, string(awssdtypes.CustomHealthStatusUnhealthy), cloudMap.health("consul_web", "10.0.0.1_80_default"))
+	services := consul.serviceInstances("aws_api")
+	require.Len(t, services, 1)
+	require.Contains(t, services, "api_10.1.0.1_8080_"+fakeNamespaceID+"_default")
+	services = consul.serviceInstances("aws_db")
+	require.Len(t, services, 1)
+	require.Equal(t, DefaultDeploymentID, services["db_10.1.0.2_5432_"+fakeNamespaceID+"_default"].Meta[DeploymentKey])
+
+	require.NoError(t, s.fetch())
+	require.Equal(t, []Summary{
+		{Direction: directionToAWS, Namespace: fakeNamespaceID},
+		{Direction: directionToConsul, Namespace: fakeNamespaceID},
+	}, summaries(s.run(false)))
+}
@@ -0,0 +1,182 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package catalog
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	awssdtypes "github.com/aws/aws-sdk-go-v2/service/servicediscovery/types"
+)
+
+const (
+	retryAttempts  = 5
+	retryBaseDelay = 2 * time.Second
+	retryMaxDelay  = time.Minute
+	retryInterval  = time.Second
+)
+
+// mutation is a change made to AWS. Mutations are identified by their
+// action and the IDs of the service and the instance they change, so a
+// failed mutation can be retried.
+type mutation struct {
+	action     string
+	operation  string
+	service    string
+	serviceID  string
+	instanceID string
+	fn         func() error
+}
+
+func (m mutation) key() string {
+	return m.action + "/" + m.serviceID + "/" + m.instanceID
+}
+
+// permanent returns true for errors that retrying the mutation doesn't fix.
+func permanent(err error) bool {
+	var instanceNotFound *awssdtypes.InstanceNotFound
+	var serviceNotFound *awssdtypes.ServiceNotFound
+	var customHealthNotFound *awssdtypes.CustomHealthNotFound
+	return errors.As(err, &instanceNotFound) ||
+		errors.As(err, &serviceNotFound) ||
+		errors.As(err, &customHealthNotFound)
+}
+
+// retryQueue holds the mutations that failed, so they are retried with
+// backoff instead of waiting for the next sync run to make them again.
+type retryQueue struct {
+	lock    sync.Mutex
+	retries map[string]*retry
+}
+
+type retry struct {
+	mutation
+	// attempts is the number of failed attempts so far.
+	attempts int
+	next     time.Time
+}
+
+func newRetryQueue() *retryQueue {
+	return &retryQueue{retries: map[string]*retry{}}
+}
+
+// add queues a mutation that failed for the first time. It replaces a
+// queued retry of the same mutation.
+func (q *retryQueue) add(m mutation, now time.Time) {
+	q.lock.Lock()
+	q.retries[m.key()] = &retry{
+		mutation: m,
+		attempts: 1,
+		next:     now.Add(backoff(0, retryBaseDelay, retryMaxDelay)),
+	}
+	q.lock.Unlock()
+}
+
+// requeue queues a retry that failed again. It returns false if the retry
+// is given up, either because it failed too often or because the mutation
+// has been queued again meanwhile.
+func (q *retryQueue) requeue(r *retry, now time.Time) bool {
+	if r.attempts+1 >= retryAttempts {
+		return false
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if _, ok := q.retries[r.key()]; ok {
+		return false
+	}
+	q.retries[r.key()] = &retry{
+		mutation: r.mutation,
+		attempts: r.attempts + 1,
+		next:     now.Add(backoff(r.attempts, retryBaseDelay, retryMaxDelay)),
+	}
+	return true
+}
+
+// remove drops the queued retry of a mutation, which is made again.
+func (q *retryQueue) remove(m mutation) {
+	q.lock.Lock()
+	delete(q.retries, m.key())
+	q.lock.Unlock()
+}
+
+// due removes and returns the retries that are due.
+func (q *retryQueue) due(now time.Time) []*retry {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	result := []*retry{}
+	for k, r := range q.retries {
+		if !r.next.After(now) {
+			result = append(result, r)
+			delete(q.retries, k)
+		}
+	}
+	return result
+}
+
+func (q *retryQueue) len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.retries)
+}
+
+// mutate makes the mutation on one of the workers and reports the outcome
+// to done. A failed mutation is queued to be retried, unless retrying
+// can't fix it.
+func (a *awsSyncer) mutate(wg *sync.WaitGroup, m mutation, done func(error)) {
+	a.retries.remove(m)
+	a.workers.run(wg, func() {
+		err := m.fn()
+		if err != nil && !permanent(err) {
+			a.retries.add(m, time.Now())
+			metricRetryQueue.WithLabelValues(*a.namespace.Id).Set(float64(a.retries.len()))
+		}
+		done(err)
+	})
+}
+
+// retryDue makes the queued mutations that are due again.
+func (a *awsSyncer) retryDue(now time.Time) {
+	namespace := *a.namespace.Id
+	wg := sync.WaitGroup{}
+	for _, r := range a.retries.due(now) {
+		a.workers.run(&wg, func() {
+			err := r.fn()
+			switch {
+			case err == nil:
+				a.log.Info("retry succeeded", "action", r.action, "service", r.service, "instance", r.instanceID)
+				metricRetries.WithLabelValues(namespace, r.operation, "success").Inc()
+				switch r.operation {
+				case operationCreate:
+					metricCreated.WithLabelValues(directionToAWS, namespace).Inc()
+				case operationRemove:
+					metricRemoved.WithLabelValues(directionToAWS, namespace).Inc()
+				}
+			case !permanent(err) && a.retries.requeue(r, time.Now()):
+				a.log.Debug("retry failed", "action", r.action, "service", r.service, "instance", r.instanceID, "error", err)
+				metricRetries.WithLabelValues(namespace, r.operation, "failure").Inc()
+			default:
+				a.log.Error("giving up retrying", "action", r.action, "service", r.service, "instance", r.instanceID, "attempts", r.attempts+1, "error", err)
+				metricRetries.WithLabelValues(namespace, r.operation, "failure").Inc()
+			}
+		})
+	}
+	wg.Wait()
+	metricRetryQueue.WithLabelValues(namespace).Set(float64(a.retries.len()))
+}
+
+// retryIndefinitely makes the queued mutations again once they are due.
+func (a *awsSyncer) retryIndefinitely(stop, stopped chan struct{}) {
+	defer close(stopped)
+	ticker := time.NewTicker(retryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			a.retryDue(now)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package catalog
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	awssd "github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+	awssdtypes "github.com/aws/aws-sdk-go-v2/service/servicediscovery/types"
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryQueue(t *testing.T) {
+	q := newRetryQueue()
+	now := time.Now()
+	m := mutation{action: ActionRegisterInstance, serviceID: "srv-1", instanceID: "i-1"}
+	q.add(m, now)
+	require.Empty(t, q.due(now.Add(-time.Second)))
+	require.Equal(t, 1, q.len())
+
+	due := q.due(now.Add(retryMaxDelay))
+	require.Len(t, due, 1)
+	require.Equal(t, 1, due[0].attempts)
+	require.Equal(t, 0, q.len())
+
+	// A retry is given up after retryAttempts or when the mutation was
+	// queued again meanwhile.
+	r := due[0]
+	for i := 2; i < retryAttempts; i++ {
+		require.True(t, q.requeue(r, now))
+		r = q.due(now.Add(retryMaxDelay))[0]
+		require.Equal(t, i, r.attempts)
+	}
+	require.False(t, q.requeue(r, now))
+	q.add(m, now)
+	require.False(t, q.requeue(&retry{mutation: m, attempts: 1}, now))
+
+	q.remove(m)
+	require.Equal(t, 0, q.len())
+}
+
+func TestPermanent(t *testing.T) {
+	require.True(t, permanent(&awssdtypes.InstanceNotFound{}))
+	require.True(t, permanent(&awssdtypes.CustomHealthNotFound{}))
+	require.False(t, permanent(&awssdtypes.ResourceInUse{}))
+	require.False(t, permanent(errors.New("timeout")))
+}
+
+// failingOnceCloudMap fails the first registration of an instance.
+type failingOnceCloudMap struct {
+	CloudMapClient
+	failed bool
+}
+
+func (c *failingOnceCloudMap) RegisterInstance(ctx context.Context, in *awssd.RegisterInstanceInput, optFns ...func(*awssd.Options)) (*awssd.RegisterInstanceOutput, error) {
+	if !c.failed {
+		c.failed = true
+		return nil, errors.New("injected failure")
+	}
+	return c.CloudMapClient.RegisterInstance(ctx, in, optFns...)
+}
+
+func TestRetry_Fake(t *testing.T) {
+	cloudMap, awsClient := newFakeCloudMap(t)
+	consul, consulClient := newFakeConsul(t)
+	config := Config{
+		ToAWS:      true,
+		Namespaces: []NamespaceConfig{{ID: fakeNamespaceID}},
+	}
+	consul.registerService(&api.AgentService{ID: "web1", Service: "web", Address: "10.0.0.1", Port: 80}, "")
+
+	s, err := newSyncer(config, &failingOnceCloudMap{CloudMapClient: awsClient}, consulClient)
+	require.NoError(t, err)
+	require.NoError(t, s.fetch())
+	require.Equal(t, []Summary{{Direction: directionToAWS, Namespace: fakeNamespaceID, Created: 1, Failed: 1}}, summaries(s.run(false)))
+	require.Empty(t, cloudMap.instances("web"))
+
+	aws := s.awsSyncers[0]
+	require.Equal(t, 1, aws.retries.len())
+	aws.retryDue(time.Now().Add(retryMaxDelay))
+	require.Equal(t, 0, aws.retries.len())
+	require.Len(t, cloudMap.instances("web"), 1)
+}
@@ -0,0 +1,152 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package catalog
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+const (
+	ActionCreateService      = "create-service"
+	ActionDeleteService      = "delete-service"
+	ActionRegisterInstance   = "register-instance"
+	ActionUpdateInstance     = "update-instance"
+	ActionRekeyInstance      = "rekey-instance"
+	ActionDeregisterInstance = "deregister-instance"
+	ActionUpdateHealth       = "update-health"
+	ActionClearHealth        = "clear-health"
+)
+
+// Change is a single change a sync run makes to the destination side.
+// Service is the name of the service on the destination side, Instance the
+// ID of the instance if the change is about one. Attributes are the
+// attributes or meta written with an instance, and the DNS settings a
+// service is created with in DNS namespaces.
+type Change struct {
+	Direction  string            `json:"direction"`
+	Namespace  string            `json:"namespace"`
+	Action     string            `json:"action"`
+	Service    string            `json:"service"`
+	Instance   string            `json:"instance,omitempty"`
+	Address    string            `json:"address,omitempty"`
+	Port       int               `json:"port,omitempty"`
+	Health     string            `json:"health,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+func (c Change) String() string {
+	s := fmt.Sprintf("%s %s %s", c.Direction, c.Action, c.Service)
+	if len(c.Instance) > 0 {
+		s += " " + c.Instance
+	}
+	if len(c.Address) > 0 {
+		s += fmt.Sprintf(" %s:%d", c.Address, c.Port)
+	}
+	if len(c.Health) > 0 {
+		s += " " + c.Health
+	}
+	return s
+}
+
+// syncRun counts the operations of one sync run in one direction with one
+// namespace and records them in the metrics. In a dry run, changes are only
+// recorded and logged instead of being made. It is safe for concurrent use.
+type syncRun struct {
+	log       hclog.Logger
+	direction string
+	namespace string
+	dry       bool
+	created   atomic.Int64
+	updated   atomic.Int64
+	removed   atomic.Int64
+	failed    atomic.Int64
+	blocked   atomic.Int64
+
+	lock    sync.Mutex
+	changes []Change
+}
+
+func newSyncRun(log hclog.Logger, direction, namespace string, dry bool) *syncRun {
+	return &syncRun{log: log, direction: direction, namespace: namespace, dry: dry}
+}
+
+// dryRun records the change and returns true if it must not be made because
+// this is a dry run.
+func (r *syncRun) dryRun(c Change) bool {
+	if !r.dry {
+		return false
+	}
+	c.Direction = r.direction
+	c.Namespace = r.namespace
+	r.lock.Lock()
+	r.changes = append(r.changes, c)
+	r.lock.Unlock()
+	r.log.Info("dry-run", "action", c.Action, "service", c.Service, "instance", c.Instance,
+		"address", c.Address, "port", c.Port, "health", c.Health)
+	return true
+}
+
+// getChanges returns the changes recorded in a dry run.
+func (r *syncRun) getChanges() []Change {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]Change{}, r.changes...)
+}
+
+func (r *syncRun) create() {
+	r.created.Add(1)
+	metricCreated.WithLabelValues(r.direction, r.namespace).Inc()
+}
+
+func (r *syncRun) update() {
+	r.updated.Add(1)
+	metricUpdated.WithLabelValues(r.direction, r.namespace).Inc()
+}
+
+func (r *syncRun) remove() {
+	r.removed.Add(1)
+	metricRemoved.WithLabelValues(r.direction, r.namespace).Inc()
+}
+
+func (r *syncRun) fail(operation string) {
+	r.failed.Add(1)
+	metricFailed.WithLabelValues(r.direction, r.namespace, operation).Inc()
+}
+
+// block records removals refused by the RemovalGuard.
+func (r *syncRun) block(count int) {
+	r.blocked.Add(int64(count))
+}
+
+// finish logs the counts of the run and records the time of the run if no
+// operation failed and no removal was refused.
+func (r *syncRun) finish() {
+	if r.dry {
+		if count := len(r.getChanges()); count > 0 {
+			r.log.Info("dry-run changes", "count", fmt.Sprintf("%d", count))
+		}
+		return
+	}
+	if count := r.created.Load(); count > 0 {
+		r.log.Info("created", "count", fmt.Sprintf("%d", count))
+	}
+	if count := r.updated.Load(); count > 0 {
+		r.log.Info("updated", "count", fmt.Sprintf("%d", count))
+	}
+	if count := r.removed.Load(); count > 0 {
+		r.log.Info("removed", "count", fmt.Sprintf("%d", count))
+	}
+	if count := r.failed.Load(); count > 0 {
+		r.log.Warn("failed", "count", fmt.Sprintf("%d", count))
+		return
+	}
+	if r.blocked.Load() > 0 {
+		return
+	}
+	metricLastSync.WithLabelValues(r.direction, r.namespace).SetToCurrentTime()
+}
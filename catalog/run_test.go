@@ -0,0 +1,117 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package catalog
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awssdtypes "github.com/aws/aws-sdk-go-v2/service/servicediscovery/types"
+	"github.com/hashicorp/go-hclog"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyncRun(t *testing.T) {
+	// The counters are global, so only their increase is checked.
+	created := testutil.ToFloat64(metricCreated.WithLabelValues(directionToAWS, "ns-run"))
+	removed := testutil.ToFloat64(metricRemoved.WithLabelValues(directionToAWS, "ns-run"))
+	failed := testutil.ToFloat64(metricFailed.WithLabelValues(directionToAWS, "ns-run", operationRemove))
+	run := newSyncRun(hclog.NewNullLogger(), directionToAWS, "ns-run", false)
+	run.create()
+	run.create()
+	run.remove()
+	run.finish()
+	require.Equal(t, created+2, testutil.ToFloat64(metricCreated.WithLabelValues(directionToAWS, "ns-run")))
+	require.Equal(t, removed+1, testutil.ToFloat64(metricRemoved.WithLabelValues(directionToAWS, "ns-run")))
+	require.NotZero(t, testutil.ToFloat64(metricLastSync.WithLabelValues(directionToAWS, "ns-run")))
+
+	metricLastSync.WithLabelValues(directionToAWS, "ns-run").Set(0)
+	run = newSyncRun(hclog.NewNullLogger(), directionToAWS, "ns-run", false)
+	run.fail(operationRemove)
+	run.finish()
+	require.Equal(t, failed+1, testutil.ToFloat64(metricFailed.WithLabelValues(directionToAWS, "ns-run", operationRemove)))
+	require.Zero(t, testutil.ToFloat64(metricLastSync.WithLabelValues(directionToAWS, "ns-run")))
+}
+
+// The syncers have no clients in these tests, so any call that is not
+// skipped by the dry run panics.
+func TestDryRun_AWS(t *testing.T) {
+	a := awsSyncer{
+		log:          hclog.NewNullLogger(),
+		namespace:    &awssdtypes.Namespace{Id: aws.String("ns-1"), Type: awssdtypes.NamespaceTypeHttp},
+		consulPrefix: "c_",
+		dryRun:       true,
+		deploymentID: DefaultDeploymentID,
+	}
+	run := newSyncRun(a.log, directionToAWS, "ns-1", a.dryRun)
+	a.create(map[string]service{
+		"web": {
+			name: "web",
+			nodes: map[string]map[int]node{
+				"1.1.1.1": {80: {host: "1.1.1.1", port: 80, consulID: "web1"}},
+			},
+			healths: map[string]health{"web1": critical},
+		},
+	}, run)
+	a.remove(map[string]service{
+		"db": {
+			name:       "db",
+			awsID:      "srv-db",
+			fromConsul: true,
+			nodes: map[string]map[int]node{
+				"2.2.2.2": {5432: {host: "2.2.2.2", port: 5432, awsID: "srv-db_2.2.2.2_5432"}},
+			},
+		},
+	}, run)
+
+	require.ElementsMatch(t, []Change{
+		{Direction: directionToAWS, Namespace: "ns-1", Action: ActionCreateService, Service: "c_web"},
+		{Direction: directionToAWS, Namespace: "ns-1", Action: ActionRegisterInstance, Service: "c_web", Instance: "1.1.1.1_80_default", Address: "1.1.1.1", Port: 80, Attributes: map[string]string{
+			"AWS_INSTANCE_IPV4": "1.1.1.1",
+			"AWS_INSTANCE_PORT": "80",
+			AWSConsulID:         "web1",
+			DeploymentKey:       DefaultDeploymentID,
+		}},
+		{Direction: directionToAWS, Namespace: "ns-1", Action: ActionUpdateHealth, Service: "c_web", Instance: "1.1.1.1_80_default", Health: "UNHEALTHY"},
+		{Direction: directionToAWS, Namespace: "ns-1", Action: ActionDeregisterInstance, Service: "c_db", Instance: "srv-db_2.2.2.2_5432", Address: "2.2.2.2", Port: 5432},
+		{Direction: directionToAWS, Namespace: "ns-1", Action: ActionDeleteService, Service: "c_db"},
+	}, run.getChanges())
+	require.Zero(t, run.created.Load())
+	require.Zero(t, run.removed.Load())
+}
+
+func TestDryRun_Consul(t *testing.T) {
+	c := consul{
+		log:          hclog.NewNullLogger(),
+		awsPrefix:    "a_",
+		dryRun:       true,
+		deploymentID: DefaultDeploymentID,
+	}
+	run := newSyncRun(c.log, directionToConsul, "ns-1", c.dryRun)
+	c.create(map[string]service{
+		"web": {
+			name:         "web",
+			awsNamespace: "ns-1",
+			nodes:        map[string]map[int]node{"1.1.1.1": {80: {host: "1.1.1.1", port: 80, awsID: "i-1"}}},
+		},
+	}, run)
+	c.remove(map[string]service{
+		"db": {
+			name:    "db",
+			fromAWS: true,
+			nodes:   map[string]map[int]node{"2.2.2.2": {5432: {host: "2.2.2.2", port: 5432, consulID: "db_2.2.2.2_5432"}}},
+		},
+	}, run)
+
+	require.ElementsMatch(t, []Change{
+		{Direction: directionToConsul, Namespace: "ns-1", Action: ActionRegisterInstance, Service: "a_web", Instance: "web_1.1.1.1_80_ns-1_default", Address: "1.1.1.1", Port: 80, Attributes: map[string]string{
+			ConsulSourceKey: ConsulAWSTag,
+			ConsulAWSNS:     "ns-1",
+			ConsulAWSID:     "i-1",
+			DeploymentKey:   DefaultDeploymentID,
+		}},
+		{Direction: directionToConsul, Namespace: "ns-1", Action: ActionDeregisterInstance, Service: "a_db", Instance: "db_2.2.2.2_5432", Address: "2.2.2.2", Port: 5432},
+	}, run.getChanges())
+}
@@ -17,16 +17,45 @@ const (
 	unknown  health = ""
 )
 
+func healthSeverity(h health) int {
+	switch h {
+	case passing:
+		return 0
+	case critical:
+		return 2
+	default:
+		return 1
+	}
+}
+
 type service struct {
-	id           string
-	name         string
-	nodes        map[string]map[int]node
-	healths      map[string]health
-	fromConsul   bool
-	fromAWS      bool
+	id         string
+	name       string
+	nodes      map[string]map[int]node
+	healths    map[string]health
+	fromConsul bool
+	fromAWS    bool
+	// foreign is set on AWS services created from Consul that are owned by
+	// another deployment or have instances of other deployments. They are
+	// never deleted.
+	foreign bool
+	// legacy is set on AWS services created by an older version of
+	// consul-aws that are not adopted. They are left alone: nothing is
+	// registered into them and they are never deleted.
+	legacy       bool
 	awsID        string
 	consulID     string
 	awsNamespace string
+	overrides    overrides
+}
+
+// overrides are the per service settings for creating a service in AWS,
+// read from the Consul service meta.
+type overrides struct {
+	name          string
+	ttl           int64
+	routingPolicy string
+	recordTypes   []string
 }
 
 type node struct {
@@ -34,98 +63,63 @@ type node struct {
 	host       string
 	awsID      string
 	consulID   string
+	tags       []string
 	attributes map[string]string
+	// staleIDs are the IDs of instances at the same host and port that
+	// were registered under an older ID scheme. They are deregistered once
+	// the instance is registered under its current ID.
+	staleIDs []string
 }
 
-func hostPortFromID(checkid string) (string, int) {
-	parts := strings.Split(checkid, "_")
-	l := len(parts)
-	if l >= 2 {
-		host := parts[l-2]
-		portString := parts[l-1]
-		port, _ := strconv.Atoi(portString)
-		return host, port
+// isTrue returns true if the meta or tag value is a true boolean.
+func isTrue(v string) bool {
+	b, err := strconv.ParseBool(v)
+	return err == nil && b
+}
+
+// encodeID joins the parts into an ID that is different for every
+// combination of parts and only uses characters valid in both Consul
+// service IDs and CloudMap instance IDs. The parts are separated by
+// underscores, and any character of a part other than a letter, a digit, a
+// dot, a colon or a dash is escaped as @ followed by its two hex digits, so
+// underscores in names and hostnames and the colons of IPv6 addresses are
+// safe. IDs are never decoded, and CloudMap instance IDs may be hashed by
+// instanceID, so what an ID was made of is always read from the attributes
+// and meta registered with it.
+func encodeID(parts ...string) string {
+	var b strings.Builder
+	for i, part := range parts {
+		if i > 0 {
+			b.WriteByte('_')
+		}
+		for j := 0; j < len(part); j++ {
+			c := part[j]
+			if isIDChar(c) {
+				b.WriteByte(c)
+			} else {
+				fmt.Fprintf(&b, "@%02x", c)
+			}
+		}
 	}
-	return "", 0
+	return b.String()
 }
 
-func id(id, host string, port int) string {
-	return fmt.Sprintf("%s_%s_%d", id, host, port)
+func isIDChar(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '.' || c == ':' || c == '-'
 }
 
-func onlyInFirst(servicesA, servicesB map[string]service) map[string]service {
-	result := map[string]service{}
-	for k, sa := range servicesA {
-		if sb, ok := servicesB[k]; !ok {
-			result[k] = sa
-		} else {
-			nodes := map[string]map[int]node{}
-			for h, nodesa := range sa.nodes {
-				nodesb, ok := sb.nodes[h]
-				if !ok {
-					nodes[h] = nodesa
-					continue
-				}
-				ports := map[int]node{}
-				for p, na := range nodesa {
-					if _, ok = nodesb[p]; !ok {
-						ports[p] = na
-					}
-				}
-				if len(ports) > 0 {
-					nodes[h] = ports
-				}
-			}
-			healths := map[string]health{}
-			for k, ha := range sa.healths {
-				if hb, ok := sb.healths[k]; !ok {
-					healths[k] = ha
-				} else {
-					if ha != hb {
-						healths[k] = ha
-					}
-				}
-			}
-			if len(nodes) == 0 && len(healths) == 0 {
-				continue
-			}
-			id := sa.id
-			if len(id) == 0 {
-				id = sb.id
-			}
-			name := sa.name
-			if len(name) == 0 {
-				name = sb.name
-			}
-			aid := sa.awsID
-			if len(aid) == 0 {
-				aid = sb.awsID
-			}
-			cid := sa.consulID
-			if len(cid) == 0 {
-				cid = sb.consulID
-			}
-			ns := sa.awsNamespace
-			if len(ns) == 0 {
-				ns = sb.awsNamespace
-			}
-			s := service{
-				id:           id,
-				name:         name,
-				awsID:        aid,
-				consulID:     cid,
-				awsNamespace: ns,
-				fromConsul:   sa.fromConsul || sb.fromConsul,
-				fromAWS:      sa.fromAWS || sb.fromAWS,
-			}
-			if len(nodes) > 0 {
-				s.nodes = nodes
-			}
-			if len(healths) > 0 {
-				s.healths = healths
-			}
-			result[k] = s
+// addInstance adds the node n of a service instance to nodes, which have a
+// single node per host and port. When current is set and there is a node
+// already, the one whose ID, as returned by id, is the current ID for the
+// host and port stays, and the ID of the other one is added to its
+// staleIDs. Otherwise the last instance wins.
+func addInstance(nodes map[string]map[int]node, n node, id func(node) string, current func(h string, p int) string) {
+	if other, ok := nodes[n.host][n.port]; ok && current != nil {
+		if id(other) == current(n.host, n.port) {
+			n, other = other, n
 		}
+		stale := append([]string{}, n.staleIDs...)
+		n.staleIDs = append(append(stale, other.staleIDs...), id(other))
 	}
-	return result
+	addNode(nodes, n.host, n.port, n)
 }
@@ -0,0 +1,93 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package catalog
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// snapshot is the state of the services of one side of a sync at one
+// version. Snapshots are immutable: neither the services map nor the maps
+// held by the services are changed once a snapshot is published, so they
+// are read without locks while fetches and syncs publish newer versions.
+type snapshot struct {
+	version  uint64
+	services map[string]service
+}
+
+// state holds the latest snapshot of one side of a sync. Writers publish a
+// new version with copies of what they change, which leaves the snapshots
+// readers hold untouched. The zero value holds an empty snapshot.
+type state struct {
+	// lock serializes the writers, readers don't take it.
+	lock    sync.Mutex
+	current atomic.Pointer[snapshot]
+}
+
+// load returns the latest snapshot.
+func (s *state) load() *snapshot {
+	if current := s.current.Load(); current != nil {
+		return current
+	}
+	return &snapshot{}
+}
+
+// replace publishes the services as the next version. The caller must not
+// change services afterwards.
+func (s *state) replace(services map[string]service) *snapshot {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	next := &snapshot{version: s.load().version + 1, services: services}
+	s.current.Store(next)
+	return next
+}
+
+// addService publishes the next version with the service added, unless a
+// service of that name is known already.
+func (s *state) addService(name string, svc service) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	current := s.load()
+	if _, ok := current.services[name]; ok {
+		return
+	}
+	services := make(map[string]service, len(current.services)+1)
+	for k, v := range current.services {
+		services[k] = v
+	}
+	services[name] = svc
+	s.current.Store(&snapshot{version: current.version + 1, services: services})
+}
+
+// setNode publishes the next version with the node of the service set at
+// host h and port p. If the service is unknown, as it is until the next
+// fetch after its first instance is registered, svc is added with the
+// node.
+func (s *state) setNode(name string, svc service, h string, p int, n node) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	current := s.load()
+	if known, ok := current.services[name]; ok {
+		svc = known
+	}
+	nodes := make(map[string]map[int]node, len(svc.nodes)+1)
+	for host, ports := range svc.nodes {
+		nodes[host] = ports
+	}
+	ports := make(map[int]node, len(nodes[h])+1)
+	for port, pn := range nodes[h] {
+		ports[port] = pn
+	}
+	ports[p] = n
+	nodes[h] = ports
+	svc.nodes = nodes
+
+	services := make(map[string]service, len(current.services))
+	for k, v := range current.services {
+		services[k] = v
+	}
+	services[name] = svc
+	s.current.Store(&snapshot{version: current.version + 1, services: services})
+}
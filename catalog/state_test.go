@@ -0,0 +1,181 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package catalog
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestState(t *testing.T) {
+	s := &state{}
+	empty := s.load()
+	require.Equal(t, uint64(0), empty.version)
+	require.Empty(t, empty.services)
+
+	first := s.replace(map[string]service{"web": {name: "web", nodes: map[string]map[int]node{
+		"10.0.0.1": {80: {host: "10.0.0.1", port: 80}},
+	}}})
+	require.Equal(t, uint64(1), first.version)
+	require.Equal(t, first, s.load())
+
+	// Setting a node publishes a new version and leaves the older one as
+	// it was.
+	s.setNode("web", service{}, "10.0.0.1", 80, node{host: "10.0.0.1", port: 80, awsID: "i-1"})
+	s.setNode("web", service{}, "10.0.0.2", 80, node{host: "10.0.0.2", port: 80})
+	second := s.load()
+	require.Equal(t, uint64(3), second.version)
+	require.Equal(t, "i-1", second.services["web"].nodes["10.0.0.1"][80].awsID)
+	require.Equal(t, "web", second.services["web"].name)
+	require.Len(t, second.services["web"].nodes, 2)
+	require.Empty(t, first.services["web"].nodes["10.0.0.1"][80].awsID)
+	require.Len(t, first.services["web"].nodes, 1)
+
+	// Unknown services are added with the node.
+	s.setNode("db", service{name: "db", fromAWS: true}, "10.0.0.3", 5432, node{host: "10.0.0.3", port: 5432})
+	third := s.load()
+	require.Equal(t, service{name: "db", fromAWS: true, nodes: map[string]map[int]node{
+		"10.0.0.3": {5432: {host: "10.0.0.3", port: 5432}},
+	}}, third.services["db"])
+	require.Len(t, third.services, 2)
+	require.NotContains(t, second.services, "db")
+}
+
+// TestState_Concurrent is meant to be run with -race.
+func TestState_Concurrent(t *testing.T) {
+	s := &state{}
+	s.replace(map[string]service{"web": {name: "web"}})
+
+	// Failures are collected and checked on the test goroutine, since
+	// require must not be called from others.
+	errs := make(chan error, 4)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for p := 0; p < 100; p++ {
+				s.setNode("web", service{name: "web"}, fmt.Sprintf("10.0.0.%d", i), p, node{host: fmt.Sprintf("10.0.0.%d", i), port: p})
+				if p%25 == 0 {
+					s.replace(map[string]service{"web": {name: "web"}})
+				}
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			last := uint64(0)
+			for j := 0; j < 100; j++ {
+				current := s.load()
+				if current.version < last {
+					errs <- fmt.Errorf("version %d after %d", current.version, last)
+					return
+				}
+				last = current.version
+				for _, ports := range current.services["web"].nodes {
+					for p, n := range ports {
+						if p != n.port {
+							errs <- fmt.Errorf("node with port %d at port %d", n.port, p)
+							return
+						}
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	require.Equal(t, uint64(1+4*100+4*4), s.load().version)
+}
+
+// TestState_ConcurrentSync fetches and syncs both directions at the same
+// time, as the goroutines started by Sync do, while services come and go
+// on both sides. It is meant to be run with -race.
+func TestState_ConcurrentSync(t *testing.T) {
+	cloudMap, awsClient := newFakeCloudMap(t)
+	consul, consulClient := newFakeConsul(t)
+	config := Config{
+		ToAWS:        true,
+		ToConsul:     true,
+		Namespaces:   []NamespaceConfig{{ID: fakeNamespaceID}},
+		ConsulPrefix: "consul_",
+		AWSPrefix:    "aws_",
+	}
+	s, err := newSyncer(config, awsClient, consulClient)
+	require.NoError(t, err)
+	aws := s.awsSyncers[0]
+
+	const rounds = 20
+	errs := make(chan error, 2*rounds)
+	var wg sync.WaitGroup
+	wg.Add(5)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			consul.registerService(&api.AgentService{
+				ID:      fmt.Sprintf("web-%d", i),
+				Service: "web",
+				Address: fmt.Sprintf("10.0.0.%d", i+1),
+				Port:    80,
+			}, api.HealthPassing)
+			cloudMap.createService(fmt.Sprintf("api-%d", i), nil, fmt.Sprintf("10.1.0.%d:8080", i+1))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			if _, err := s.consul.fetch(0); err != nil {
+				errs <- err
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			if err := aws.fetch(); err != nil {
+				errs <- err
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			run := newSyncRun(aws.log, directionToAWS, fakeNamespaceID, false)
+			s.consul.syncToAWS(aws, run)
+			run.finish()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			run := newSyncRun(s.consul.log, directionToConsul, fakeNamespaceID, false)
+			aws.syncToConsul(s.consul, run)
+			run.finish()
+		}
+	}()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	s.waitForOperations()
+
+	// Once quiet, a last fetch and run converge both sides.
+	require.NoError(t, s.fetch())
+	for _, summary := range summaries(s.run(false)) {
+		require.Zero(t, summary.Failed, summary)
+	}
+	s.waitForOperations()
+	require.NoError(t, s.fetch())
+	require.Len(t, cloudMap.instances("consul_web"), rounds)
+	for i := 0; i < rounds; i++ {
+		require.Len(t, consul.serviceInstances(fmt.Sprintf("aws_api-%d", i)), 1)
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package catalog
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Status tracks the fetches of Sync so its health can be reported. The zero
+// value is not usable, use NewStatus. It is safe for concurrent use.
+type Status struct {
+	lock    sync.RWMutex
+	fetches map[fetcher]time.Time
+
+	// ha is set once leader election is used, leader is the ID of the
+	// current leader and isLeader is true if that is this process.
+	ha       bool
+	leader   string
+	isLeader bool
+}
+
+type fetcher struct {
+	side      string
+	namespace string
+}
+
+// FetchStatus is the state of one of the fetchers started by Sync. LastFetch
+// is zero until the first successful fetch.
+type FetchStatus struct {
+	Side      string    `json:"side"`
+	Namespace string    `json:"namespace,omitempty"`
+	LastFetch time.Time `json:"last_fetch"`
+}
+
+func NewStatus() *Status {
+	return &Status{fetches: map[fetcher]time.Time{}}
+}
+
+// register adds a fetcher that has to complete a fetch before Sync is
+// ready.
+func (s *Status) register(side, namespace string) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	if _, ok := s.fetches[fetcher{side, namespace}]; !ok {
+		s.fetches[fetcher{side, namespace}] = time.Time{}
+	}
+	s.lock.Unlock()
+}
+
+// fetched records a successful fetch.
+func (s *Status) fetched(side, namespace string) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	s.fetches[fetcher{side, namespace}] = time.Now()
+	s.lock.Unlock()
+}
+
+// reset forgets the fetchers, which are started again when this process
+// becomes the leader again.
+func (s *Status) reset() {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	s.fetches = map[fetcher]time.Time{}
+	s.lock.Unlock()
+}
+
+func (s *Status) setLeader(leader string, isLeader bool) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	s.ha = true
+	s.leader = leader
+	s.isLeader = isLeader
+	s.lock.Unlock()
+}
+
+// observeLeader records the leader seen by a standby and returns true if it
+// changed. Nothing changes once this process is the leader, which it may
+// have become since the leader was read.
+func (s *Status) observeLeader(leader string) bool {
+	if s == nil {
+		return false
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.isLeader || s.leader == leader {
+		return false
+	}
+	s.ha = true
+	s.leader = leader
+	return true
+}
+
+// Leader returns the ID of the current leader and whether this process is
+// the leader. The leader is empty if leader election is not used or no
+// process holds the lock.
+func (s *Status) Leader() (string, bool) {
+	if s == nil {
+		return "", false
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.leader, s.isLeader
+}
+
+// Standby returns true if leader election is used and this process is not
+// the leader.
+func (s *Status) Standby() bool {
+	if s == nil {
+		return false
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.ha && !s.isLeader
+}
+
+// Fetches returns the state of all fetchers, sorted by side and namespace.
+func (s *Status) Fetches() []FetchStatus {
+	if s == nil {
+		return nil
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	result := make([]FetchStatus, 0, len(s.fetches))
+	for f, t := range s.fetches {
+		result = append(result, FetchStatus{Side: f.side, Namespace: f.namespace, LastFetch: t})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Side != result[j].Side {
+			return result[i].Side < result[j].Side
+		}
+		return result[i].Namespace < result[j].Namespace
+	})
+	return result
+}
+
+// Ready returns true once Sync has started its fetchers, all of them
+// completed a fetch, and none of the last successful fetches is older than
+// maxStaleness. Standbys have nothing to fetch and are always ready.
+func (s *Status) Ready(maxStaleness time.Duration) bool {
+	if s.Standby() {
+		return true
+	}
+	fetches := s.Fetches()
+	if len(fetches) == 0 {
+		return false
+	}
+	for _, f := range fetches {
+		if f.LastFetch.IsZero() || time.Since(f.LastFetch) > maxStaleness {
+			return false
+		}
+	}
+	return true
+}
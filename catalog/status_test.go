@@ -0,0 +1,75 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package catalog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusReady(t *testing.T) {
+	s := NewStatus()
+	require.False(t, s.Ready(time.Minute), "no fetchers started")
+
+	s.register(sideConsul, "")
+	s.register(sideAWS, "ns-1")
+	s.fetched(sideConsul, "")
+	require.False(t, s.Ready(time.Minute), "aws has not fetched yet")
+
+	s.fetched(sideAWS, "ns-1")
+	require.True(t, s.Ready(time.Minute))
+
+	s.lock.Lock()
+	s.fetches[fetcher{sideAWS, "ns-1"}] = time.Now().Add(-2 * time.Minute)
+	s.lock.Unlock()
+	require.False(t, s.Ready(time.Minute), "aws fetch is stale")
+
+	fetches := s.Fetches()
+	require.Len(t, fetches, 2)
+	require.Equal(t, sideAWS, fetches[0].Side)
+	require.Equal(t, "ns-1", fetches[0].Namespace)
+	require.Equal(t, sideConsul, fetches[1].Side)
+}
+
+func TestStatusNil(t *testing.T) {
+	var s *Status
+	s.register(sideConsul, "")
+	s.fetched(sideConsul, "")
+	s.setLeader("a", true)
+	s.reset()
+	require.False(t, s.Standby())
+	require.Empty(t, s.Fetches())
+	require.False(t, s.Ready(time.Minute))
+}
+
+func TestStatusStandby(t *testing.T) {
+	s := NewStatus()
+	require.False(t, s.Standby())
+
+	s.setLeader("other", false)
+	require.True(t, s.Standby())
+	require.True(t, s.Ready(time.Minute), "standbys are ready")
+	leader, isLeader := s.Leader()
+	require.Equal(t, "other", leader)
+	require.False(t, isLeader)
+
+	require.True(t, s.observeLeader("next"))
+	require.False(t, s.observeLeader("next"))
+
+	s.setLeader("me", true)
+	require.False(t, s.Standby())
+	require.False(t, s.Ready(time.Minute), "the leader has not fetched yet")
+	// A leader read before acquiring the lock doesn't demote the process.
+	require.False(t, s.observeLeader("me"))
+	require.False(t, s.observeLeader("other"))
+	require.False(t, s.Standby())
+
+	s.register(sideConsul, "")
+	s.fetched(sideConsul, "")
+	require.True(t, s.Ready(time.Minute))
+	s.reset()
+	require.Empty(t, s.Fetches())
+}
@@ -4,104 +4,316 @@
 package catalog
 
 import (
+	"fmt"
 	"time"
 
-	awssd "github.com/aws/aws-sdk-go-v2/service/servicediscovery"
-	"github.com/hashicorp/consul/api"
 	"github.com/hashicorp/go-hclog"
 )
 
-// Sync aws->consul and vice versa.
-func Sync(toAWS, toConsul bool, namespaceID, consulPrefix, awsPrefix, awsPullInterval string, awsDNSTTL int64, stale bool, awsClient *awssd.Client, consulClient *api.Client, stop, stopped chan struct{}) {
+// Config holds the settings of Sync.
+type Config struct {
+	// ToAWS syncs Consul services to AWS.
+	ToAWS bool
+	// ToConsul syncs AWS services to Consul.
+	ToConsul bool
+	// Namespaces are the CloudMap namespaces to sync with. One AWS fetcher
+	// is started for every namespace.
+	Namespaces []NamespaceConfig
+	// ConsulPrefix is prepended to services written to AWS from Consul.
+	ConsulPrefix string
+	// AWSPrefix is prepended to services written to Consul from AWS.
+	AWSPrefix string
+	// AWSPullInterval is the interval between fetching from AWS.
+	AWSPullInterval time.Duration
+	// AWSDNSTTL is the TTL of the DNS records of services created in AWS.
+	AWSDNSTTL int64
+	// Stale allows any Consul server to respond to reads.
+	Stale bool
+	// ToAWSFilter selects the Consul services synced to AWS.
+	ToAWSFilter Filter
+	// ToConsulFilter selects the AWS services synced to Consul.
+	ToConsulFilter Filter
+	// ToAWSOptIn only syncs Consul services to AWS that have the
+	// ConsulOptInMetaKey meta set to true.
+	ToAWSOptIn bool
+	// ToConsulOptIn only syncs AWS services to Consul that are tagged with
+	// AWSOptInTagKey set to true.
+	ToConsulOptIn bool
+	// Status, if set, records the fetches for health checks.
+	Status *Status
+	// DryRun logs the changes that would be made to either side instead of
+	// making them.
+	DryRun bool
+	// LockKey, if set, is the Consul KV key locked by the leader when
+	// running several processes for high availability. Only the leader
+	// syncs, the others wait to take over.
+	LockKey string
+	// LockID identifies this process as the leader.
+	LockID string
+	// AWSMaxConcurrency is the number of AWS mutations made at the same
+	// time. Defaults to DefaultAWSConcurrency.
+	AWSMaxConcurrency int
+	// AWSMaxRequestRate is the maximum number of requests per second made
+	// to AWS. Zero doesn't limit the rate.
+	AWSMaxRequestRate int
+	// DeploymentID tells the CloudMap services of this deployment apart
+	// from the ones of other deployments syncing with the same namespace.
+	// Defaults to DefaultDeploymentID.
+	DeploymentID string
+	// AWSAdoptServices tags the CloudMap services created by older
+	// versions of consul-aws as owned by this deployment. They are left
+	// alone otherwise.
+	AWSAdoptServices bool
+	// RemovalGuard, if set, refuses removals over its limits.
+	RemovalGuard *RemovalGuard
+	// RemovalGracePeriod is how long synced instances must be missing from
+	// their source before they are removed. Zero removes them right away.
+	// It is ignored by SyncOnce, Plan and Apply, which forget the missing
+	// instances when they return.
+	RemovalGracePeriod time.Duration
+}
+
+// Sync aws->consul and vice versa. One AWS fetcher is started for every
+// namespace in config.Namespaces, all of them syncing with the same Consul
+// catalog. With config.LockKey set, Sync waits until it holds the lock before
+// syncing, and goes back to waiting when the lock is lost.
+func Sync(config Config, awsClient CloudMapClient, consulClient ConsulClient, stop, stopped chan struct{}) {
 	defer close(stopped)
-	log := hclog.Default().Named("sync")
-	consul := consul{
-		client:       consulClient,
-		log:          hclog.Default().Named("consul"),
-		trigger:      make(chan bool, 1),
-		consulPrefix: consulPrefix,
-		awsPrefix:    awsPrefix,
-		toAWS:        toAWS,
-		stale:        stale,
+	if len(config.LockKey) == 0 {
+		syncUntil(config, awsClient, consulClient, stop)
+		return
 	}
-	pullInterval, err := time.ParseDuration(awsPullInterval)
+
+	log := hclog.Default().Named("sync")
+	leader, err := newLeader(consulClient, config.LockKey, config.LockID, config.Status)
 	if err != nil {
-		log.Error("cannot parse aws pull interval", "error", err)
+		log.Error("cannot setup leader election", "error", err)
 		return
 	}
-	aws := awsSyncer{
-		client:       awsClient,
-		log:          hclog.Default().Named("awsSyncer"),
-		trigger:      make(chan bool, 1),
-		consulPrefix: consulPrefix,
-		awsPrefix:    awsPrefix,
-		toConsul:     toConsul,
-		pullInterval: pullInterval,
-		dnsTTL:       awsDNSTTL,
+	watchStop := make(chan struct{})
+	watchStopped := make(chan struct{})
+	go leader.watch(watchStop, watchStopped)
+	defer func() {
+		close(watchStop)
+		<-watchStopped
+	}()
+
+	for {
+		lost := leader.acquire(stop)
+		if lost == nil {
+			return
+		}
+		shutdown := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			select {
+			case <-stop:
+			case <-lost:
+				log.Warn("lost leadership, shutting down sync")
+			case <-done:
+			}
+			close(shutdown)
+		}()
+		ok := syncUntil(config, awsClient, consulClient, shutdown)
+		close(done)
+		leader.release()
+		config.Status.reset()
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if !ok {
+			return
+		}
 	}
+}
 
-	err = aws.setupNamespace(namespaceID)
+// syncUntil syncs until stop is closed, in which case it returns true, or a
+// problem stops it.
+func syncUntil(config Config, awsClient CloudMapClient, consulClient ConsulClient, stop chan struct{}) bool {
+	log := hclog.Default().Named("sync")
+	s, err := newSyncer(config, awsClient, consulClient)
 	if err != nil {
-		log.Error("cannot setup namespace", "error", err)
-		return
+		log.Error("cannot start sync", "error", err)
+		return false
 	}
+	consul := s.consul
+	awsSyncers := s.awsSyncers
 
-	fetchConsulStop := make(chan struct{})
-	fetchConsulStopped := make(chan struct{})
-	go consul.fetchIndefinetely(fetchConsulStop, fetchConsulStopped)
-	fetchAWSStop := make(chan struct{})
-	fetchAWSStopped := make(chan struct{})
-	go aws.fetchIndefinetely(fetchAWSStop, fetchAWSStopped)
+	shutdown := make(chan struct{})
+	routines := []routine{}
+	start := func(name string, fn func(stop, stopped chan struct{})) {
+		r := routine{name: name, stopped: make(chan struct{})}
+		routines = append(routines, r)
+		go fn(shutdown, r.stopped)
+	}
 
-	toConsulStop := make(chan struct{})
-	toConsulStopped := make(chan struct{})
-	toAWSStop := make(chan struct{})
-	toAWSStopped := make(chan struct{})
+	config.Status.register(sideConsul, "")
+	start("consul fetch", consul.fetchIndefinetely)
+	for _, aws := range awsSyncers {
+		config.Status.register(sideAWS, *aws.namespace.Id)
+		start("awsSyncer fetch", aws.fetchIndefinetely)
+		start("awsSyncer retry", aws.retryIndefinitely)
+		start("awsSyncer operations", aws.pollOperationsIndefinitely)
+	}
+	for _, aws := range awsSyncers {
+		aws := aws
+		start("consul sync", func(stop, stopped chan struct{}) {
+			aws.sync(consul, stop, stopped)
+		})
+	}
+	start("awsSyncer sync", func(stop, stopped chan struct{}) {
+		consul.sync(awsSyncers, stop, stopped)
+	})
 
-	go aws.sync(&consul, toConsulStop, toConsulStopped)
-	go consul.sync(&aws, toAWSStop, toAWSStopped)
+	exited := make(chan string, len(routines))
+	for _, r := range routines {
+		go func(r routine) {
+			<-r.stopped
+			exited <- r.name
+		}(r)
+	}
 
+	ok := true
 	select {
 	case <-stop:
-		close(toConsulStop)
-		close(toAWSStop)
-		close(fetchConsulStop)
-		close(fetchAWSStop)
-		<-toConsulStopped
-		<-toAWSStopped
-		<-fetchAWSStopped
-		<-fetchConsulStopped
-	case <-fetchAWSStopped:
-		log.Info("problem wit awsSyncer fetch. shutting down...")
-		close(toConsulStop)
-		close(toAWSStop)
-		close(fetchConsulStop)
-		<-toConsulStopped
-		<-toAWSStopped
-		<-fetchConsulStopped
-	case <-fetchConsulStopped:
-		log.Info("problem with consul fetch. shutting down...")
-		close(toConsulStop)
-		close(fetchAWSStop)
-		close(toAWSStop)
-		<-toConsulStopped
-		<-toAWSStopped
-		<-fetchAWSStopped
-	case <-toConsulStopped:
-		log.Info("problem with consul sync. shutting down...")
-		close(fetchConsulStop)
-		close(toAWSStop)
-		close(fetchAWSStop)
-		<-toAWSStopped
-		<-fetchAWSStopped
-		<-fetchConsulStopped
-	case <-toAWSStopped:
-		log.Info("problem with awsSyncer sync. shutting down...")
-		close(toConsulStop)
-		close(fetchConsulStop)
-		close(fetchAWSStop)
-		<-toConsulStopped
-		<-fetchConsulStopped
-		<-fetchAWSStopped
+	case name := <-exited:
+		log.Info("problem with " + name + ". shutting down...")
+		ok = false
 	}
+	close(shutdown)
+	for _, r := range routines {
+		<-r.stopped
+	}
+	return ok
+}
+
+// syncer holds the Consul side and the AWS side of every namespace of a
+// sync.
+type syncer struct {
+	consul     *consul
+	awsSyncers []*awsSyncer
+}
+
+// newSyncer sets up both sides of a sync, which includes looking up and
+// creating the namespaces.
+func newSyncer(config Config, awsClient CloudMapClient, consulClient ConsulClient) (*syncer, error) {
+	toAWSFilter, err := newServiceFilter(config.ToAWSFilter)
+	if err != nil {
+		return nil, fmt.Errorf("invalid to-aws filter: %s", err)
+	}
+	toConsulFilter, err := newServiceFilter(config.ToConsulFilter)
+	if err != nil {
+		return nil, fmt.Errorf("invalid to-consul filter: %s", err)
+	}
+	deploymentID := config.DeploymentID
+	if len(deploymentID) == 0 {
+		deploymentID = DefaultDeploymentID
+	}
+	consul := &consul{
+		client:       consulClient,
+		log:          hclog.Default().Named("consul"),
+		trigger:      make(chan bool, 1),
+		consulPrefix: config.ConsulPrefix,
+		awsPrefix:    config.AWSPrefix,
+		toAWS:        config.ToAWS,
+		stale:        config.Stale,
+		filter:       toAWSFilter,
+		optIn:        config.ToAWSOptIn,
+		status:       config.Status,
+		dryRun:       config.DryRun,
+		deploymentID: deploymentID,
+		adopt:        config.AWSAdoptServices,
+		guard:        config.RemovalGuard,
+	}
+	// The CloudMap rate limits are per account, so all namespaces share
+	// the rate limit and the workers.
+	awsClient = newLimitedCloudMap(awsClient, config.AWSMaxRequestRate)
+	workers := newWorkers(config.AWSMaxConcurrency)
+	awsSyncers := make([]*awsSyncer, 0, len(config.Namespaces))
+	for _, namespace := range config.Namespaces {
+		aws := &awsSyncer{
+			client:       awsClient,
+			log:          hclog.Default().Named("awsSyncer").With("namespace", namespace.String()),
+			trigger:      make(chan bool, 1),
+			consulPrefix: config.ConsulPrefix,
+			awsPrefix:    config.AWSPrefix,
+			toConsul:     config.ToConsul,
+			pullInterval: config.AWSPullInterval,
+			dnsTTL:       config.AWSDNSTTL,
+			filter:       toConsulFilter,
+			optIn:        config.ToConsulOptIn,
+			status:       config.Status,
+			dryRun:       config.DryRun,
+			workers:      workers,
+			retries:      newRetryQueue(),
+			operations:   newOperationTracker(),
+			deploymentID: deploymentID,
+			adopt:        config.AWSAdoptServices,
+			guard:        config.RemovalGuard,
+			owners:       map[string]owner{},
+
+			awsTombstones:    newTombstones(config.RemovalGracePeriod),
+			consulTombstones: newTombstones(config.RemovalGracePeriod),
+		}
+		err = aws.setupNamespace(namespace)
+		if err != nil {
+			return nil, fmt.Errorf("cannot setup namespace %s: %s", namespace.String(), err)
+		}
+		awsSyncers = append(awsSyncers, aws)
+	}
+	return &syncer{consul: consul, awsSyncers: awsSyncers}, nil
+}
+
+// fetch fetches Consul and every namespace once.
+func (s *syncer) fetch() error {
+	if _, err := s.consul.fetch(0); err != nil {
+		return fmt.Errorf("error fetching from consul: %s", err)
+	}
+	for _, aws := range s.awsSyncers {
+		if err := aws.fetch(); err != nil {
+			return fmt.Errorf("error fetching namespace %s: %s", *aws.namespace.Id, err)
+		}
+	}
+	return nil
+}
+
+// run syncs the fetched services once in every enabled direction and
+// returns the runs, one per direction and namespace.
+func (s *syncer) run(dry bool) []*syncRun {
+	runs := []*syncRun{}
+	if s.consul.toAWS {
+		for _, aws := range s.awsSyncers {
+			run := newSyncRun(aws.log, directionToAWS, *aws.namespace.Id, dry)
+			s.consul.syncToAWS(aws, run)
+			run.finish()
+			runs = append(runs, run)
+		}
+	}
+	for _, aws := range s.awsSyncers {
+		if !aws.toConsul {
+			continue
+		}
+		run := newSyncRun(s.consul.log, directionToConsul, *aws.namespace.Id, dry)
+		aws.syncToConsul(s.consul, run)
+		run.finish()
+		runs = append(runs, run)
+	}
+	return runs
+}
+
+// waitForOperations waits for the AWS operations made by the runs, so
+// their failures are counted.
+func (s *syncer) waitForOperations() {
+	for _, aws := range s.awsSyncers {
+		aws.waitForOperations()
+	}
+}
+
+// routine is a goroutine started by Sync which closes stopped when it
+// returns.
+type routine struct {
+	name    string
+	stopped chan struct{}
 }
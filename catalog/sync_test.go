@@ -29,11 +29,6 @@ func TestSync(t *testing.T) {
 	if namespaceID == "" {
 		t.Fatalf("The NAMESPACEID variable must be set.")
 	}
-	runSyncTest(t, namespaceID)
-}
-
-func runSyncTest(t *testing.T, namespaceID string) {
-	// Test Setup
 	config, err := awsconfig.LoadDefaultConfig(context.TODO())
 	if err != nil {
 		t.Fatalf("Error retrieving AWS session: %s", err)
@@ -45,7 +40,19 @@ func runSyncTest(t *testing.T, namespaceID string) {
 	if err != nil {
 		t.Fatalf("Error connecting to Consul agent: %s", err)
 	}
+	runSyncTest(t, awssdClient, NewConsulClient(consulClient), namespaceID, 20*time.Second)
+}
 
+// TestSync_Fake runs the scenario of TestSync against in-process fakes of
+// CloudMap and Consul.
+func TestSync_Fake(t *testing.T) {
+	_, awssdClient := newFakeCloudMap(t)
+	_, consulClient := newFakeConsul(t)
+	runSyncTest(t, awssdClient, consulClient, fakeNamespaceID, 10*time.Second)
+}
+
+func runSyncTest(t *testing.T, awssdClient CloudMapClient, consulClient ConsulClient, namespaceID string, timeout time.Duration) {
+	var err error
 	consulServiceID := "r1"
 	consulServiceName := "redis"
 	awsServiceName := "web"
@@ -67,9 +74,15 @@ func runSyncTest(t *testing.T, namespaceID string) {
 	stop := make(chan struct{})
 	stopped := make(chan struct{})
 	go Sync(
-		true, true, namespaceID,
-		"consul_", "aws_",
-		"1s", 0, true,
+		Config{
+			ToAWS:           true,
+			ToConsul:        true,
+			Namespaces:      []NamespaceConfig{{ID: namespaceID}},
+			ConsulPrefix:    "consul_",
+			AWSPrefix:       "aws_",
+			AWSPullInterval: time.Second,
+			Stale:           true,
+		},
 		awssdClient, consulClient,
 		stop, stopped,
 	)
@@ -91,7 +104,8 @@ func runSyncTest(t *testing.T, namespaceID string) {
 		}
 	}()
 	select {
-	case <-time.After(20 * time.Second):
+	case <-time.After(timeout):
+	case <-all(doneA, doneC):
 	}
 
 	select {
@@ -118,20 +132,52 @@ func runSyncTest(t *testing.T, namespaceID string) {
 		t.Logf("error deleting service in Consul: %s", err)
 	}
 
-	select {
-	case <-time.After((WaitTime * 5) * time.Second):
-	}
-	if err = checkForImportedAWSService(consulClient, "aws_"+awsServiceName, namespaceID, awsServiceID, 1); err == nil {
+	removedA := eventually(timeout, func() bool {
+		return checkForImportedAWSService(consulClient, "aws_"+awsServiceName, namespaceID, awsServiceID, 1) != nil
+	})
+	if !removedA {
 		t.Error("Expected that the imported aws services is deleted")
 	}
-	if err = checkForImportedConsulService(awssdClient, namespaceID, "consul_"+consulServiceName, 1); err == nil {
+	removedC := eventually(timeout, func() bool {
+		return checkForImportedConsulService(awssdClient, namespaceID, "consul_"+consulServiceName, 1) != nil
+	})
+	if !removedC {
 		t.Error("Expected that the imported consul services is deleted")
 	}
 
 	close(stop)
 	<-stopped
 }
-func createServiceInConsul(c *api.Client, id, name string) error {
+
+// all returns a channel that is closed once all the given channels are
+// closed.
+func all(chans ...chan struct{}) chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		for _, c := range chans {
+			<-c
+		}
+		close(done)
+	}()
+	return done
+}
+
+// eventually polls condition until it is true or timeout passed, and
+// returns the last result.
+func eventually(timeout time.Duration, condition func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if condition() {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func createServiceInConsul(c ConsulClient, id, name string) error {
 	reg := api.CatalogRegistration{
 		Node:           ConsulAWSNodeName,
 		Address:        "127.0.0.1",
@@ -150,12 +196,12 @@ func createServiceInConsul(c *api.Client, id, name string) error {
 	return err
 }
 
-func deleteServiceInConsul(c *api.Client, id string) error {
+func deleteServiceInConsul(c ConsulClient, id string) error {
 	_, err := c.Catalog().Deregister(&api.CatalogDeregistration{Node: ConsulAWSNodeName, ServiceID: id}, nil)
 	return err
 }
 
-func createServiceInAWS(a *awssd.Client, namespaceID, name string) (string, error) {
+func createServiceInAWS(a CloudMapClient, namespaceID, name string) (string, error) {
 	ttl := int64(60)
 	input := awssd.CreateServiceInput{
 		Name:        &name,
@@ -175,7 +221,7 @@ func createServiceInAWS(a *awssd.Client, namespaceID, name string) (string, erro
 	return *resp.Service.Id, nil
 }
 
-func createInstanceInAWS(a *awssd.Client, serviceID string) error {
+func createInstanceInAWS(a CloudMapClient, serviceID string) error {
 	_, err := a.RegisterInstance(context.TODO(), &awssd.RegisterInstanceInput{
 		ServiceId:  &serviceID,
 		InstanceId: &serviceID,
@@ -198,12 +244,12 @@ func createInstanceInAWS(a *awssd.Client, serviceID string) error {
 	return err
 }
 
-func deleteInstanceInAWS(a *awssd.Client, id string) error {
+func deleteInstanceInAWS(a CloudMapClient, id string) error {
 	_, err := a.DeregisterInstance(context.TODO(), &awssd.DeregisterInstanceInput{ServiceId: &id, InstanceId: &id})
 	return err
 }
 
-func deleteServiceInAWS(a *awssd.Client, id string) error {
+func deleteServiceInAWS(a CloudMapClient, id string) error {
 	var err error
 	for i := 0; i < 50; i++ {
 		_, err = a.DeleteService(context.TODO(), &awssd.DeleteServiceInput{Id: &id})
@@ -216,7 +262,7 @@ func deleteServiceInAWS(a *awssd.Client, id string) error {
 	return err
 }
 
-func checkForImportedAWSService(c *api.Client, name, namespaceID, serviceID string, repeat int) error {
+func checkForImportedAWSService(c ConsulClient, name, namespaceID, serviceID string, repeat int) error {
 	for i := 0; i < repeat; i++ {
 		services, _, err := c.Catalog().Services(nil)
 		if err == nil {
@@ -258,7 +304,7 @@ func checkForImportedAWSService(c *api.Client, name, namespaceID, serviceID stri
 	return fmt.Errorf("shrug")
 }
 
-func checkForImportedConsulService(a *awssd.Client, namespaceID, name string, repeat int) error {
+func checkForImportedConsulService(a CloudMapClient, namespaceID, name string, repeat int) error {
 	for i := 0; i < repeat; i++ {
 		paginator := awssd.NewListServicesPaginator(a, &awssd.ListServicesInput{
 			Filters: []awssdtypes.ServiceFilter{
@@ -0,0 +1,186 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package catalog
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	awssd "github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+	"github.com/aws/smithy-go"
+	"github.com/hashicorp/go-hclog"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// DefaultAWSConcurrency is the number of AWS mutations made at the same
+	// time unless configured otherwise.
+	DefaultAWSConcurrency = 10
+
+	throttleAttempts  = 6
+	throttleBaseDelay = 100 * time.Millisecond
+	throttleMaxDelay  = 10 * time.Second
+)
+
+// throttled returns true if CloudMap rejected a request because of its rate
+// limits.
+func throttled(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.ErrorCode() {
+	case "ThrottlingException", "RequestLimitExceeded", "TooManyRequestsException":
+		return true
+	}
+	return false
+}
+
+// backoff returns the delay before the given attempt, starting with 0:
+// exponential growth from base capped at max, with full jitter.
+func backoff(attempt int, base, max time.Duration) time.Duration {
+	delay := max
+	if attempt < 32 && base<<attempt < max {
+		delay = base << attempt
+	}
+	return time.Duration(rand.Int63n(int64(delay) + 1))
+}
+
+// limitedCloudMap limits the rate of requests to CloudMap and retries
+// throttled requests with exponential backoff and jitter.
+type limitedCloudMap struct {
+	client  CloudMapClient
+	limiter *rate.Limiter
+	log     hclog.Logger
+}
+
+// newLimitedCloudMap wraps client. A maxRate of 0 doesn't limit the rate.
+func newLimitedCloudMap(client CloudMapClient, maxRate int) *limitedCloudMap {
+	limiter := rate.NewLimiter(rate.Inf, 0)
+	if maxRate > 0 {
+		limiter = rate.NewLimiter(rate.Limit(maxRate), maxRate)
+	}
+	return &limitedCloudMap{
+		client:  client,
+		limiter: limiter,
+		log:     hclog.Default().Named("cloudmap"),
+	}
+}
+
+// call makes a request with fn once the rate allows it, and again after a
+// backoff as long as it is throttled.
+func call[I, O any](c *limitedCloudMap, ctx context.Context, fn func(context.Context, I, ...func(*awssd.Options)) (O, error), in I, optFns []func(*awssd.Options)) (O, error) {
+	for attempt := 0; ; attempt++ {
+		if err := c.limiter.Wait(ctx); err != nil {
+			var zero O
+			return zero, err
+		}
+		out, err := fn(ctx, in, optFns...)
+		if !throttled(err) {
+			return out, err
+		}
+		metricThrottled.Inc()
+		if attempt+1 == throttleAttempts {
+			return out, err
+		}
+		delay := backoff(attempt, throttleBaseDelay, throttleMaxDelay)
+		c.log.Debug("request throttled, backing off", "delay", delay, "error", err)
+		select {
+		case <-ctx.Done():
+			return out, err
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (c *limitedCloudMap) ListNamespaces(ctx context.Context, in *awssd.ListNamespacesInput, optFns ...func(*awssd.Options)) (*awssd.ListNamespacesOutput, error) {
+	return call(c, ctx, c.client.ListNamespaces, in, optFns)
+}
+
+func (c *limitedCloudMap) ListServices(ctx context.Context, in *awssd.ListServicesInput, optFns ...func(*awssd.Options)) (*awssd.ListServicesOutput, error) {
+	return call(c, ctx, c.client.ListServices, in, optFns)
+}
+
+func (c *limitedCloudMap) ListInstances(ctx context.Context, in *awssd.ListInstancesInput, optFns ...func(*awssd.Options)) (*awssd.ListInstancesOutput, error) {
+	return call(c, ctx, c.client.ListInstances, in, optFns)
+}
+
+func (c *limitedCloudMap) GetInstancesHealthStatus(ctx context.Context, in *awssd.GetInstancesHealthStatusInput, optFns ...func(*awssd.Options)) (*awssd.GetInstancesHealthStatusOutput, error) {
+	return call(c, ctx, c.client.GetInstancesHealthStatus, in, optFns)
+}
+
+func (c *limitedCloudMap) GetNamespace(ctx context.Context, in *awssd.GetNamespaceInput, optFns ...func(*awssd.Options)) (*awssd.GetNamespaceOutput, error) {
+	return call(c, ctx, c.client.GetNamespace, in, optFns)
+}
+
+func (c *limitedCloudMap) CreateHttpNamespace(ctx context.Context, in *awssd.CreateHttpNamespaceInput, optFns ...func(*awssd.Options)) (*awssd.CreateHttpNamespaceOutput, error) {
+	return call(c, ctx, c.client.CreateHttpNamespace, in, optFns)
+}
+
+func (c *limitedCloudMap) CreatePrivateDnsNamespace(ctx context.Context, in *awssd.CreatePrivateDnsNamespaceInput, optFns ...func(*awssd.Options)) (*awssd.CreatePrivateDnsNamespaceOutput, error) {
+	return call(c, ctx, c.client.CreatePrivateDnsNamespace, in, optFns)
+}
+
+func (c *limitedCloudMap) GetOperation(ctx context.Context, in *awssd.GetOperationInput, optFns ...func(*awssd.Options)) (*awssd.GetOperationOutput, error) {
+	return call(c, ctx, c.client.GetOperation, in, optFns)
+}
+
+func (c *limitedCloudMap) ListTagsForResource(ctx context.Context, in *awssd.ListTagsForResourceInput, optFns ...func(*awssd.Options)) (*awssd.ListTagsForResourceOutput, error) {
+	return call(c, ctx, c.client.ListTagsForResource, in, optFns)
+}
+
+func (c *limitedCloudMap) TagResource(ctx context.Context, in *awssd.TagResourceInput, optFns ...func(*awssd.Options)) (*awssd.TagResourceOutput, error) {
+	return call(c, ctx, c.client.TagResource, in, optFns)
+}
+
+func (c *limitedCloudMap) CreateService(ctx context.Context, in *awssd.CreateServiceInput, optFns ...func(*awssd.Options)) (*awssd.CreateServiceOutput, error) {
+	return call(c, ctx, c.client.CreateService, in, optFns)
+}
+
+func (c *limitedCloudMap) DeleteService(ctx context.Context, in *awssd.DeleteServiceInput, optFns ...func(*awssd.Options)) (*awssd.DeleteServiceOutput, error) {
+	return call(c, ctx, c.client.DeleteService, in, optFns)
+}
+
+func (c *limitedCloudMap) DiscoverInstances(ctx context.Context, in *awssd.DiscoverInstancesInput, optFns ...func(*awssd.Options)) (*awssd.DiscoverInstancesOutput, error) {
+	return call(c, ctx, c.client.DiscoverInstances, in, optFns)
+}
+
+func (c *limitedCloudMap) RegisterInstance(ctx context.Context, in *awssd.RegisterInstanceInput, optFns ...func(*awssd.Options)) (*awssd.RegisterInstanceOutput, error) {
+	return call(c, ctx, c.client.RegisterInstance, in, optFns)
+}
+
+func (c *limitedCloudMap) DeregisterInstance(ctx context.Context, in *awssd.DeregisterInstanceInput, optFns ...func(*awssd.Options)) (*awssd.DeregisterInstanceOutput, error) {
+	return call(c, ctx, c.client.DeregisterInstance, in, optFns)
+}
+
+func (c *limitedCloudMap) UpdateInstanceCustomHealthStatus(ctx context.Context, in *awssd.UpdateInstanceCustomHealthStatusInput, optFns ...func(*awssd.Options)) (*awssd.UpdateInstanceCustomHealthStatusOutput, error) {
+	return call(c, ctx, c.client.UpdateInstanceCustomHealthStatus, in, optFns)
+}
+
+// workers bounds the number of AWS mutations made at the same time.
+type workers struct {
+	slots chan struct{}
+}
+
+func newWorkers(n int) *workers {
+	if n <= 0 {
+		n = DefaultAWSConcurrency
+	}
+	return &workers{slots: make(chan struct{}, n)}
+}
+
+// run waits for a free worker and runs fn on it. wg is done once fn
+// returned.
+func (w *workers) run(wg *sync.WaitGroup, fn func()) {
+	wg.Add(1)
+	w.slots <- struct{}{}
+	go func() {
+		defer wg.Done()
+		defer func() { <-w.slots }()
+		fn()
+	}()
+}
@@ -0,0 +1,75 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package catalog
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	awssdtypes "github.com/aws/aws-sdk-go-v2/service/servicediscovery/types"
+	"github.com/aws/smithy-go"
+	"github.com/hashicorp/consul/api"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestThrottled(t *testing.T) {
+	require.True(t, throttled(&smithy.GenericAPIError{Code: "ThrottlingException"}))
+	require.True(t, throttled(&awssdtypes.RequestLimitExceeded{}))
+	require.False(t, throttled(&awssdtypes.ServiceNotFound{}))
+	require.False(t, throttled(errors.New("ThrottlingException")))
+	require.False(t, throttled(nil))
+}
+
+func TestBackoff(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		require.LessOrEqual(t, backoff(0, time.Second, time.Minute), time.Second)
+		require.LessOrEqual(t, backoff(3, time.Second, time.Minute), 8*time.Second)
+		require.LessOrEqual(t, backoff(100, time.Second, time.Minute), time.Minute)
+		require.GreaterOrEqual(t, backoff(100, time.Second, time.Minute), time.Duration(0))
+	}
+}
+
+func TestWorkers(t *testing.T) {
+	w := newWorkers(3)
+	var running, max atomic.Int64
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		w.run(&wg, func() {
+			n := running.Add(1)
+			for {
+				m := max.Load()
+				if n <= m || max.CompareAndSwap(m, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			running.Add(-1)
+		})
+	}
+	wg.Wait()
+	require.Equal(t, int64(3), max.Load())
+}
+
+func TestSyncOnce_Throttled(t *testing.T) {
+	cloudMap, awsClient := newFakeCloudMap(t)
+	consul, consulClient := newFakeConsul(t)
+	config := Config{
+		ToAWS:      true,
+		Namespaces: []NamespaceConfig{{ID: fakeNamespaceID}},
+	}
+
+	consul.registerService(&api.AgentService{ID: "web1", Service: "web", Address: "10.0.0.1", Port: 80}, "")
+	cloudMap.throttle("RegisterInstance", 2)
+	throttledBefore := testutil.ToFloat64(metricThrottled)
+
+	summaries, err := SyncOnce(config, awsClient, consulClient)
+	require.NoError(t, err)
+	require.Equal(t, []Summary{{Direction: directionToAWS, Namespace: fakeNamespaceID, Created: 2}}, summaries)
+	require.Len(t, cloudMap.instances("web"), 1)
+	require.Equal(t, 2.0, testutil.ToFloat64(metricThrottled)-throttledBefore)
+}
@@ -0,0 +1,83 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package catalog
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// tombstones delays the removal of synced instances that disappeared from
+// the source. An instance is only removed once it has been missing for the
+// grace period, so a source that briefly loses instances, like a flapping
+// Consul agent or a failed CloudMap discovery, doesn't make every consumer
+// see them go away and come back. It is safe for concurrent use.
+type tombstones struct {
+	grace time.Duration
+
+	lock sync.Mutex
+	// missing holds when the instances were first missing, by service,
+	// host and port.
+	missing map[string]time.Time
+}
+
+func newTombstones(grace time.Duration) *tombstones {
+	return &tombstones{grace: grace, missing: map[string]time.Time{}}
+}
+
+func tombstoneKey(name, host string, port int) string {
+	return fmt.Sprintf("%s/%s/%d", name, host, port)
+}
+
+// expired returns the instances to remove that have been missing for the
+// grace period. Instances missing for the first time are tracked from now
+// on, and the ones that are no longer to remove are forgotten. Only the
+// services selected by synced are delayed, the others and services without
+// instances are returned as they are.
+func (t *tombstones) expired(remove map[string]service, synced func(service) bool, now time.Time) map[string]service {
+	if t.grace <= 0 {
+		return remove
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	result := map[string]service{}
+	missing := map[string]time.Time{}
+	for k, s := range remove {
+		if !synced(s) || len(s.nodes) == 0 {
+			result[k] = s
+			continue
+		}
+		nodes := map[string]map[int]node{}
+		for h, ports := range s.nodes {
+			for p, n := range ports {
+				key := tombstoneKey(k, h, p)
+				since, ok := t.missing[key]
+				if !ok {
+					since = now
+				}
+				missing[key] = since
+				if now.Sub(since) < t.grace {
+					continue
+				}
+				if nodes[h] == nil {
+					nodes[h] = map[int]node{}
+				}
+				nodes[h][p] = n
+			}
+		}
+		if len(nodes) > 0 {
+			s.nodes = nodes
+			result[k] = s
+		}
+	}
+	t.missing = missing
+	return result
+}
+
+func (t *tombstones) len() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.missing)
+}
@@ -0,0 +1,99 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package catalog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTombstones(t *testing.T) {
+	synced := func(s service) bool { return s.fromAWS }
+	remove := map[string]service{
+		"web": {name: "web", fromAWS: true, nodes: map[string]map[int]node{
+			"10.0.0.1": {80: {host: "10.0.0.1", port: 80}},
+			"10.0.0.2": {80: {host: "10.0.0.2", port: 80}},
+		}},
+		"db": {name: "db", nodes: map[string]map[int]node{
+			"10.0.0.3": {5432: {host: "10.0.0.3", port: 5432}},
+		}},
+	}
+	now := time.Now()
+
+	require.Equal(t, remove, newTombstones(0).expired(remove, synced, now))
+
+	tombstones := newTombstones(time.Minute)
+	// Services that aren't synced are returned right away.
+	require.Equal(t, map[string]service{"db": remove["db"]}, tombstones.expired(remove, synced, now))
+	require.Equal(t, 2, tombstones.len())
+
+	// An instance that came back is forgotten.
+	web := remove["web"]
+	web.nodes = map[string]map[int]node{"10.0.0.1": web.nodes["10.0.0.1"]}
+	require.Empty(t, tombstones.expired(map[string]service{"web": web}, synced, now.Add(30*time.Second)))
+	require.Equal(t, 1, tombstones.len())
+
+	// Instances missing past the grace period are removed, and kept until
+	// they are no longer to remove.
+	require.Equal(t, map[string]service{"web": web, "db": remove["db"]}, tombstones.expired(remove, synced, now.Add(time.Minute)))
+	require.Equal(t, map[string]service{"web": web}, tombstones.expired(map[string]service{"web": web}, synced, now.Add(time.Minute)))
+	require.Empty(t, tombstones.expired(map[string]service{}, synced, now.Add(time.Minute)))
+	require.Equal(t, 0, tombstones.len())
+}
+
+func TestTombstones_Sync(t *testing.T) {
+	cloudMap, awsClient := newFakeCloudMap(t)
+	consul, consulClient := newFakeConsul(t)
+	config := Config{
+		ToConsul:           true,
+		Namespaces:         []NamespaceConfig{{ID: fakeNamespaceID}},
+		RemovalGracePeriod: time.Hour,
+	}
+	awsID := cloudMap.createService("api", nil, "10.1.0.1:8080")
+
+	s, err := newSyncer(config, awsClient, consulClient)
+	require.NoError(t, err)
+	require.NoError(t, s.fetch())
+	require.Equal(t, []Summary{{Direction: directionToConsul, Namespace: fakeNamespaceID, Created: 1}}, summaries(s.run(false)))
+
+	// The instance is kept in Consul during the grace period.
+	cloudMap.deleteService(awsID)
+	require.NoError(t, s.fetch())
+	require.Equal(t, []Summary{{Direction: directionToConsul, Namespace: fakeNamespaceID}}, summaries(s.run(false)))
+	require.Len(t, consul.serviceInstances("api"), 1)
+	aws := s.awsSyncers[0]
+	require.Equal(t, 1, aws.consulTombstones.len())
+
+	aws.consulTombstones.grace = 0
+	require.Equal(t, []Summary{{Direction: directionToConsul, Namespace: fakeNamespaceID, Removed: 1}}, summaries(s.run(false)))
+	require.Empty(t, consul.serviceInstances("api"))
+}
+
+// TestTombstones_SyncOnce checks that the grace period is ignored when
+// syncing once, since the tombstones would be forgotten on return and the
+// instance never removed.
+func TestTombstones_SyncOnce(t *testing.T) {
+	cloudMap, awsClient := newFakeCloudMap(t)
+	consul, consulClient := newFakeConsul(t)
+	config := Config{
+		ToConsul:           true,
+		Namespaces:         []NamespaceConfig{{ID: fakeNamespaceID}},
+		RemovalGracePeriod: time.Hour,
+	}
+	awsID := cloudMap.createService("api", nil, "10.1.0.1:8080")
+	_, err := SyncOnce(config, awsClient, consulClient)
+	require.NoError(t, err)
+	require.Len(t, consul.serviceInstances("api"), 1)
+
+	cloudMap.deleteService(awsID)
+	changes, err := Plan(config, awsClient, consulClient)
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+	summaries, err := Apply(config, awsClient, consulClient, changes)
+	require.NoError(t, err)
+	require.Equal(t, []Summary{{Direction: directionToConsul, Namespace: fakeNamespaceID, Removed: 1}}, summaries)
+	require.Empty(t, consul.serviceInstances("api"))
+}
@@ -24,6 +24,22 @@ func init() {
 			return &cmdSyncCatalog.Command{UI: ui}, nil
 		},
 
+		"sync-once": func() (cli.Command, error) {
+			return &cmdSyncCatalog.OnceCommand{UI: ui}, nil
+		},
+
+		"plan": func() (cli.Command, error) {
+			return &cmdSyncCatalog.PlanCommand{UI: ui}, nil
+		},
+
+		"apply": func() (cli.Command, error) {
+			return &cmdSyncCatalog.ApplyCommand{UI: ui}, nil
+		},
+
+		"purge": func() (cli.Command, error) {
+			return &cmdSyncCatalog.PurgeCommand{UI: ui}, nil
+		},
+
 		"version": func() (cli.Command, error) {
 			return &cmdVersion.Command{UI: ui, Version: version.GetHumanVersion(), GitCommit: version.GitCommit}, nil
 		},
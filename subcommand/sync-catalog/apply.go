@@ -0,0 +1,121 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package synccatalog
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/mitchellh/cli"
+
+	"github.com/hashicorp/consul-aws/catalog"
+	"github.com/hashicorp/consul-aws/internal/flags"
+)
+
+// ApplyCommand is the command for making the changes of a plan.
+type ApplyCommand struct {
+	UI cli.Ui
+	syncFlags
+
+	flagPlan string
+
+	once sync.Once
+	help string
+}
+
+func (c *ApplyCommand) init() {
+	c.syncFlags.init()
+	c.flags.StringVar(&c.flagPlan, "plan", "",
+		"The path of the plan written by \"consul-aws plan\". Required.")
+	c.help = flags.Usage(applyHelp, c.flags)
+}
+
+func (c *ApplyCommand) Run(args []string) int {
+	c.once.Do(c.init)
+	if err := c.flags.Parse(args); err != nil {
+		return 1
+	}
+	if len(c.flags.Args()) > 0 {
+		c.UI.Error("Should have no non-flag arguments.")
+		return 1
+	}
+	if len(c.flagPlan) == 0 {
+		c.UI.Error("Please provide -plan")
+		return 1
+	}
+	plan, err := readPlanFile(c.flagPlan)
+	if err != nil {
+		c.UI.Error(fmt.Sprintf("Error reading plan: %s", err))
+		return 1
+	}
+	settings, err := c.settings(c.UI)
+	if err != nil {
+		c.UI.Error(fmt.Sprintf("Invalid configuration: %s", err))
+		return 1
+	}
+	awsClient, consulClient, err := c.clients()
+	if err != nil {
+		c.UI.Error(err.Error())
+		return 1
+	}
+
+	warnSyncOnce(c.UI, settings)
+	summaries, err := catalog.Apply(settings.catalogConfig(), awsClient, consulClient, plan.Changes)
+	if errors.Is(err, catalog.ErrDrift) {
+		c.UI.Error(fmt.Sprintf("Refusing to apply the plan from %s: %s. Please run \"consul-aws plan\" again.",
+			plan.CreatedAt.Format("2006-01-02 15:04:05 MST"), err))
+		return 1
+	}
+	if err != nil {
+		c.UI.Error(fmt.Sprintf("Error applying: %s", err))
+		return 1
+	}
+	c.UI.Output(formatSummaries(summaries))
+	if failed(summaries) {
+		return 1
+	}
+	return 0
+}
+
+// formatSummaries renders the outcome of every direction and namespace.
+func formatSummaries(summaries []catalog.Summary) string {
+	out := ""
+	for _, s := range summaries {
+		out += fmt.Sprintf("%s %s: %d created, %d updated, %d removed, %d failed",
+			s.Direction, s.Namespace, s.Created, s.Updated, s.Removed, s.Failed)
+		if s.Blocked > 0 {
+			out += fmt.Sprintf(", %d removals refused", s.Blocked)
+		}
+		out += "\n"
+	}
+	return out
+}
+
+func failed(summaries []catalog.Summary) bool {
+	for _, s := range summaries {
+		if s.Failed > 0 || s.Blocked > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *ApplyCommand) Synopsis() string { return applySynopsis }
+func (c *ApplyCommand) Help() string {
+	c.once.Do(c.init)
+	return c.help
+}
+
+const applySynopsis = "Make the changes of a plan."
+const applyHelp = `
+Usage: consul-aws apply -plan=<file> [options]
+
+  Make the changes of a plan written by "consul-aws plan". The options have
+  to be the same as when the plan was made. AWS services and Consul services
+  are fetched again, and nothing is changed unless the changes needed to sync
+  them are still exactly the changes of the plan. The removal grace period
+  is ignored, like by "consul-aws plan".
+
+`
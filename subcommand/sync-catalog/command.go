@@ -4,73 +4,69 @@
 package synccatalog
 
 import (
-	"flag"
 	"fmt"
 	"os"
 	"os/signal"
 	"sync"
+	"time"
 
-	sd "github.com/aws/aws-sdk-go-v2/service/servicediscovery"
 	"github.com/mitchellh/cli"
 
 	"github.com/hashicorp/consul-aws/internal/flags"
 
 	"github.com/hashicorp/consul-aws/catalog"
-	"github.com/hashicorp/consul-aws/subcommand"
 )
 
-const DefaultPollInterval = "30s"
+const DefaultPollInterval = 30 * time.Second
 
 // Command is the command for syncing the A
 type Command struct {
 	UI cli.Ui
-
-	flags                         *flag.FlagSet
-	http                          *flags.HTTPFlags
-	flagToConsul                  bool
-	flagToAWS                     bool
-	flagAWSNamespaceID            string
-	flagAWSServicePrefix          string
-	flagAWSDeprecatedPullInterval string
-	flagAWSPollInterval           string
-	flagAWSDNSTTL                 int64
-	flagConsulServicePrefix       string
-	flagConsulDomain              string
+	syncFlags
 
 	once sync.Once
 	help string
 }
 
 func (c *Command) init() {
-	c.flags = flag.NewFlagSet("", flag.ContinueOnError)
-	c.flags.BoolVar(&c.flagToConsul, "to-consul", false,
-		"If true, AWS services will be synced to Consul. (Defaults to false)")
-	c.flags.BoolVar(&c.flagToAWS, "to-aws", false,
-		"If true, Consul services will be synced to AWS. (Defaults to false)")
-	c.flags.StringVar(&c.flagAWSNamespaceID, "aws-namespace-id",
-		"", "The AWS namespace to sync with Consul services.")
-	c.flags.StringVar(&c.flagAWSServicePrefix, "aws-service-prefix",
-		"", "A prefix to prepend to all services written to AWS from Consul. "+
-			"If this is not set then services will have no prefix.")
-	c.flags.StringVar(&c.flagConsulServicePrefix, "consul-service-prefix",
-		"", "A prefix to prepend to all services written to Consul from AWS. "+
-			"If this is not set then services will have no prefix.")
-	c.flags.StringVar(&c.flagAWSDeprecatedPullInterval, "aws-pull-interval",
-		DefaultPollInterval, "[DEPRECATED] The interval between fetching from AWS CloudMap. "+
-			"Accepts a sequence of decimal numbers, each with optional "+
-			"fraction and a unit suffix, such as \"300ms\", \"10s\", \"1.5m\". "+
-			"Defaults to 30s)")
-	c.flags.StringVar(&c.flagAWSPollInterval, "aws-poll-interval",
-		DefaultPollInterval, "The interval between fetching from AWS CloudMap. "+
-			"Accepts a sequence of decimal numbers, each with optional "+
-			"fraction and a unit suffix, such as \"300ms\", \"10s\", \"1.5m\". "+
-			"Defaults to 30s)")
-	c.flags.Int64Var(&c.flagAWSDNSTTL, "aws-dns-ttl",
-		60, "DNS TTL for services created in AWS CloudMap in seconds. (Defaults to 60)")
-
-	c.http = &flags.HTTPFlags{}
-	flags.Merge(c.flags, c.http.ClientFlags())
-	flags.Merge(c.flags, c.http.ServerFlags())
+	c.syncFlags.init()
+	c.flags.Var(&c.flagConfig.DryRun, "dry-run",
+		"If true, the changes that would be made to Consul and AWS are logged "+
+			"instead of being made. (Defaults to false)")
+	c.initRemovalFlags()
+	c.flags.Var(&c.flagConfig.RemovalConfirmRuns, "removal-confirm-runs",
+		"The number of sync runs in a row removals over -max-removals or "+
+			"-max-removal-percent are refused before they are made anyway. "+
+			"(Defaults to 0, only made once confirmed with a POST to "+
+			"/removals/confirm, see -removal-confirm-token)")
+	c.flags.Var(&c.flagConfig.RemovalConfirmToken, "removal-confirm-token",
+		"The token a POST to /removals/confirm on the -listen-addr listener "+
+			"must send as \"Authorization: Bearer <token>\" to confirm refused "+
+			"removals. Anyone who can reach the listener with the token can "+
+			"confirm them, so prefer setting it in a configuration file. If "+
+			"this is not set, /removals/confirm is not served.")
+	c.flags.Var(&c.flagConfig.RemovalGracePeriod, "removal-grace-period",
+		"How long synced instances must be missing from Consul or AWS CloudMap "+
+			"before they are removed from the other side, so instances that "+
+			"briefly disappear aren't removed and registered again. "+
+			"(Defaults to 0, removed right away)")
+	c.flags.Var(&c.flagConfig.LockKey, "lock-key",
+		"A Consul KV key to lock before syncing, for running several processes "+
+			"for high availability. Only the process holding the lock syncs, "+
+			"the others wait and take over when it is lost. If this is not set, "+
+			"the process syncs right away.")
+	c.flags.Var(&c.flagConfig.LockID, "lock-id",
+		"The ID this process is known by when holding the lock. (Defaults to "+
+			"the hostname)")
+	c.flags.Var(&c.flagConfig.ListenAddr, "listen-addr",
+		"The address to serve Prometheus metrics on /metrics, the health "+
+			"checks on /health/live and /health/ready and the refused removals "+
+			"on /removals from, like \":9090\". "+
+			"Nothing is served if this is not set.")
+	c.flags.Var(&c.flagConfig.ReadyMaxStaleness, "ready-max-staleness",
+		"How old the last successful fetch from Consul and from every AWS "+
+			"namespace may be for /health/ready to report ready. (Defaults to "+
+			"three times the longer of -aws-poll-interval and the Consul wait time)")
 	c.help = flags.Usage(help, c.flags)
 }
 
@@ -83,35 +79,33 @@ func (c *Command) Run(args []string) int {
 		c.UI.Error("Should have no non-flag arguments.")
 		return 1
 	}
-	if len(c.flagAWSNamespaceID) == 0 {
-		c.UI.Error("Please provide -aws-namespace-id.")
-		return 1
-	}
-	config, err := subcommand.AWSConfig()
+	settings, err := c.settings(c.UI)
 	if err != nil {
-		c.UI.Error(fmt.Sprintf("Error retrieving AWS session: %s", err))
+		c.UI.Error(fmt.Sprintf("Invalid configuration: %s", err))
 		return 1
 	}
-	awsClient := sd.NewFromConfig(config)
-
-	consulClient, err := c.http.APIClient()
+	awsClient, consulClient, err := c.clients()
 	if err != nil {
-		c.UI.Error(fmt.Sprintf("Error connecting to Consul agent: %s", err))
+		c.UI.Error(err.Error())
 		return 1
 	}
 
-	pollInterval := c.flagAWSPollInterval
-	if pollInterval == DefaultPollInterval && c.flagAWSDeprecatedPullInterval != DefaultPollInterval {
-		c.UI.Info("Please use -aws-poll-interval instead of the deprecated -aws-pull-interval")
-		pollInterval = c.flagAWSDeprecatedPullInterval
+	status := catalog.NewStatus()
+	syncConfig := settings.catalogConfig()
+	syncConfig.Status = status
+	if len(settings.ListenAddr) > 0 {
+		server, err := c.listen(settings.ListenAddr, status, syncConfig.RemovalGuard, settings.readyMaxStaleness(), settings.RemovalConfirmToken)
+		if err != nil {
+			c.UI.Error(fmt.Sprintf("Error listening on %s: %s", settings.ListenAddr, err))
+			return 1
+		}
+		defer server.Close()
 	}
 
 	stop := make(chan struct{})
 	stopped := make(chan struct{})
 	go catalog.Sync(
-		c.flagToAWS, c.flagToConsul, c.flagAWSNamespaceID,
-		c.flagConsulServicePrefix, c.flagAWSServicePrefix,
-		pollInterval, c.flagAWSDNSTTL, c.getStaleWithDefaultTrue(),
+		syncConfig,
 		awsClient, consulClient,
 		stop, stopped,
 	)
@@ -130,17 +124,6 @@ func (c *Command) Run(args []string) int {
 	return 0
 }
 
-func (c *Command) getStaleWithDefaultTrue() bool {
-	stale := true
-	c.flags.Visit(func(f *flag.Flag) {
-		if f.Name == "stale" {
-			stale = c.http.Stale()
-			return
-		}
-	})
-	return stale
-}
-
 func (c *Command) Synopsis() string { return synopsis }
 func (c *Command) Help() string {
 	c.once.Do(c.init)
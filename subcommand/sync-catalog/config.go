@@ -0,0 +1,347 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package synccatalog
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"github.com/hashicorp/hcl"
+	"github.com/mitchellh/mapstructure"
+
+	"github.com/hashicorp/consul-aws/catalog"
+	"github.com/hashicorp/consul-aws/internal/flags"
+)
+
+// Config is the configuration of sync-catalog as read from HCL or JSON
+// configuration files. The command line flags are bound to a Config as well.
+// Every field knows whether it has been set, so configuration files and flags
+// can be merged on top of the defaults in order, with flags winning.
+type Config struct {
+	ToConsul            flags.BoolValue     `mapstructure:"to_consul"`
+	ToAWS               flags.BoolValue     `mapstructure:"to_aws"`
+	AWSNamespaceIDs     []string            `mapstructure:"aws_namespace_ids"`
+	AWSNamespaceNames   []string            `mapstructure:"aws_namespace_names"`
+	AWSCreateNamespace  flags.BoolValue     `mapstructure:"aws_create_namespace"`
+	AWSNamespaceType    flags.StringValue   `mapstructure:"aws_namespace_type"`
+	AWSNamespaceVPC     flags.StringValue   `mapstructure:"aws_namespace_vpc"`
+	AWSServicePrefix    flags.StringValue   `mapstructure:"aws_service_prefix"`
+	AWSPollInterval     flags.DurationValue `mapstructure:"aws_poll_interval"`
+	AWSDNSTTL           flags.UintValue     `mapstructure:"aws_dns_ttl"`
+	AWSMaxConcurrency   flags.UintValue     `mapstructure:"aws_max_concurrency"`
+	AWSMaxRequestRate   flags.UintValue     `mapstructure:"aws_max_request_rate"`
+	ConsulServicePrefix flags.StringValue   `mapstructure:"consul_service_prefix"`
+	Stale               flags.BoolValue     `mapstructure:"stale"`
+	ToAWSInclude        []string            `mapstructure:"to_aws_include"`
+	ToAWSExclude        []string            `mapstructure:"to_aws_exclude"`
+	ToAWSIncludeTags    []string            `mapstructure:"to_aws_include_tags"`
+	ToAWSExcludeTags    []string            `mapstructure:"to_aws_exclude_tags"`
+	ToConsulInclude     []string            `mapstructure:"to_consul_include"`
+	ToConsulExclude     []string            `mapstructure:"to_consul_exclude"`
+	ToAWSOptIn          flags.BoolValue     `mapstructure:"to_aws_opt_in"`
+	ToConsulOptIn       flags.BoolValue     `mapstructure:"to_consul_opt_in"`
+	ListenAddr          flags.StringValue   `mapstructure:"listen_addr"`
+	ReadyMaxStaleness   flags.DurationValue `mapstructure:"ready_max_staleness"`
+	DryRun              flags.BoolValue     `mapstructure:"dry_run"`
+	LockKey             flags.StringValue   `mapstructure:"lock_key"`
+	LockID              flags.StringValue   `mapstructure:"lock_id"`
+	DeploymentID        flags.StringValue   `mapstructure:"deployment_id"`
+	AWSAdoptServices    flags.BoolValue     `mapstructure:"aws_adopt_services"`
+	MaxRemovals         flags.UintValue     `mapstructure:"max_removals"`
+	MaxRemovalPercent   flags.UintValue     `mapstructure:"max_removal_percent"`
+	RemovalConfirmRuns  flags.UintValue     `mapstructure:"removal_confirm_runs"`
+	RemovalConfirmToken flags.StringValue   `mapstructure:"removal_confirm_token"`
+	RemovalGracePeriod  flags.DurationValue `mapstructure:"removal_grace_period"`
+}
+
+// settings are the values sync-catalog runs with.
+type settings struct {
+	ToConsul            bool
+	ToAWS               bool
+	AWSNamespaceIDs     []string
+	AWSNamespaceNames   []string
+	AWSCreateNamespace  bool
+	AWSNamespaceType    string
+	AWSNamespaceVPC     string
+	AWSServicePrefix    string
+	AWSPollInterval     time.Duration
+	AWSDNSTTL           uint
+	AWSMaxConcurrency   uint
+	AWSMaxRequestRate   uint
+	ConsulServicePrefix string
+	Stale               bool
+	ToAWSFilter         catalog.Filter
+	ToConsulFilter      catalog.Filter
+	ToAWSOptIn          bool
+	ToConsulOptIn       bool
+	ListenAddr          string
+	ReadyMaxStaleness   time.Duration
+	DryRun              bool
+	LockKey             string
+	LockID              string
+	DeploymentID        string
+	AWSAdoptServices    bool
+	MaxRemovals         uint
+	MaxRemovalPercent   uint
+	RemovalConfirmRuns  uint
+	RemovalConfirmToken string
+	RemovalGracePeriod  time.Duration
+}
+
+func defaultSettings() settings {
+	return settings{
+		AWSNamespaceType:  catalog.NamespaceTypeHTTP,
+		AWSPollInterval:   DefaultPollInterval,
+		AWSDNSTTL:         60,
+		AWSMaxConcurrency: catalog.DefaultAWSConcurrency,
+		Stale:             true,
+		DeploymentID:      catalog.DefaultDeploymentID,
+	}
+}
+
+// merge overlays all values that have been set in c onto s.
+func (c *Config) merge(s *settings) {
+	c.ToConsul.Merge(&s.ToConsul)
+	c.ToAWS.Merge(&s.ToAWS)
+	mergeSlice(c.AWSNamespaceIDs, &s.AWSNamespaceIDs)
+	mergeSlice(c.AWSNamespaceNames, &s.AWSNamespaceNames)
+	c.AWSCreateNamespace.Merge(&s.AWSCreateNamespace)
+	c.AWSNamespaceType.Merge(&s.AWSNamespaceType)
+	c.AWSNamespaceVPC.Merge(&s.AWSNamespaceVPC)
+	c.AWSServicePrefix.Merge(&s.AWSServicePrefix)
+	c.AWSPollInterval.Merge(&s.AWSPollInterval)
+	c.AWSDNSTTL.Merge(&s.AWSDNSTTL)
+	c.AWSMaxConcurrency.Merge(&s.AWSMaxConcurrency)
+	c.AWSMaxRequestRate.Merge(&s.AWSMaxRequestRate)
+	c.ConsulServicePrefix.Merge(&s.ConsulServicePrefix)
+	c.Stale.Merge(&s.Stale)
+	mergeSlice(c.ToAWSInclude, &s.ToAWSFilter.Include)
+	mergeSlice(c.ToAWSExclude, &s.ToAWSFilter.Exclude)
+	mergeSlice(c.ToAWSIncludeTags, &s.ToAWSFilter.IncludeTags)
+	mergeSlice(c.ToAWSExcludeTags, &s.ToAWSFilter.ExcludeTags)
+	mergeSlice(c.ToConsulInclude, &s.ToConsulFilter.Include)
+	mergeSlice(c.ToConsulExclude, &s.ToConsulFilter.Exclude)
+	c.ToAWSOptIn.Merge(&s.ToAWSOptIn)
+	c.ToConsulOptIn.Merge(&s.ToConsulOptIn)
+	c.ListenAddr.Merge(&s.ListenAddr)
+	c.ReadyMaxStaleness.Merge(&s.ReadyMaxStaleness)
+	c.DryRun.Merge(&s.DryRun)
+	c.LockKey.Merge(&s.LockKey)
+	c.LockID.Merge(&s.LockID)
+	c.DeploymentID.Merge(&s.DeploymentID)
+	c.AWSAdoptServices.Merge(&s.AWSAdoptServices)
+	c.MaxRemovals.Merge(&s.MaxRemovals)
+	c.MaxRemovalPercent.Merge(&s.MaxRemovalPercent)
+	c.RemovalConfirmRuns.Merge(&s.RemovalConfirmRuns)
+	c.RemovalConfirmToken.Merge(&s.RemovalConfirmToken)
+	c.RemovalGracePeriod.Merge(&s.RemovalGracePeriod)
+}
+
+// mergeSlice overlays v onto the given slice if it isn't empty.
+func mergeSlice(v []string, onto *[]string) {
+	if len(v) > 0 {
+		*onto = v
+	}
+}
+
+func (s *settings) validate() error {
+	if len(s.AWSNamespaceIDs) == 0 && len(s.AWSNamespaceNames) == 0 {
+		return fmt.Errorf("please provide -aws-namespace-id or -aws-namespace-name")
+	}
+	switch s.AWSNamespaceType {
+	case catalog.NamespaceTypeHTTP:
+	case catalog.NamespaceTypeDNSPrivate:
+		if s.AWSCreateNamespace && len(s.AWSNamespaceVPC) == 0 {
+			return fmt.Errorf("please provide -aws-namespace-vpc to create dns-private namespaces")
+		}
+	default:
+		return fmt.Errorf("unknown namespace type %q", s.AWSNamespaceType)
+	}
+	if s.AWSPollInterval <= 0 {
+		return fmt.Errorf("the aws poll interval must be positive")
+	}
+	if s.AWSMaxConcurrency == 0 {
+		return fmt.Errorf("the aws max concurrency must be positive")
+	}
+	if len(s.DeploymentID) == 0 {
+		return fmt.Errorf("the deployment id must not be empty")
+	}
+	if s.MaxRemovalPercent > 100 {
+		return fmt.Errorf("the max removal percent must not be over 100")
+	}
+	if s.RemovalGracePeriod < 0 {
+		return fmt.Errorf("the removal grace period must not be negative")
+	}
+	if s.ReadyMaxStaleness < 0 {
+		return fmt.Errorf("the ready max staleness must not be negative")
+	}
+	if err := s.ToAWSFilter.Validate(); err != nil {
+		return fmt.Errorf("invalid to-aws filter: %s", err)
+	}
+	if err := s.ToConsulFilter.Validate(); err != nil {
+		return fmt.Errorf("invalid to-consul filter: %s", err)
+	}
+	return nil
+}
+
+func (s *settings) catalogConfig() catalog.Config {
+	return catalog.Config{
+		ToAWS:              s.ToAWS,
+		ToConsul:           s.ToConsul,
+		Namespaces:         s.namespaces(),
+		ConsulPrefix:       s.ConsulServicePrefix,
+		AWSPrefix:          s.AWSServicePrefix,
+		AWSPullInterval:    s.AWSPollInterval,
+		AWSDNSTTL:          int64(s.AWSDNSTTL),
+		Stale:              s.Stale,
+		ToAWSFilter:        s.ToAWSFilter,
+		ToConsulFilter:     s.ToConsulFilter,
+		ToAWSOptIn:         s.ToAWSOptIn,
+		ToConsulOptIn:      s.ToConsulOptIn,
+		DryRun:             s.DryRun,
+		LockKey:            s.LockKey,
+		LockID:             s.lockID(),
+		AWSMaxConcurrency:  int(s.AWSMaxConcurrency),
+		AWSMaxRequestRate:  int(s.AWSMaxRequestRate),
+		DeploymentID:       s.DeploymentID,
+		AWSAdoptServices:   s.AWSAdoptServices,
+		RemovalGuard:       s.removalGuard(),
+		RemovalGracePeriod: s.RemovalGracePeriod,
+	}
+}
+
+// removalGuard returns the guard refusing removals over the configured
+// limits, or nil if no limit is configured.
+func (s *settings) removalGuard() *catalog.RemovalGuard {
+	if s.MaxRemovals == 0 && s.MaxRemovalPercent == 0 {
+		return nil
+	}
+	return catalog.NewRemovalGuard(int(s.MaxRemovals), int(s.MaxRemovalPercent), int(s.RemovalConfirmRuns))
+}
+
+// lockID returns the configured lock ID, or the hostname.
+func (s *settings) lockID() string {
+	if len(s.LockID) > 0 {
+		return s.LockID
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		return hostname
+	}
+	return fmt.Sprintf("consul-aws-%d", os.Getpid())
+}
+
+// readyMaxStaleness returns how old the last successful fetches may be for
+// sync-catalog to be ready. Unless configured, it is three times the longer
+// of the AWS poll interval and the Consul blocking query wait time.
+func (s *settings) readyMaxStaleness() time.Duration {
+	if s.ReadyMaxStaleness > 0 {
+		return s.ReadyMaxStaleness
+	}
+	interval := s.AWSPollInterval
+	if wait := catalog.WaitTime * time.Second; wait > interval {
+		interval = wait
+	}
+	return 3 * interval
+}
+
+func (s *settings) namespaces() []catalog.NamespaceConfig {
+	namespaces := []catalog.NamespaceConfig{}
+	for _, id := range s.AWSNamespaceIDs {
+		namespaces = append(namespaces, catalog.NamespaceConfig{ID: id})
+	}
+	for _, name := range s.AWSNamespaceNames {
+		namespaces = append(namespaces, catalog.NamespaceConfig{
+			Name:   name,
+			Create: s.AWSCreateNamespace,
+			Type:   s.AWSNamespaceType,
+			VPC:    s.AWSNamespaceVPC,
+		})
+	}
+	return namespaces
+}
+
+// loadConfigFiles reads the given configuration files and directories in
+// order. Only files ending in .hcl or .json are read from directories.
+func loadConfigFiles(paths []string) ([]*Config, error) {
+	configs := []*Config{}
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %q: %v", path, err)
+		}
+		isDir := fi.IsDir()
+		err = flags.Visit(path, func(path string) error {
+			if isDir {
+				switch filepath.Ext(path) {
+				case ".hcl", ".json":
+				default:
+					return nil
+				}
+			}
+			config, err := decodeConfigFile(path)
+			if err != nil {
+				return err
+			}
+			configs = append(configs, config)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return configs, nil
+}
+
+// decodeConfigFile decodes a single HCL or JSON configuration file. Unknown
+// keys are an error.
+func decodeConfigFile(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]interface{}
+	if err := hcl.Decode(&raw, string(data)); err != nil {
+		return nil, err
+	}
+
+	var config Config
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook:  mapstructure.ComposeDecodeHookFunc(flags.ConfigDecodeHook, intToUintValueFunc()),
+		ErrorUnused: true,
+		Result:      &config,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := decoder.Decode(raw); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// intToUintValueFunc is a mapstructure hook that looks for an incoming int
+// mapped to a UintValue. HCL decodes numbers without a fraction as int while
+// flags.ConfigDecodeHook only handles the float64 numbers decoded from JSON.
+func intToUintValueFunc() mapstructure.DecodeHookFunc {
+	return func(
+		f reflect.Type,
+		t reflect.Type,
+		data interface{}) (interface{}, error) {
+		if f.Kind() != reflect.Int {
+			return data, nil
+		}
+
+		val := flags.UintValue{}
+		if t != reflect.TypeOf(val) {
+			return data, nil
+		}
+		if err := val.Set(fmt.Sprintf("%d", data)); err != nil {
+			return nil, err
+		}
+		return val, nil
+	}
+}
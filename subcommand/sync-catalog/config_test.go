@@ -0,0 +1,115 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package synccatalog
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/cli"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfigFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestDecodeConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	hclPath := writeConfigFile(t, dir, "config.hcl", `
+to_aws = true
+aws_namespace_ids = ["ns-1", "ns-2"]
+aws_poll_interval = "10s"
+aws_dns_ttl = 30
+consul_service_prefix = "aws_"
+aws_max_request_rate = 20
+max_removal_percent = 25
+`)
+	jsonPath := writeConfigFile(t, dir, "config.json", `{
+  "to_consul": true,
+  "aws_namespace_names": ["prod"],
+  "aws_dns_ttl": 90
+}`)
+
+	s := defaultSettings()
+	for _, path := range []string{hclPath, jsonPath} {
+		config, err := decodeConfigFile(path)
+		require.NoError(t, err)
+		config.merge(&s)
+	}
+
+	expected := defaultSettings()
+	expected.ToAWS = true
+	expected.ToConsul = true
+	expected.AWSNamespaceIDs = []string{"ns-1", "ns-2"}
+	expected.AWSNamespaceNames = []string{"prod"}
+	expected.AWSPollInterval = 10 * time.Second
+	expected.AWSDNSTTL = 90
+	expected.ConsulServicePrefix = "aws_"
+	expected.AWSMaxRequestRate = 20
+	expected.MaxRemovalPercent = 25
+	require.Equal(t, expected, s)
+}
+
+func TestDecodeConfigFile_UnknownKey(t *testing.T) {
+	path := writeConfigFile(t, t.TempDir(), "config.hcl", `to_aws = true
+aws_namespace = "ns-1"`)
+	_, err := decodeConfigFile(path)
+	require.Error(t, err)
+}
+
+func TestLoadConfigFiles_Dir(t *testing.T) {
+	dir := t.TempDir()
+	writeConfigFile(t, dir, "b.json", `{"aws_service_prefix": "b_"}`)
+	writeConfigFile(t, dir, "a.hcl", `aws_service_prefix = "a_"`)
+	writeConfigFile(t, dir, "README.md", `not a config file`)
+
+	configs, err := loadConfigFiles([]string{dir})
+	require.NoError(t, err)
+	require.Len(t, configs, 2)
+
+	s := defaultSettings()
+	for _, config := range configs {
+		config.merge(&s)
+	}
+	require.Equal(t, "b_", s.AWSServicePrefix)
+}
+
+func TestCommandSettings_FlagsOverrideConfigFile(t *testing.T) {
+	path := writeConfigFile(t, t.TempDir(), "config.hcl", `
+to_aws = true
+to_consul = true
+aws_namespace_ids = ["ns-1"]
+aws_service_prefix = "file_"
+stale = false
+`)
+	c := &Command{UI: cli.NewMockUi()}
+	c.once.Do(c.init)
+	require.NoError(t, c.flags.Parse([]string{
+		"-config-file", path,
+		"-to-consul=false",
+		"-aws-namespace-id", "ns-2",
+		"-aws-service-prefix", "flag_",
+	}))
+
+	s, err := c.settings(c.UI)
+	require.NoError(t, err)
+	require.True(t, s.ToAWS)
+	require.False(t, s.ToConsul)
+	require.Equal(t, []string{"ns-2"}, s.AWSNamespaceIDs)
+	require.Equal(t, "flag_", s.AWSServicePrefix)
+	require.False(t, s.Stale)
+}
+
+func TestCommandSettings_Validate(t *testing.T) {
+	c := &Command{UI: cli.NewMockUi()}
+	c.once.Do(c.init)
+	require.NoError(t, c.flags.Parse([]string{"-to-aws"}))
+	_, err := c.settings(c.UI)
+	require.Error(t, err)
+}
@@ -0,0 +1,94 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package synccatalog
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/hashicorp/consul-aws/catalog"
+)
+
+// listen starts serving the metrics, health checks and refused removals on
+// addr. The server runs until it is closed.
+func (c *Command) listen(addr string, status *catalog.Status, guard *catalog.RemovalGuard, maxStaleness time.Duration, confirmToken string) (*http.Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{Handler: c.handler(status, guard, maxStaleness, confirmToken)}
+	go func() {
+		if err := server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			c.UI.Error(fmt.Sprintf("Error serving HTTP: %s", err))
+		}
+	}()
+	return server, nil
+}
+
+// readyResponse is the body of /health/ready.
+type readyResponse struct {
+	Ready   bool                  `json:"ready"`
+	Leader  string                `json:"leader,omitempty"`
+	Standby bool                  `json:"standby,omitempty"`
+	Fetches []catalog.FetchStatus `json:"fetches"`
+}
+
+// confirmResponse is the body of /removals/confirm.
+type confirmResponse struct {
+	Confirmed int `json:"confirmed"`
+}
+
+// handler serves /removals/confirm only with a confirmToken, since it makes
+// removals the guard refused and the listener is usually reachable by
+// anything that scrapes metrics or probes health.
+func (c *Command) handler(status *catalog.Status, guard *catalog.RemovalGuard, maxStaleness time.Duration, confirmToken string) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/health/live", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/health/ready", func(w http.ResponseWriter, r *http.Request) {
+		leader, _ := status.Leader()
+		resp := readyResponse{
+			Ready:   status.Ready(maxStaleness),
+			Leader:  leader,
+			Standby: status.Standby(),
+			Fetches: status.Fetches(),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if !resp.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(resp)
+	})
+	mux.HandleFunc("/removals", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(guard.Blocked())
+	})
+	if len(confirmToken) == 0 {
+		return mux
+	}
+	mux.HandleFunc("/removals/confirm", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		expected := []byte("Bearer " + confirmToken)
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(confirmResponse{Confirmed: guard.Confirm()})
+	})
+	return mux
+}
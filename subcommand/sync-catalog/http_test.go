@@ -0,0 +1,117 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package synccatalog
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/cli"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hashicorp/consul-aws/catalog"
+)
+
+func TestHandler_Health(t *testing.T) {
+	c := &Command{UI: cli.NewMockUi()}
+	status := catalog.NewStatus()
+	server := httptest.NewServer(c.handler(status, nil, time.Minute, ""))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/health/live")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = http.Get(server.URL + "/health/ready")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	var ready readyResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&ready))
+	require.False(t, ready.Ready)
+
+	resp, err = http.Get(server.URL + "/metrics")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestHandler_Removals(t *testing.T) {
+	c := &Command{UI: cli.NewMockUi()}
+	guard := catalog.NewRemovalGuard(1, 0, 0)
+	server := httptest.NewServer(c.handler(catalog.NewStatus(), guard, time.Minute, "secret"))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/removals")
+	require.NoError(t, err)
+	var blocked []catalog.BlockedRemoval
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&blocked))
+	resp.Body.Close()
+	require.Empty(t, blocked)
+
+	resp, err = http.Get(server.URL + "/removals/confirm")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	resp, err = http.Post(server.URL+"/removals/confirm", "", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp, err = confirm(server.URL, "wrong")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp, err = confirm(server.URL, "secret")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var confirmed confirmResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&confirmed))
+	require.Equal(t, 0, confirmed.Confirmed)
+}
+
+func TestHandler_RemovalsConfirmDisabled(t *testing.T) {
+	c := &Command{UI: cli.NewMockUi()}
+	guard := catalog.NewRemovalGuard(1, 0, 0)
+	server := httptest.NewServer(c.handler(catalog.NewStatus(), guard, time.Minute, ""))
+	defer server.Close()
+
+	resp, err := confirm(server.URL, "")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+// confirm confirms the refused removals with the given token.
+func confirm(url, token string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, url+"/removals/confirm", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return http.DefaultClient.Do(req)
+}
+
+func TestSettingsRemovalGuard(t *testing.T) {
+	s := defaultSettings()
+	require.Nil(t, s.removalGuard())
+	s.MaxRemovalPercent = 50
+	require.NotNil(t, s.removalGuard())
+}
+
+func TestSettingsReadyMaxStaleness(t *testing.T) {
+	s := defaultSettings()
+	require.Equal(t, 90*time.Second, s.readyMaxStaleness())
+	s.AWSPollInterval = time.Second
+	require.Equal(t, 30*time.Second, s.readyMaxStaleness())
+	s.ReadyMaxStaleness = 5 * time.Minute
+	require.Equal(t, 5*time.Minute, s.readyMaxStaleness())
+}
@@ -0,0 +1,85 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package synccatalog
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/mitchellh/cli"
+
+	"github.com/hashicorp/consul-aws/catalog"
+	"github.com/hashicorp/consul-aws/internal/flags"
+)
+
+// OnceCommand is the command for syncing AWS and Consul once.
+type OnceCommand struct {
+	UI cli.Ui
+	syncFlags
+
+	once sync.Once
+	help string
+}
+
+func (c *OnceCommand) init() {
+	c.syncFlags.init()
+	c.flags.Var(&c.flagConfig.DryRun, "dry-run",
+		"If true, the changes that would be made to Consul and AWS are logged "+
+			"instead of being made. (Defaults to false)")
+	c.initRemovalFlags()
+	c.help = flags.Usage(onceHelp, c.flags)
+}
+
+func (c *OnceCommand) Run(args []string) int {
+	c.once.Do(c.init)
+	if err := c.flags.Parse(args); err != nil {
+		return 1
+	}
+	if len(c.flags.Args()) > 0 {
+		c.UI.Error("Should have no non-flag arguments.")
+		return 1
+	}
+	settings, err := c.settings(c.UI)
+	if err != nil {
+		c.UI.Error(fmt.Sprintf("Invalid configuration: %s", err))
+		return 1
+	}
+	awsClient, consulClient, err := c.clients()
+	if err != nil {
+		c.UI.Error(err.Error())
+		return 1
+	}
+
+	warnSyncOnce(c.UI, settings)
+	summaries, err := catalog.SyncOnce(settings.catalogConfig(), awsClient, consulClient)
+	if err != nil {
+		c.UI.Error(fmt.Sprintf("Error syncing: %s", err))
+		return 1
+	}
+	c.UI.Output(formatSummaries(summaries))
+	if failed(summaries) {
+		return 1
+	}
+	return 0
+}
+
+func (c *OnceCommand) Synopsis() string { return onceSynopsis }
+func (c *OnceCommand) Help() string {
+	c.once.Do(c.init)
+	return c.help
+}
+
+const onceSynopsis = "Sync AWS services and Consul services once."
+const onceHelp = `
+Usage: consul-aws sync-once [options]
+
+  Fetch AWS services and Consul services once, sync them in the enabled
+  directions, print how many services and instances were created, removed
+  or failed, and exit. The exit code is 1 if any operation failed or any
+  removal was refused for being over the limits, which makes this suitable
+  for scheduled jobs. Accepts the same options as sync-catalog, except the
+  removal grace period, which is ignored: instances missing from their
+  source are removed right away.
+
+`
@@ -0,0 +1,27 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package synccatalog
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/hashicorp/consul-aws/catalog"
+)
+
+func TestFormatSummaries(t *testing.T) {
+	summaries := []catalog.Summary{
+		{Direction: "to-aws", Namespace: "ns-1", Created: 3, Removed: 1},
+		{Direction: "to-consul", Namespace: "ns-1", Created: 2, Failed: 1},
+	}
+	require.Equal(t, "to-aws ns-1: 3 created, 0 updated, 1 removed, 0 failed\n"+
+		"to-consul ns-1: 2 created, 0 updated, 0 removed, 1 failed\n", formatSummaries(summaries))
+	require.True(t, failed(summaries))
+	require.False(t, failed(summaries[:1]))
+
+	summaries = []catalog.Summary{{Direction: "to-consul", Namespace: "ns-1", Blocked: 4}}
+	require.Equal(t, "to-consul ns-1: 0 created, 0 updated, 0 removed, 0 failed, 4 removals refused\n", formatSummaries(summaries))
+	require.True(t, failed(summaries))
+}
@@ -0,0 +1,173 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package synccatalog
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/cli"
+
+	"github.com/hashicorp/consul-aws/catalog"
+	"github.com/hashicorp/consul-aws/internal/flags"
+)
+
+const planFileVersion = 2
+
+// planFile is the plan written by plan and executed by apply.
+type planFile struct {
+	Version   int              `json:"version"`
+	CreatedAt time.Time        `json:"created_at"`
+	Changes   []catalog.Change `json:"changes"`
+}
+
+func writePlanFile(path string, changes []catalog.Change) error {
+	data, err := json.MarshalIndent(planFile{
+		Version:   planFileVersion,
+		CreatedAt: time.Now().UTC(),
+		Changes:   changes,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+func readPlanFile(path string) (*planFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var plan planFile
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return nil, fmt.Errorf("error decoding %s: %s", path, err)
+	}
+	if plan.Version != planFileVersion {
+		return nil, fmt.Errorf("unsupported plan version %d", plan.Version)
+	}
+	return &plan, nil
+}
+
+// formatPlan renders the changes as a diff grouped by direction and
+// namespace.
+func formatPlan(changes []catalog.Change) string {
+	if len(changes) == 0 {
+		return "No changes. Consul and AWS are in sync.\n"
+	}
+	var b strings.Builder
+	var group string
+	created, removed, updated := 0, 0, 0
+	for _, c := range changes {
+		if g := c.Direction + " " + c.Namespace; g != group {
+			if len(group) > 0 {
+				b.WriteString("\n")
+			}
+			group = g
+			fmt.Fprintf(&b, "%s:\n", g)
+		}
+		symbol := "+"
+		switch c.Action {
+		case catalog.ActionDeleteService, catalog.ActionDeregisterInstance:
+			symbol = "-"
+			removed++
+		case catalog.ActionUpdateInstance, catalog.ActionRekeyInstance, catalog.ActionUpdateHealth, catalog.ActionClearHealth:
+			symbol = "~"
+			updated++
+		default:
+			created++
+		}
+		fmt.Fprintf(&b, "  %s %s %s", symbol, c.Action, c.Service)
+		if len(c.Instance) > 0 {
+			fmt.Fprintf(&b, " %s", c.Instance)
+		}
+		if len(c.Address) > 0 {
+			fmt.Fprintf(&b, " %s:%d", c.Address, c.Port)
+		}
+		if len(c.Health) > 0 {
+			fmt.Fprintf(&b, " %s", c.Health)
+		}
+		b.WriteString("\n")
+	}
+	fmt.Fprintf(&b, "\nPlan: %d to create, %d to remove, %d to update.\n", created, removed, updated)
+	return b.String()
+}
+
+// PlanCommand is the command for planning the changes of a sync.
+type PlanCommand struct {
+	UI cli.Ui
+	syncFlags
+
+	flagOut string
+
+	once sync.Once
+	help string
+}
+
+func (c *PlanCommand) init() {
+	c.syncFlags.init()
+	c.flags.StringVar(&c.flagOut, "out", "",
+		"The path to write the plan to. Required.")
+	c.help = flags.Usage(planHelp, c.flags)
+}
+
+func (c *PlanCommand) Run(args []string) int {
+	c.once.Do(c.init)
+	if err := c.flags.Parse(args); err != nil {
+		return 1
+	}
+	if len(c.flags.Args()) > 0 {
+		c.UI.Error("Should have no non-flag arguments.")
+		return 1
+	}
+	if len(c.flagOut) == 0 {
+		c.UI.Error("Please provide -out")
+		return 1
+	}
+	settings, err := c.settings(c.UI)
+	if err != nil {
+		c.UI.Error(fmt.Sprintf("Invalid configuration: %s", err))
+		return 1
+	}
+	awsClient, consulClient, err := c.clients()
+	if err != nil {
+		c.UI.Error(err.Error())
+		return 1
+	}
+
+	warnSyncOnce(c.UI, settings)
+	changes, err := catalog.Plan(settings.catalogConfig(), awsClient, consulClient)
+	if err != nil {
+		c.UI.Error(fmt.Sprintf("Error planning: %s", err))
+		return 1
+	}
+	if err := writePlanFile(c.flagOut, changes); err != nil {
+		c.UI.Error(fmt.Sprintf("Error writing plan: %s", err))
+		return 1
+	}
+	c.UI.Output(formatPlan(changes))
+	c.UI.Output(fmt.Sprintf("Saved the plan to %s. Run \"consul-aws apply -plan=%s\" with the same options to make these changes.", c.flagOut, c.flagOut))
+	return 0
+}
+
+func (c *PlanCommand) Synopsis() string { return planSynopsis }
+func (c *PlanCommand) Help() string {
+	c.once.Do(c.init)
+	return c.help
+}
+
+const planSynopsis = "Plan the changes syncing AWS services and Consul services would make."
+const planHelp = `
+Usage: consul-aws plan -out=<file> [options]
+
+  Fetch AWS services and Consul services once, print the changes a sync
+  with the same options would make and save them to a plan file, which can
+  be reviewed and executed with "consul-aws apply". The removal grace
+  period is ignored: instances missing from their source are removed right
+  away.
+
+`
@@ -0,0 +1,59 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package synccatalog
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/mitchellh/cli"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hashicorp/consul-aws/catalog"
+)
+
+func TestFormatPlan(t *testing.T) {
+	require.Equal(t, "No changes. Consul and AWS are in sync.\n", formatPlan(nil))
+
+	changes := []catalog.Change{
+		{Direction: "to-aws", Namespace: "ns-1", Action: catalog.ActionCreateService, Service: "web"},
+		{Direction: "to-aws", Namespace: "ns-1", Action: catalog.ActionRegisterInstance, Service: "web", Address: "1.1.1.1", Port: 80},
+		{Direction: "to-consul", Namespace: "ns-1", Action: catalog.ActionDeregisterInstance, Service: "db", Instance: "db_2.2.2.2_5432", Address: "2.2.2.2", Port: 5432},
+		{Direction: "to-consul", Namespace: "ns-1", Action: catalog.ActionUpdateHealth, Service: "api", Instance: "api_3.3.3.3_80", Health: "critical"},
+	}
+	expected := `to-aws ns-1:
+  + create-service web
+  + register-instance web 1.1.1.1:80
+
+to-consul ns-1:
+  - deregister-instance db db_2.2.2.2_5432 2.2.2.2:5432
+  ~ update-health api api_3.3.3.3_80 critical
+
+Plan: 2 to create, 1 to remove, 1 to update.
+`
+	require.Equal(t, expected, formatPlan(changes))
+}
+
+func TestPlanFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plan.json")
+	changes := []catalog.Change{
+		{Direction: "to-aws", Namespace: "ns-1", Action: catalog.ActionCreateService, Service: "web"},
+		{Direction: "to-aws", Namespace: "ns-1", Action: catalog.ActionRegisterInstance, Service: "web", Instance: "1.1.1.1_80_default", Address: "1.1.1.1", Port: 80, Attributes: map[string]string{"version": "1"}},
+	}
+	require.NoError(t, writePlanFile(path, changes))
+	plan, err := readPlanFile(path)
+	require.NoError(t, err)
+	require.Equal(t, changes, plan.Changes)
+
+	writeConfigFile(t, filepath.Dir(path), "plan.json", `{"version": 1, "changes": []}`)
+	_, err = readPlanFile(path)
+	require.Error(t, err)
+}
+
+func TestApplyCommand_RequiresPlan(t *testing.T) {
+	ui := cli.NewMockUi()
+	c := &ApplyCommand{UI: ui}
+	require.Equal(t, 1, c.Run([]string{"-aws-namespace-id", "ns-1", "-to-aws"}))
+	require.Contains(t, ui.ErrorWriter.String(), "-plan")
+}
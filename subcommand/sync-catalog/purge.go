@@ -0,0 +1,142 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package synccatalog
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/mitchellh/cli"
+
+	"github.com/hashicorp/consul-aws/catalog"
+	"github.com/hashicorp/consul-aws/internal/flags"
+)
+
+// PurgeCommand is the command for removing everything consul-aws created.
+type PurgeCommand struct {
+	UI cli.Ui
+	syncFlags
+
+	flagYes bool
+
+	once sync.Once
+	help string
+}
+
+func (c *PurgeCommand) init() {
+	c.syncFlags.init()
+	c.flags.BoolVar(&c.flagYes, "yes", false,
+		"If true, the services are removed without asking for confirmation.")
+	c.help = flags.Usage(purgeHelp, c.flags)
+}
+
+func (c *PurgeCommand) Run(args []string) int {
+	c.once.Do(c.init)
+	if err := c.flags.Parse(args); err != nil {
+		return 1
+	}
+	if len(c.flags.Args()) > 0 {
+		c.UI.Error("Should have no non-flag arguments.")
+		return 1
+	}
+	settings, err := c.settings(c.UI)
+	if err != nil {
+		c.UI.Error(fmt.Sprintf("Invalid configuration: %s", err))
+		return 1
+	}
+	awsClient, consulClient, err := c.clients()
+	if err != nil {
+		c.UI.Error(err.Error())
+		return 1
+	}
+
+	config := settings.catalogConfig()
+	owned, err := catalog.ListOwned(config, awsClient, consulClient)
+	if err != nil {
+		c.UI.Error(fmt.Sprintf("Error listing services: %s", err))
+		return 1
+	}
+	if len(owned) == 0 {
+		c.UI.Output("Nothing to purge.")
+		return 0
+	}
+	c.UI.Output(formatOwned(owned))
+	if !c.flagYes && !c.confirm() {
+		c.UI.Output("Purge cancelled.")
+		return 1
+	}
+
+	removed, failed, err := catalog.Purge(config, awsClient, consulClient, owned)
+	if err != nil {
+		c.UI.Error(fmt.Sprintf("Error purging: %s", err))
+		return 1
+	}
+	c.UI.Output(fmt.Sprintf("%d removed, %d failed", removed, failed))
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// confirm asks the user to type "yes".
+func (c *PurgeCommand) confirm() bool {
+	answer, err := c.UI.Ask("Do you want to remove these services? Only 'yes' will be accepted:")
+	if err != nil {
+		c.UI.Error(fmt.Sprintf("Error asking for confirmation: %s", err))
+		return false
+	}
+	return strings.TrimSpace(answer) == "yes"
+}
+
+// formatOwned renders the services that purge removes, one per line with
+// their instances.
+func formatOwned(owned []catalog.OwnedService) string {
+	out := "The following services will be removed:\n"
+	for _, o := range owned {
+		where := o.Side
+		if len(o.Namespace) > 0 {
+			where += " " + o.Namespace
+		}
+		notes := ""
+		if o.Legacy {
+			notes += ", legacy"
+		}
+		if o.Shared {
+			notes += ", service kept for other deployments"
+		}
+		out += fmt.Sprintf("  - %s: %s (%d instances%s)\n", where, o.Name, len(o.Instances), notes)
+		for _, i := range o.Instances {
+			out += fmt.Sprintf("      %s\n", i)
+		}
+	}
+	return out
+}
+
+func (c *PurgeCommand) Synopsis() string { return purgeSynopsis }
+func (c *PurgeCommand) Help() string {
+	c.once.Do(c.init)
+	return c.help
+}
+
+const purgeSynopsis = "Remove all services created by consul-aws."
+const purgeHelp = `
+Usage: consul-aws purge [options]
+
+  Remove the services consul-aws created: the CloudMap services in the
+  namespaces created from Consul services, and the services imported from
+  AWS into Consul on the consul-aws node. CloudMap instances are deregistered
+  before their service is deleted. Services consul-aws did not create are
+  never touched.
+
+  Legacy services, created by versions of consul-aws without deployments
+  and not yet adopted by any, are removed too and listed as legacy: the
+  CloudMap services marked by their description and the services imported
+  into Consul without a deployment.
+
+  The services are listed before anything is removed, and the removal has
+  to be confirmed unless -yes is given. Accepts the same options as
+  sync-catalog, which select the namespaces to purge.
+
+`
@@ -0,0 +1,42 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package synccatalog
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mitchellh/cli"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hashicorp/consul-aws/catalog"
+)
+
+func TestFormatOwned(t *testing.T) {
+	owned := []catalog.OwnedService{
+		{Side: "aws", Namespace: "ns-1", Name: "web", ID: "srv-1", Instances: []string{"i-1", "i-2"}},
+		{Side: "aws", Namespace: "ns-1", Name: "api", ID: "srv-2", Instances: []string{"i-3"}, Shared: true},
+		{Side: "consul", Name: "db", Instances: []string{"db_1"}},
+		{Side: "consul", Name: "db", Instances: []string{"db_2"}, Legacy: true},
+	}
+	require.Equal(t, "The following services will be removed:\n"+
+		"  - aws ns-1: web (2 instances)\n"+
+		"      i-1\n"+
+		"      i-2\n"+
+		"  - aws ns-1: api (1 instances, service kept for other deployments)\n"+
+		"      i-3\n"+
+		"  - consul: db (1 instances)\n"+
+		"      db_1\n"+
+		"  - consul: db (1 instances, legacy)\n"+
+		"      db_2\n", formatOwned(owned))
+}
+
+func TestPurgeCommand_Confirm(t *testing.T) {
+	for answer, expected := range map[string]bool{"yes": true, "y": false, "": false, "no": false} {
+		ui := cli.NewMockUi()
+		ui.InputReader = strings.NewReader(answer + "\n")
+		c := &PurgeCommand{UI: ui}
+		require.Equal(t, expected, c.confirm(), answer)
+	}
+}
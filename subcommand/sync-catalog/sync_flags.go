@@ -0,0 +1,215 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package synccatalog
+
+import (
+	"flag"
+	"fmt"
+
+	sd "github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+	"github.com/mitchellh/cli"
+
+	"github.com/hashicorp/consul-aws/internal/flags"
+
+	"github.com/hashicorp/consul-aws/catalog"
+	"github.com/hashicorp/consul-aws/subcommand"
+)
+
+// syncFlags are the flags shared by the commands syncing Consul and AWS.
+type syncFlags struct {
+	flags                         *flag.FlagSet
+	http                          *flags.HTTPFlags
+	flagConfig                    Config
+	flagConfigFiles               flags.AppendSliceValue
+	flagAWSNamespaceIDs           flags.AppendSliceValue
+	flagAWSNamespaceNames         flags.AppendSliceValue
+	flagAWSDeprecatedPullInterval flags.DurationValue
+	flagToAWSInclude              flags.AppendSliceValue
+	flagToAWSExclude              flags.AppendSliceValue
+	flagToAWSIncludeTags          flags.AppendSliceValue
+	flagToAWSExcludeTags          flags.AppendSliceValue
+	flagToConsulInclude           flags.AppendSliceValue
+	flagToConsulExclude           flags.AppendSliceValue
+}
+
+// init creates the flag set with the shared flags. Commands add their own
+// flags to it afterwards.
+func (f *syncFlags) init() {
+	f.flags = flag.NewFlagSet("", flag.ContinueOnError)
+	f.flags.Var(&f.flagConfigFiles, "config-file",
+		"Path to an HCL or JSON configuration file. Can be specified multiple "+
+			"times, files are loaded in order. Flags take precedence over the "+
+			"values from configuration files.")
+	f.flags.Var(&f.flagConfigFiles, "config-dir",
+		"Path to a directory of HCL or JSON configuration files. Files ending "+
+			"in .hcl or .json are loaded in alphabetical order. Can be specified "+
+			"multiple times.")
+	f.flags.Var(&f.flagConfig.ToConsul, "to-consul",
+		"If true, AWS services will be synced to Consul. (Defaults to false)")
+	f.flags.Var(&f.flagConfig.ToAWS, "to-aws",
+		"If true, Consul services will be synced to AWS. (Defaults to false)")
+	f.flags.Var(&f.flagAWSNamespaceIDs, "aws-namespace-id",
+		"The AWS namespace to sync with Consul services. Can be specified "+
+			"multiple times to sync several namespaces from a single process.")
+	f.flags.Var(&f.flagAWSNamespaceNames, "aws-namespace-name",
+		"The name of an AWS namespace to sync with Consul services. The namespace "+
+			"is looked up by name on startup, so the configuration stays valid when "+
+			"the namespace is recreated. Can be specified multiple times.")
+	f.flags.Var(&f.flagConfig.AWSCreateNamespace, "aws-create-namespace",
+		"If true, namespaces given with -aws-namespace-name are created when they "+
+			"don't exist. (Defaults to false)")
+	f.flags.Var(&f.flagConfig.AWSNamespaceType, "aws-namespace-type",
+		"The type of namespace created by -aws-create-namespace. "+
+			"Can be \"http\" or \"dns-private\". (Defaults to http)")
+	f.flags.Var(&f.flagConfig.AWSNamespaceVPC, "aws-namespace-vpc",
+		"The VPC to associate with namespaces created with "+
+			"-aws-namespace-type=dns-private.")
+	f.flags.Var(&f.flagConfig.AWSServicePrefix, "aws-service-prefix",
+		"A prefix to prepend to all services written to AWS from Consul. "+
+			"If this is not set then services will have no prefix.")
+	f.flags.Var(&f.flagConfig.ConsulServicePrefix, "consul-service-prefix",
+		"A prefix to prepend to all services written to Consul from AWS. "+
+			"If this is not set then services will have no prefix.")
+	f.flags.Var(&f.flagAWSDeprecatedPullInterval, "aws-pull-interval",
+		"[DEPRECATED] The interval between fetching from AWS CloudMap. "+
+			"Accepts a sequence of decimal numbers, each with optional "+
+			"fraction and a unit suffix, such as \"300ms\", \"10s\", \"1.5m\". "+
+			"Defaults to 30s)")
+	f.flags.Var(&f.flagConfig.AWSPollInterval, "aws-poll-interval",
+		"The interval between fetching from AWS CloudMap. "+
+			"Accepts a sequence of decimal numbers, each with optional "+
+			"fraction and a unit suffix, such as \"300ms\", \"10s\", \"1.5m\". "+
+			"Defaults to 30s)")
+	f.flags.Var(&f.flagConfig.AWSDNSTTL, "aws-dns-ttl",
+		"DNS TTL for services created in AWS CloudMap in seconds. (Defaults to 60)")
+	f.flags.Var(&f.flagConfig.AWSMaxConcurrency, "aws-max-concurrency",
+		"The number of services and instances created, updated or removed in "+
+			"AWS CloudMap at the same time. (Defaults to 10)")
+	f.flags.Var(&f.flagConfig.AWSMaxRequestRate, "aws-max-request-rate",
+		"The maximum number of requests per second made to AWS CloudMap. "+
+			"Throttled requests are retried with backoff regardless. "+
+			"(Defaults to 0, no limit)")
+	f.flags.Var(&f.flagConfig.DeploymentID, "deployment-id",
+		"Identifies this deployment of consul-aws. CloudMap services are tagged "+
+			"with it, and only the services of this deployment are managed. "+
+			"Deployments syncing with the same namespace need distinct IDs. "+
+			"(Defaults to default)")
+	f.flags.Var(&f.flagConfig.AWSAdoptServices, "aws-adopt-services",
+		"If true, CloudMap services created by versions of consul-aws that "+
+			"didn't tag them are tagged as owned by this deployment. They are left "+
+			"alone otherwise, and their instances are not re-keyed to the current "+
+			"ID scheme. Deployments other than the default one also need it to "+
+			"re-key the Consul registrations imported by older versions. "+
+			"(Defaults to false)")
+	f.flags.Var(&f.flagToAWSInclude, "to-aws-include",
+		"Only sync Consul services to AWS whose name matches this pattern. "+
+			"Patterns are globs, or regular expressions when enclosed in "+
+			"slashes, like \"/^web-.*$/\". Can be specified multiple times.")
+	f.flags.Var(&f.flagToAWSExclude, "to-aws-exclude",
+		"Don't sync Consul services to AWS whose name matches this pattern. "+
+			"Takes precedence over -to-aws-include. Can be specified multiple times.")
+	f.flags.Var(&f.flagToAWSIncludeTags, "to-aws-include-tag",
+		"Only sync Consul services to AWS that have this tag. Can be specified "+
+			"multiple times to sync services having any of the tags.")
+	f.flags.Var(&f.flagToAWSExcludeTags, "to-aws-exclude-tag",
+		"Don't sync Consul services to AWS that have this tag. Can be specified "+
+			"multiple times.")
+	f.flags.Var(&f.flagToConsulInclude, "to-consul-include",
+		"Only sync AWS services to Consul whose name matches this pattern. "+
+			"Accepts the same patterns as -to-aws-include. Can be specified "+
+			"multiple times.")
+	f.flags.Var(&f.flagToConsulExclude, "to-consul-exclude",
+		"Don't sync AWS services to Consul whose name matches this pattern. "+
+			"Takes precedence over -to-consul-include. Can be specified multiple times.")
+	f.flags.Var(&f.flagConfig.ToAWSOptIn, "to-aws-opt-in",
+		"If true, only Consul services with the service meta \""+catalog.ConsulOptInMetaKey+
+			"=true\" on any of their instances are synced to AWS. (Defaults to false)")
+	f.flags.Var(&f.flagConfig.ToConsulOptIn, "to-consul-opt-in",
+		"If true, only AWS services tagged with \""+catalog.AWSOptInTagKey+
+			"=true\" are synced to Consul. (Defaults to false)")
+
+	f.http = &flags.HTTPFlags{}
+	flags.Merge(f.flags, f.http.ClientFlags())
+	flags.Merge(f.flags, f.http.ServerFlags())
+}
+
+// initRemovalFlags adds the limits on removals to the flag set, for the
+// commands making changes.
+func (f *syncFlags) initRemovalFlags() {
+	f.flags.Var(&f.flagConfig.MaxRemovals, "max-removals",
+		"The maximum number of instances a single sync run removes from Consul "+
+			"or from an AWS namespace. Runs removing more are refused until "+
+			"confirmed. (Defaults to 0, no limit)")
+	f.flags.Var(&f.flagConfig.MaxRemovalPercent, "max-removal-percent",
+		"The maximum percentage of the synced instances a single sync run "+
+			"removes from Consul or from an AWS namespace. Runs removing more are "+
+			"refused until confirmed. (Defaults to 0, no limit)")
+}
+
+// clients creates the AWS CloudMap and the Consul client.
+func (f *syncFlags) clients() (catalog.CloudMapClient, catalog.ConsulClient, error) {
+	config, err := subcommand.AWSConfig()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error retrieving AWS session: %s", err)
+	}
+	awsClient := sd.NewFromConfig(config)
+
+	consulClient, err := f.http.APIClient()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error connecting to Consul agent: %s", err)
+	}
+	return awsClient, catalog.NewConsulClient(consulClient), nil
+}
+
+// settings merges the configuration files and the flags onto the defaults
+// and validates the result.
+func (f *syncFlags) settings(ui cli.Ui) (settings, error) {
+	s := defaultSettings()
+	configs, err := loadConfigFiles(f.flagConfigFiles)
+	if err != nil {
+		return s, err
+	}
+	for _, config := range configs {
+		config.merge(&s)
+	}
+
+	flagConfig := f.flagConfig
+	flagConfig.AWSNamespaceIDs = f.flagAWSNamespaceIDs
+	flagConfig.AWSNamespaceNames = f.flagAWSNamespaceNames
+	flagConfig.ToAWSInclude = f.flagToAWSInclude
+	flagConfig.ToAWSExclude = f.flagToAWSExclude
+	flagConfig.ToAWSIncludeTags = f.flagToAWSIncludeTags
+	flagConfig.ToAWSExcludeTags = f.flagToAWSExcludeTags
+	flagConfig.ToConsulInclude = f.flagToConsulInclude
+	flagConfig.ToConsulExclude = f.flagToConsulExclude
+	flagConfig.merge(&s)
+	if f.isSet("aws-pull-interval") && !f.isSet("aws-poll-interval") {
+		ui.Info("Please use -aws-poll-interval instead of the deprecated -aws-pull-interval")
+		f.flagAWSDeprecatedPullInterval.Merge(&s.AWSPollInterval)
+	}
+	if f.isSet("stale") {
+		s.Stale = f.http.Stale()
+	}
+	return s, s.validate()
+}
+
+// warnSyncOnce warns about the settings ignored by the commands syncing
+// once.
+func warnSyncOnce(ui cli.Ui, s settings) {
+	if s.RemovalGracePeriod > 0 {
+		ui.Warn("Ignoring the removal grace period, which only applies to sync-catalog")
+	}
+}
+
+// isSet returns true if the flag with the given name was set on the
+// command line.
+func (f *syncFlags) isSet(name string) bool {
+	set := false
+	f.flags.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}